@@ -0,0 +1,231 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// 导出格式不兼容地改变时递增
+const configVersion = 1
+
+// 导出的追踪配置，用于在不同机器间迁移
+type config struct {
+	Version      int                 `json:"version"`
+	Users        []*configUser       `json:"users"`
+	Lsts         []*configLst        `json:"lsts"`
+	LstEntities  []*configLstEntity  `json:"lst_entities"`
+	UserEntities []*configUserEntity `json:"user_entities"`
+	UserLinks    []*configUserLink   `json:"user_links"`
+}
+
+type configUser struct {
+	Id           uint64 `json:"id"`
+	ScreenName   string `json:"screen_name"`
+	Name         string `json:"name"`
+	IsProtected  bool   `json:"protected"`
+	FriendsCount int    `json:"friends_count"`
+}
+
+type configLst struct {
+	Id      uint64 `json:"id"`
+	Name    string `json:"name"`
+	OwnerId uint64 `json:"owner_uid"`
+}
+
+// Id 仅用于在文档内被 user_links 引用，导入时会重新分配
+type configLstEntity struct {
+	Id        int32  `json:"id"`
+	LstId     int64  `json:"lst_id"`
+	Name      string `json:"name"`
+	ParentDir string `json:"parent_dir"`
+}
+
+type configUserEntity struct {
+	Uid               uint64     `json:"user_id"`
+	Name              string     `json:"name"`
+	ParentDir         string     `json:"parent_dir"`
+	LatestReleaseTime *time.Time `json:"latest_release_time,omitempty"`
+	MediaCount        int        `json:"media_count"`
+	PhotoCount        int        `json:"photo_count"`
+	VideoCount        int        `json:"video_count"`
+	GifCount          int        `json:"gif_count"`
+	TotalBytes        int64      `json:"total_bytes"`
+}
+
+type configUserLink struct {
+	Uid               uint64 `json:"user_id"`
+	Name              string `json:"name"`
+	ParentLstEntityId int32  `json:"parent_lst_entity_id"`
+}
+
+// 将追踪的用户、列表及其实体和链接导出为 JSON
+func ExportConfig(db *sqlx.DB, w io.Writer) error {
+	users := []*User{}
+	if err := db.Select(&users, `SELECT * FROM users ORDER BY id`); err != nil {
+		return err
+	}
+	lsts := []*Lst{}
+	if err := db.Select(&lsts, `SELECT * FROM lsts ORDER BY id`); err != nil {
+		return err
+	}
+	lstEntities := []*LstEntity{}
+	if err := db.Select(&lstEntities, `SELECT * FROM lst_entities ORDER BY id`); err != nil {
+		return err
+	}
+	userEntities := []*UserEntity{}
+	if err := db.Select(&userEntities, `SELECT * FROM user_entities ORDER BY id`); err != nil {
+		return err
+	}
+	links := []*UserLink{}
+	if err := db.Select(&links, `SELECT * FROM user_links ORDER BY id`); err != nil {
+		return err
+	}
+	// 导出的路径总是绝对路径，导入方可能使用不同的库根目录
+	o := optionsOf(db)
+	resolveLstEntities(o, lstEntities...)
+	resolveUserEntities(o, userEntities...)
+
+	cfg := &config{
+		Version:      configVersion,
+		Users:        make([]*configUser, 0, len(users)),
+		Lsts:         make([]*configLst, 0, len(lsts)),
+		LstEntities:  make([]*configLstEntity, 0, len(lstEntities)),
+		UserEntities: make([]*configUserEntity, 0, len(userEntities)),
+		UserLinks:    make([]*configUserLink, 0, len(links)),
+	}
+	for _, usr := range users {
+		cfg.Users = append(cfg.Users, &configUser{usr.Id, usr.ScreenName, usr.Name, usr.IsProtected, usr.FriendsCount})
+	}
+	for _, lst := range lsts {
+		cfg.Lsts = append(cfg.Lsts, &configLst{lst.Id, lst.Name, lst.OwnerId})
+	}
+	for _, le := range lstEntities {
+		cfg.LstEntities = append(cfg.LstEntities, &configLstEntity{le.Id.Int32, le.LstId, le.Name, le.ParentDir})
+	}
+	for _, ue := range userEntities {
+		entity := &configUserEntity{Uid: ue.Uid, Name: ue.Name, ParentDir: ue.ParentDir, MediaCount: ue.MediaCount,
+			PhotoCount: ue.PhotoCount, VideoCount: ue.VideoCount, GifCount: ue.GifCount, TotalBytes: ue.TotalBytes}
+		if ue.LatestReleaseTime.Valid {
+			entity.LatestReleaseTime = &ue.LatestReleaseTime.Time
+		}
+		cfg.UserEntities = append(cfg.UserEntities, entity)
+	}
+	for _, link := range links {
+		cfg.UserLinks = append(cfg.UserLinks, &configUserLink{link.Uid, link.Name, link.ParentLstEntityId})
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(cfg)
+}
+
+// 导入 ExportConfig 导出的配置，已存在的记录会被更新
+// parent_dir 在本机不存在的实体及其下的链接会被跳过；已有实体的下载进度不会被覆盖
+func ImportConfig(db *sqlx.DB, r io.Reader) error {
+	cfg := &config{}
+	if err := json.NewDecoder(r).Decode(cfg); err != nil {
+		return err
+	}
+	if cfg.Version != configVersion {
+		return fmt.Errorf("unsupported config version %d", cfg.Version)
+	}
+
+	return withRetry(optionsOf(db), func() error {
+		return WithTx(db, func(tx *Tx) error {
+			return importConfigTx(tx, cfg)
+		})
+	})
+}
+
+func importConfigTx(tx *Tx, cfg *config) error {
+	o := tx.o
+	for _, usr := range cfg.Users {
+		stmt := `INSERT INTO users(id, screen_name, name, protected, friends_count) VALUES(?, ?, ?, ?, ?)
+			ON CONFLICT(id) DO UPDATE SET screen_name=excluded.screen_name, name=excluded.name,
+			protected=excluded.protected, friends_count=excluded.friends_count`
+		if _, err := tx.Exec(stmt, usr.Id, usr.ScreenName, usr.Name, usr.IsProtected, usr.FriendsCount); err != nil {
+			return wrapErr(err)
+		}
+	}
+
+	for _, lst := range cfg.Lsts {
+		stmt := `INSERT INTO lsts(id, name, owner_uid) VALUES(?, ?, ?)
+			ON CONFLICT(id) DO UPDATE SET name=excluded.name, owner_uid=excluded.owner_uid`
+		if _, err := tx.Exec(stmt, lst.Id, lst.Name, lst.OwnerId); err != nil {
+			return wrapErr(err)
+		}
+	}
+
+	// 导出文档中的列表实体 id -> 本地列表实体 id
+	lstEntityIds := make(map[int32]int32)
+	for _, le := range cfg.LstEntities {
+		abs, stored, err := storedPath(o, le.ParentDir)
+		if err != nil {
+			return err
+		}
+		if !dirExists(abs) {
+			continue
+		}
+		stmt := `INSERT INTO lst_entities(lst_id, name, parent_dir) VALUES(?, ?, ?)
+			ON CONFLICT(lst_id, parent_dir) DO UPDATE SET name=excluded.name, updated_at=CURRENT_TIMESTAMP`
+		if _, err := tx.Exec(stmt, le.LstId, le.Name, stored); err != nil {
+			return wrapErr(err)
+		}
+		var id int32
+		if err := tx.Get(&id, `SELECT id FROM lst_entities WHERE lst_id=? AND parent_dir=?`, le.LstId, stored); err != nil {
+			return err
+		}
+		lstEntityIds[le.Id] = id
+	}
+
+	for _, ue := range cfg.UserEntities {
+		abs, stored, err := storedPath(o, ue.ParentDir)
+		if err != nil {
+			return err
+		}
+		if !dirExists(abs) {
+			continue
+		}
+		var latest sql.NullTime
+		if ue.LatestReleaseTime != nil {
+			latest = sql.NullTime{Time: *ue.LatestReleaseTime, Valid: true}
+		}
+		stmt := `INSERT INTO user_entities(user_id, name, parent_dir, latest_release_time, media_count,
+			photo_count, video_count, gif_count, total_bytes) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT(user_id, parent_dir) DO UPDATE SET name=excluded.name,
+			latest_release_time=COALESCE(latest_release_time, excluded.latest_release_time),
+			media_count=CASE media_count WHEN 0 THEN excluded.media_count ELSE media_count END,
+			photo_count=CASE media_count WHEN 0 THEN excluded.photo_count ELSE photo_count END,
+			video_count=CASE media_count WHEN 0 THEN excluded.video_count ELSE video_count END,
+			gif_count=CASE media_count WHEN 0 THEN excluded.gif_count ELSE gif_count END, updated_at=CURRENT_TIMESTAMP`
+		if _, err := tx.Exec(stmt, ue.Uid, ue.Name, stored, latest, ue.MediaCount,
+			ue.PhotoCount, ue.VideoCount, ue.GifCount, ue.TotalBytes); err != nil {
+			return wrapErr(err)
+		}
+	}
+
+	for _, link := range cfg.UserLinks {
+		parent, ok := lstEntityIds[link.ParentLstEntityId]
+		if !ok {
+			continue
+		}
+		stmt := `INSERT INTO user_links(user_id, name, parent_lst_entity_id) VALUES(?, ?, ?)
+			ON CONFLICT(user_id, parent_lst_entity_id) DO UPDATE SET name=excluded.name`
+		if _, err := tx.Exec(stmt, link.Uid, link.Name, parent); err != nil {
+			return wrapErr(err)
+		}
+	}
+
+	return nil
+}
+
+func dirExists(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
@@ -1,13 +1,16 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
+	"github.com/Gwenep/twitter-media-download/internal/utils"
 	"github.com/jmoiron/sqlx"
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -17,14 +20,20 @@ import (
 
 // CreateOrUpdateUserEntityWithPathChange 处理用户实体的创建或更新，支持路径变更
 // 当检测到路径变更但数据库和.user文件存在时，更新现有记录而不是创建新记录
+// 以 WithStrictPaths 打开的数据库只按路径精确匹配
 func CreateOrUpdateUserEntityWithPathChange(db *sqlx.DB, entity *UserEntity, rootPath string) (*UserEntity, error) {
 	// 获取绝对路径
-	absPath, err := filepath.Abs(entity.ParentDir)
+	o := optionsOf(db)
+	absPath, storedDir, err := storedPath(o, entity.ParentDir)
 	if err != nil {
 		return nil, err
 	}
 	entity.ParentDir = absPath
 
+	if o.strictPaths {
+		return createOrUpdateUserEntityStrict(db, entity, storedDir)
+	}
+
 	// 1. 检查新路径下是否已存在与数据库name字段匹配的文件夹
 	entries, err := os.ReadDir(absPath)
 	if err == nil {
@@ -42,8 +51,8 @@ func CreateOrUpdateUserEntityWithPathChange(db *sqlx.DB, entity *UserEntity, roo
 					if entity.Uid != 0 {
 						existingEntity.Uid = entity.Uid
 					}
-					updateStmt := `UPDATE user_entities SET parent_dir=?, name=? WHERE id=?`
-					_, err = db.Exec(updateStmt, existingEntity.ParentDir, existingEntity.Name, existingEntity.Id)
+					updateStmt := `UPDATE user_entities SET parent_dir=?, name=?, updated_at=CURRENT_TIMESTAMP WHERE id=?`
+					_, err = execWithRetry(db, updateStmt, storedDir, existingEntity.Name, existingEntity.Id)
 					if err != nil {
 						return nil, err
 					}
@@ -55,10 +64,9 @@ func CreateOrUpdateUserEntityWithPathChange(db *sqlx.DB, entity *UserEntity, roo
 		}
 	}
 
-	// 2. 首先检查新路径下是否存在.user文件
-	newUserFilePath := filepath.Join(absPath, ".user")
-	if _, err := os.Stat(newUserFilePath); err == nil {
-		// 新路径下存在.user文件，尝试查找该用户的所有实体记录
+	// 2. 首先检查新路径下的实体目录中是否存在属于该用户的.user文件
+	if entity.Name != "" && isUserFileOf(filepath.Join(absPath, entity.Name), entity.Uid) {
+		// 新路径下存在该用户的.user文件，尝试查找该用户的所有实体记录
 		var entities []*UserEntity
 		stmt := `SELECT * FROM user_entities WHERE user_id=?`
 		err = db.Select(&entities, stmt, entity.Uid)
@@ -70,8 +78,8 @@ func CreateOrUpdateUserEntityWithPathChange(db *sqlx.DB, entity *UserEntity, roo
 		if len(entities) > 0 {
 			// 更新第一个找到的实体记录的路径
 			existingEntity := entities[0]
-			updateStmt := `UPDATE user_entities SET parent_dir=?, name=? WHERE id=?`
-			_, err = db.Exec(updateStmt, entity.ParentDir, entity.Name, existingEntity.Id)
+			updateStmt := `UPDATE user_entities SET parent_dir=?, name=?, updated_at=CURRENT_TIMESTAMP WHERE id=?`
+			_, err = execWithRetry(db, updateStmt, storedDir, entity.Name, existingEntity.Id)
 			if err != nil {
 				return nil, err
 			}
@@ -94,13 +102,12 @@ func CreateOrUpdateUserEntityWithPathChange(db *sqlx.DB, entity *UserEntity, roo
 
 	// 检查是否存在匹配的实体记录
 	for _, existingEntity := range entities {
-		// 检查现有记录指向的目录是否有.user文件
-		userFilePath := filepath.Join(existingEntity.ParentDir, ".user")
-		if _, err := os.Stat(userFilePath); err == nil {
-			// .user文件存在，认为是同一用户的下载记录
+		// 检查现有记录指向的实体目录中是否有属于该用户的.user文件
+		if isUserFileOf(filepath.Join(resolvePath(o, existingEntity.ParentDir), existingEntity.Name), entity.Uid) {
+			// .user文件存在且uid一致，认为是同一用户的下载记录
 			// 更新现有记录的路径
-			updateStmt := `UPDATE user_entities SET parent_dir=?, name=? WHERE id=?`
-			_, err = db.Exec(updateStmt, entity.ParentDir, entity.Name, existingEntity.Id)
+			updateStmt := `UPDATE user_entities SET parent_dir=?, name=?, updated_at=CURRENT_TIMESTAMP WHERE id=?`
+			_, err = execWithRetry(db, updateStmt, storedDir, entity.Name, existingEntity.Id)
 			if err != nil {
 				return nil, err
 			}
@@ -113,8 +120,8 @@ func CreateOrUpdateUserEntityWithPathChange(db *sqlx.DB, entity *UserEntity, roo
 	}
 
 	// 如果没有找到匹配的实体记录，创建新记录
-	insertStmt := `INSERT INTO user_entities(user_id, name, parent_dir) VALUES(:user_id, :name, :parent_dir)`
-	de, err := db.NamedExec(insertStmt, entity)
+	insertStmt := `INSERT INTO user_entities(user_id, name, parent_dir) VALUES(?, ?, ?)`
+	de, err := execWithRetry(db, insertStmt, entity.Uid, entity.Name, storedDir)
 	if err != nil {
 		return nil, err
 	}
@@ -127,10 +134,33 @@ func CreateOrUpdateUserEntityWithPathChange(db *sqlx.DB, entity *UserEntity, roo
 	return entity, nil
 }
 
+// 只复用同一路径下已有的实体，不做任何基于目录名或 .user 文件的迁移
+func createOrUpdateUserEntityStrict(db *sqlx.DB, entity *UserEntity, storedDir string) (*UserEntity, error) {
+	existingEntity := &UserEntity{}
+	stmt := `SELECT * FROM user_entities WHERE user_id=? AND parent_dir=?`
+	err := db.Get(existingEntity, stmt, entity.Uid, storedDir)
+	if err == sql.ErrNoRows {
+		return entity, CreateUserEntity(db, entity)
+	}
+	if err != nil {
+		return nil, err
+	}
+	existingEntity.ParentDir = entity.ParentDir
+
+	if existingEntity.Name != entity.Name {
+		updateStmt := `UPDATE user_entities SET name=?, updated_at=CURRENT_TIMESTAMP WHERE id=?`
+		if _, err := execWithRetry(db, updateStmt, entity.Name, existingEntity.Id); err != nil {
+			return nil, err
+		}
+		existingEntity.Name = entity.Name
+	}
+	return existingEntity, nil
+}
+
 // CreateOrUpdateLstEntityWithPathChange 处理列表实体的创建或更新，支持路径变更
 func CreateOrUpdateLstEntityWithPathChange(db *sqlx.DB, entity *LstEntity) (*LstEntity, error) {
 	// 获取绝对路径
-	absPath, err := filepath.Abs(entity.ParentDir)
+	absPath, storedDir, err := storedPath(optionsOf(db), entity.ParentDir)
 	if err != nil {
 		return nil, err
 	}
@@ -150,8 +180,8 @@ func CreateOrUpdateLstEntityWithPathChange(db *sqlx.DB, entity *LstEntity) (*Lst
 		// 当用户更改下载路径时，保持列表名称不变，认为是同一列表
 		if strings.EqualFold(existingEntity.Name, entity.Name) {
 			// 更新现有记录的路径
-			updateStmt := `UPDATE lst_entities SET parent_dir=? WHERE id=?`
-			_, err = db.Exec(updateStmt, entity.ParentDir, existingEntity.Id)
+			updateStmt := `UPDATE lst_entities SET parent_dir=?, updated_at=CURRENT_TIMESTAMP WHERE id=?`
+			_, err = execWithRetry(db, updateStmt, storedDir, existingEntity.Id)
 			if err != nil {
 				return nil, err
 			}
@@ -163,8 +193,8 @@ func CreateOrUpdateLstEntityWithPathChange(db *sqlx.DB, entity *LstEntity) (*Lst
 	}
 
 	// 如果没有找到匹配的实体记录，创建新记录
-	insertStmt := `INSERT INTO lst_entities(lst_id, name, parent_dir) VALUES(:lst_id, :name, :parent_dir)`
-	r, err := db.NamedExec(insertStmt, &entity)
+	insertStmt := `INSERT INTO lst_entities(lst_id, name, parent_dir) VALUES(?, ?, ?)`
+	r, err := execWithRetry(db, insertStmt, entity.LstId, entity.Name, storedDir)
 	if err != nil {
 		return nil, err
 	}
@@ -241,19 +271,81 @@ CREATE INDEX IF NOT EXISTS idx_user_links_user_id ON user_links (user_id);
 `
 
 func CreateTables(db *sqlx.DB) {
-	db.MustExec(schema)
+	if err := Migrate(db); err != nil {
+		panic(err)
+	}
 }
 
 func CreateUser(db *sqlx.DB, usr *User) error {
+	return withRetry(optionsOf(db), func() error {
+		return WithTx(db, func(tx *Tx) error {
+			return CreateUserTx(tx, usr)
+		})
+	})
+}
+
+// 在调用者提供的事务（WithTx、Begin 开启的 *Tx）中创建用户，不会重试
+func CreateUserTx(ext sqlx.Ext, usr *User) error {
 	stmt := `INSERT INTO Users(id, screen_name, name, protected, friends_count) VALUES(:id, :screen_name, :name, :protected, :friends_count)`
-	_, err := db.NamedExec(stmt, usr)
-	return err
+	if _, err := sqlx.NamedExec(ext, stmt, usr); err != nil {
+		return wrapErr(err)
+	}
+	return recordFriendsCount(ext, usr.Id, usr.FriendsCount)
 }
 
+// 删除用户及其曾用名和关注数历史，关注列表中解析到该用户的条目恢复为未解析
+// 用户仍有实体或链接时返回 ErrConstraint，需要一并删除请使用 DeleteUserCascade
 func DelUser(db *sqlx.DB, uid uint64) error {
-	stmt := `DELETE FROM users WHERE id=?`
-	_, err := db.Exec(stmt, uid)
-	return err
+	return withRetry(optionsOf(db), func() error {
+		return WithTx(db, func(tx *Tx) error {
+			stmts := []string{
+				`DELETE FROM user_previous_names WHERE uid=?`,
+				`DELETE FROM user_friends_history WHERE uid=?`,
+				`UPDATE watchlist SET resolved_uid=NULL WHERE resolved_uid=?`,
+				`DELETE FROM users WHERE id=?`,
+			}
+			for _, stmt := range stmts {
+				if _, err := tx.Exec(stmt, uid); err != nil {
+					return wrapErr(err)
+				}
+			}
+			return nil
+		})
+	})
+}
+
+// 在同一事务中删除用户及其链接、实体（下载错误随之级联删除）、曾用名和关注数历史，
+// 关注列表中解析到该用户的条目恢复为未解析。用户不存在时 deleted 为 false
+func DeleteUserCascade(db *sqlx.DB, uid uint64) (deleted bool, err error) {
+	err = withRetry(optionsOf(db), func() error {
+		return WithTx(db, func(tx *Tx) error {
+			stmts := []string{
+				`DELETE FROM user_links WHERE user_id=?`,
+				`DELETE FROM user_entities WHERE user_id=?`,
+				`DELETE FROM user_previous_names WHERE uid=?`,
+				`DELETE FROM user_friends_history WHERE uid=?`,
+				`DELETE FROM user_tags WHERE uid=?`,
+				`UPDATE watchlist SET resolved_uid=NULL WHERE resolved_uid=?`,
+			}
+			for _, stmt := range stmts {
+				if _, err := tx.Exec(stmt, uid); err != nil {
+					return wrapErr(err)
+				}
+			}
+
+			res, err := tx.Exec(`DELETE FROM users WHERE id=?`, uid)
+			if err != nil {
+				return wrapErr(err)
+			}
+			n, err := res.RowsAffected()
+			if err != nil {
+				return err
+			}
+			deleted = n > 0
+			return nil
+		})
+	})
+	return deleted, err
 }
 
 func GetUserById(db *sqlx.DB, uid uint64) (*User, error) {
@@ -262,7 +354,22 @@ func GetUserById(db *sqlx.DB, uid uint64) (*User, error) {
 	err := db.Get(result, stmt, uid)
 	if err == sql.ErrNoRows {
 		result = nil
-		err = nil
+		err = notFoundErr(db)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// 按 screen_name 查找用户（不区分大小写），不存在时返回 nil
+func GetUserByScreenName(db *sqlx.DB, screenName string) (*User, error) {
+	stmt := `SELECT * FROM users WHERE screen_name=? COLLATE NOCASE`
+	result := &User{}
+	err := db.Get(result, stmt, screenName)
+	if err == sql.ErrNoRows {
+		result = nil
+		err = notFoundErr(db)
 	}
 	if err != nil {
 		return nil, err
@@ -270,26 +377,226 @@ func GetUserById(db *sqlx.DB, uid uint64) (*User, error) {
 	return result, nil
 }
 
+// 旧版本 SQLite 单条语句最多允许 999 个参数
+const maxInParams = 500
+
+// 批量获取用户，不存在的 id 不会出现在结果中
+func GetUsersByIds(db *sqlx.DB, ids []uint64) (map[uint64]*User, error) {
+	res := make(map[uint64]*User, len(ids))
+	for start := 0; start < len(ids); start += maxInParams {
+		end := min(start+maxInParams, len(ids))
+		query, args, err := sqlx.In(`SELECT * FROM users WHERE id IN (?)`, ids[start:end])
+		if err != nil {
+			return nil, err
+		}
+		users := []*User{}
+		if err := db.Select(&users, db.Rebind(query), args...); err != nil {
+			return nil, err
+		}
+		for _, usr := range users {
+			res[usr.Id] = usr
+		}
+	}
+	return res, nil
+}
+
+// 按 screen_name 前缀查找用户（不区分大小写），前缀中的 % 和 _ 按字面匹配
+func SearchUsersByScreenName(db *sqlx.DB, prefix string, limit int) ([]*User, error) {
+	if limit <= 0 {
+		limit = -1
+	}
+	stmt := `SELECT * FROM users WHERE screen_name LIKE ? ESCAPE '\' ORDER BY screen_name COLLATE NOCASE LIMIT ?`
+	res := []*User{}
+	err := db.Select(&res, stmt, escapeLike(prefix)+"%", limit)
+	return res, err
+}
+
+// 查找 parent_dir 中包含 substring 的用户实体（不区分 ASCII 大小写），按 parent_dir 和 id 排序
+// 与解析后的绝对路径匹配，设置了库根目录时也能按根目录中的部分查找
+func SearchEntitiesByPath(db *sqlx.DB, substring string) ([]*UserEntity, error) {
+	o := optionsOf(db)
+	where, args := pathSearchCond(o, substring)
+	entities := []*UserEntity{}
+	if err := db.Select(&entities, `SELECT * FROM user_entities WHERE `+where+` ORDER BY id`, args...); err != nil {
+		return nil, err
+	}
+	resolveUserEntities(o, entities...)
+
+	needle := asciiLower(substring)
+	res := []*UserEntity{}
+	for _, entity := range entities {
+		if strings.Contains(asciiLower(entity.ParentDir), needle) {
+			res = append(res, entity)
+		}
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		return asciiLower(res[i].ParentDir) < asciiLower(res[j].ParentDir)
+	})
+	return res, nil
+}
+
+// 同 SearchEntitiesByPath，但同时查找用户实体和列表实体，同一目录下用户实体在前
+func SearchAllEntitiesByPath(db *sqlx.DB, substring string) ([]*EntityPathMatch, error) {
+	o := optionsOf(db)
+	where, args := pathSearchCond(o, substring)
+	stmt := `SELECT 'user' AS kind, id, user_id AS owner_id, name, parent_dir FROM user_entities WHERE ` + where + `
+		UNION ALL
+		SELECT 'lst' AS kind, id, lst_id AS owner_id, name, parent_dir FROM lst_entities WHERE ` + where + `
+		ORDER BY kind DESC, id`
+	matches := []*EntityPathMatch{}
+	if err := db.Select(&matches, stmt, append(args, args...)...); err != nil {
+		return nil, err
+	}
+
+	needle := asciiLower(substring)
+	res := []*EntityPathMatch{}
+	for _, match := range matches {
+		match.ParentDir = resolvePath(o, match.ParentDir)
+		if strings.Contains(asciiLower(match.ParentDir), needle) {
+			res = append(res, match)
+		}
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		return asciiLower(res[i].ParentDir) < asciiLower(res[j].ParentDir)
+	})
+	return res, nil
+}
+
+// 按存储的 parent_dir 筛选路径中包含 substring 的记录，LIKE 只忽略 ASCII 大小写，与 asciiLower 一致
+// 设置了库根目录时相对路径还要按 / 分隔的形式匹配，substring 也可能从根目录中开始，
+// 此时其余部分须是相对路径的前缀；这样筛出的是超集，调用方需按解析后的路径再确认一次
+func pathSearchCond(o *options, substring string) (string, []any) {
+	patterns := []string{"%" + escapeLike(substring) + "%"}
+	if o.libraryRoot != "" {
+		sep := string(filepath.Separator)
+		prefix := asciiLower(strings.TrimSuffix(o.libraryRoot, sep) + sep)
+		needle := asciiLower(substring)
+		patterns = append(patterns, "%"+escapeLike(filepath.ToSlash(substring))+"%")
+		if strings.Contains(prefix, needle) {
+			patterns = append(patterns, "%")
+		}
+		for i := 1; i < len(needle); i++ {
+			if strings.HasSuffix(prefix, needle[:i]) {
+				patterns = append(patterns, escapeLike(filepath.ToSlash(substring[i:]))+"%")
+			}
+		}
+	}
+
+	conds := make([]string, len(patterns))
+	args := make([]any, len(patterns))
+	for i, pattern := range patterns {
+		conds[i] = `parent_dir LIKE ? ESCAPE '\'`
+		args[i] = pattern
+	}
+	return "(" + strings.Join(conds, " OR ") + ")", args
+}
+
+// 受保护的用户，可能无法下载其推文
+func ListProtectedUsers(db *sqlx.DB) ([]*User, error) {
+	return listUsersByProtected(db, true)
+}
+
+func ListAccessibleUsers(db *sqlx.DB) ([]*User, error) {
+	return listUsersByProtected(db, false)
+}
+
+func listUsersByProtected(db *sqlx.DB, protected bool) ([]*User, error) {
+	stmt := `SELECT * FROM users WHERE protected=? ORDER BY screen_name COLLATE NOCASE`
+	res := []*User{}
+	err := db.Select(&res, stmt, protected)
+	return res, err
+}
+
+// 没有任何用户链接、即不是通过列表追踪的用户，按 screen_name 排序
+func ListUsersWithoutLinks(db *sqlx.DB) ([]*User, error) {
+	stmt := `SELECT users.* FROM users
+		LEFT JOIN user_links ON user_links.user_id = users.id
+		WHERE user_links.id IS NULL
+		ORDER BY users.screen_name COLLATE NOCASE`
+	res := []*User{}
+	err := db.Select(&res, stmt)
+	return res, err
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+func escapeLike(s string) string {
+	return likeEscaper.Replace(s)
+}
+
+// friends_count 变化时同时追加一条关注数历史
 func UpdateUser(db *sqlx.DB, usr *User) error {
-	stmt := `UPDATE users SET screen_name=:screen_name, name=:name, protected=:protected, friends_count=:friends_count WHERE id=:id`
-	_, err := db.NamedExec(stmt, usr)
-	return err
+	return withRetry(optionsOf(db), func() error {
+		return WithTx(db, func(tx *Tx) error {
+			var prev int
+			err := tx.Get(&prev, `SELECT friends_count FROM users WHERE id=?`, usr.Id)
+			if err == sql.ErrNoRows {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+
+			stmt := `UPDATE users SET screen_name=:screen_name, name=:name, protected=:protected, friends_count=:friends_count WHERE id=:id`
+			if _, err = tx.NamedExec(stmt, usr); err != nil {
+				return wrapErr(err)
+			}
+			if prev != usr.FriendsCount {
+				if err = recordFriendsCount(tx, usr.Id, usr.FriendsCount); err != nil {
+					return wrapErr(err)
+				}
+			}
+			return nil
+		})
+	})
 }
 
 func CreateUserEntity(db *sqlx.DB, entity *UserEntity) error {
 	// 这里我们使用新的路径变更处理函数
 	// 由于原始函数接口不支持传入rootPath参数，我们在这里简单包装
 	// 注意：在main.go中调用时应该使用CreateOrUpdateUserEntityWithPathChange
-	abs, err := filepath.Abs(entity.ParentDir)
+	return withRetry(optionsOf(db), func() error {
+		return CreateUserEntityTx(db, entity)
+	})
+}
+
+// 在创建前检查用户在 parentDir 下是否已有实体，不修改数据库
+// 路径可用时返回 true；否则返回 false 和占用该路径的实体。与 UNIQUE(user_id, parent_dir) 一致，路径不区分 ASCII 大小写
+func CanCreateUserEntity(db *sqlx.DB, uid uint64, parentDir string) (bool, *UserEntity, error) {
+	o := optionsOf(db)
+	_, storedDir, err := storedPath(o, parentDir)
+	if err != nil {
+		return false, nil, err
+	}
+
+	existing := &UserEntity{}
+	err = db.Get(existing, `SELECT * FROM user_entities WHERE user_id=? AND parent_dir=?`, uid, storedDir)
+	if err == sql.ErrNoRows {
+		return true, nil, nil
+	}
+	if err != nil {
+		return false, nil, err
+	}
+	resolveUserEntities(o, existing)
+	return false, existing, nil
+}
+
+// 在调用者提供的事务中创建用户实体，不会重试；ext 为 *sqlx.DB 或 WithTx、Begin 开启的 *Tx，以便按数据库的选项存储路径
+func CreateUserEntityTx(ext sqlx.Ext, entity *UserEntity) error {
+	o, err := optionsOfExt(ext)
+	if err != nil {
+		return err
+	}
+	abs, stored, err := storedPath(o, entity.ParentDir)
 	if err != nil {
 		return err
 	}
 	entity.ParentDir = abs
 
-	stmt := `INSERT INTO user_entities(user_id, name, parent_dir) VALUES(:user_id, :name, :parent_dir)`
-	de, err := db.NamedExec(stmt, entity)
+	stmt := `INSERT INTO user_entities(user_id, name, parent_dir) VALUES(?, ?, ?)`
+	de, err := ext.Exec(stmt, entity.Uid, entity.Name, stored)
 	if err != nil {
-		return err
+		return wrapErr(err)
 	}
 	lastId, err := de.LastInsertId()
 	if err != nil {
@@ -302,45 +609,89 @@ func CreateUserEntity(db *sqlx.DB, entity *UserEntity) error {
 
 func DelUserEntity(db *sqlx.DB, id uint32) error {
 	stmt := `DELETE FROM user_entities WHERE id=?`
-	_, err := db.Exec(stmt, id)
+	_, err := execWithRetry(db, stmt, id)
 	return err
 }
 
 func LocateUserEntity(db *sqlx.DB, uid uint64, parentDIr string) (*UserEntity, error) {
-	absPath, err := filepath.Abs(parentDIr)
+	entity, pathChanged, err := FindUserEntity(db, uid, parentDIr)
+	if err != nil || entity == nil || !pathChanged {
+		return entity, err
+	}
+
+	absPath, err := normalizePath(parentDIr)
 	if err != nil {
 		return nil, err
 	}
+	// 打印提示信息，告知用户路径已变更
+	fmt.Printf("路径匹配提示: 用户 %d 的下载记录已从 '%s' 移动到 '%s'\n", uid, entity.ParentDir, absPath)
+	if err := RelocateUserEntity(db, entity, absPath); err != nil {
+		return nil, err
+	}
+	return entity, nil
+}
 
-	// 首先检查新路径下是否存在.user文件
-	newUserFilePath := filepath.Join(absPath, ".user")
-	if _, err := os.Stat(newUserFilePath); err == nil {
-		// 新路径下存在.user文件，尝试查找该用户的所有实体记录
+// 查找用户在 parentDir 下的实体，不修改数据库
+// pathChanged 为 true 表示通过 .user 文件匹配到了位于其他目录的实体，返回的实体仍是原路径
+func FindUserEntity(db *sqlx.DB, uid uint64, parentDir string) (*UserEntity, bool, error) {
+	rel, err := PreviewRelocation(db, uid, parentDir)
+	if err != nil || rel == nil {
+		return nil, false, err
+	}
+	return rel.Entity, rel.OldDir != rel.NewDir, nil
+}
+
+// 将实体移动到 parentDir 并更新 entity.ParentDir
+func RelocateUserEntity(db *sqlx.DB, entity *UserEntity, parentDir string) error {
+	parentDir, stored, err := storedPath(optionsOf(db), parentDir)
+	if err != nil {
+		return err
+	}
+	stmt := `UPDATE user_entities SET parent_dir=?, updated_at=CURRENT_TIMESTAMP WHERE id=?`
+	if _, err := execWithRetry(db, stmt, stored, entity.Id); err != nil {
+		return err
+	}
+	entity.ParentDir = parentDir
+	return nil
+}
+
+// PreviewRelocation 执行与 LocateUserEntity 相同的匹配，但不修改数据库
+// 以 WithStrictPaths 打开的数据库只按路径精确匹配
+// 没有匹配到实体时返回 nil；Entity 中的路径为变更前的路径
+func PreviewRelocation(db *sqlx.DB, uid uint64, parentDir string) (*Relocation, error) {
+	o := optionsOf(db)
+	absPath, storedDir, err := storedPath(o, parentDir)
+	if err != nil {
+		return nil, err
+	}
+
+	strict := o.strictPaths
+
+	// 首先检查新路径下是否有该用户的实体目录，即其中的.user文件属于该用户
+	if !strict {
 		var entities []*UserEntity
 		listStmt := `SELECT * FROM user_entities WHERE user_id=?`
 		err = db.Select(&entities, listStmt, uid)
 		if err != nil {
 			return nil, err
 		}
-		
-		// 如果找到实体记录，更新路径并返回
-		if len(entities) > 0 {
-			// 更新第一个找到的实体记录的路径
-			entity := entities[0]
-			updateStmt := `UPDATE user_entities SET parent_dir=? WHERE id=?`
-			db.Exec(updateStmt, absPath, entity.Id)
-			
-			// 更新实体的路径
-			entity.ParentDir = absPath
-			fmt.Printf("路径匹配提示: 用户 %d 的下载记录已更新到新路径 '%s'\n", uid, absPath)
-			return entity, nil
+		resolveUserEntities(o, entities...)
+
+		// 将第一个在新路径下找到目录的实体记录移动到新路径
+		for _, entity := range entities {
+			if isUserFileOf(filepath.Join(absPath, entity.Name), uid) {
+				return &Relocation{entity, entity.ParentDir, absPath, MatchedUserFileInNewDir}, nil
+			}
 		}
 	}
 
 	// 然后尝试直接匹配路径
 	stmt := `SELECT * FROM user_entities WHERE user_id=? AND parent_dir=?`
 	result := &UserEntity{}
-	err = db.Get(result, stmt, uid, absPath)
+	err = db.Get(result, stmt, uid, storedDir)
+	if err == sql.ErrNoRows && strict {
+		return nil, nil
+	}
 	if err == sql.ErrNoRows {
 		// 直接匹配失败，尝试基于.user文件存在性来查找匹配的实体
 		var entities []*UserEntity
@@ -349,32 +700,23 @@ func LocateUserEntity(db *sqlx.DB, uid uint64, parentDIr string) (*UserEntity, e
 		if err != nil {
 			return nil, err
 		}
-		
-		// 检查每个实体的目录中是否存在.user文件
+		resolveUserEntities(o, entities...)
+
+		// 检查每个实体的目录中是否存在属于该用户的.user文件
 		for _, entity := range entities {
-			userFilePath := filepath.Join(entity.ParentDir, ".user")
-			if _, err := os.Stat(userFilePath); err == nil {
-				// .user文件存在，认为是同一用户的下载记录
-				// 打印提示信息，告知用户路径已变更
-				fmt.Printf("路径匹配提示: 用户 %d 的下载记录已从 '%s' 移动到 '%s'\n", 
-					uid, entity.ParentDir, absPath)
-				
-				// 更新数据库中的路径信息
-				updateStmt := `UPDATE user_entities SET parent_dir=? WHERE id=?`
-				db.Exec(updateStmt, absPath, entity.Id)
-				
-				// 更新实体的路径
-				entity.ParentDir = absPath
-				return entity, nil
+			if isUserFileOf(filepath.Join(entity.ParentDir, entity.Name), uid) {
+				// .user文件存在且uid一致，认为是同一用户的下载记录
+				return &Relocation{entity, entity.ParentDir, absPath, MatchedUserFileInOldDir}, nil
 			}
 		}
-		
+
 		return nil, nil
 	}
 	if err != nil {
 		return nil, err
 	}
-	return result, nil
+	resolveUserEntities(o, result)
+	return &Relocation{result, result.ParentDir, result.ParentDir, MatchedExactPath}, nil
 }
 
 func GetUserEntity(db *sqlx.DB, id int) (*UserEntity, error) {
@@ -383,50 +725,486 @@ func GetUserEntity(db *sqlx.DB, id int) (*UserEntity, error) {
 	err := db.Get(result, stmt, id)
 	if err == sql.ErrNoRows {
 		result = nil
-		err = nil
+		err = notFoundErr(db)
 	}
 	if err != nil {
 		return nil, err
 	}
+	resolveUserEntities(optionsOf(db), result)
 	return result, nil
 }
 
+// 实体的 latest_release_time，第二个返回值为 false 表示从未同步过
+// 实体不存在时按 Get* 的约定返回 notFoundErr
+func GetUserEntityWatermark(db *sqlx.DB, id int) (time.Time, bool, error) {
+	var res sql.NullTime
+	err := db.Get(&res, `SELECT latest_release_time FROM user_entities WHERE id=?`, id)
+	if err == sql.ErrNoRows {
+		return time.Time{}, false, notFoundErr(db)
+	}
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return res.Time, res.Valid, nil
+}
+
+// 按名称查找用户的实体，不区分大小写，不存在时返回 nil, nil
+// 有多个同名实体时返回 latest_release_time 最晚的一个，从未下载过的实体排在最后
+func GetUserEntityByName(db *sqlx.DB, uid uint64, name string) (*UserEntity, error) {
+	stmt := `SELECT * FROM user_entities WHERE user_id=? AND name=? COLLATE NOCASE
+		ORDER BY latest_release_time IS NULL, julianday(latest_release_time) DESC, id DESC LIMIT 1`
+	result := &UserEntity{}
+	err := db.Get(result, stmt, uid, name)
+	if err == sql.ErrNoRows {
+		result = nil
+		err = notFoundErr(db)
+	}
+	if err != nil {
+		return nil, err
+	}
+	resolveUserEntities(optionsOf(db), result)
+	return result, nil
+}
+
+func GetUserEntityWithUser(db *sqlx.DB, id int) (*UserEntityWithUser, error) {
+	stmt := `SELECT user_entities.*, COALESCE(users.screen_name, '') AS screen_name, COALESCE(users.name, '') AS user_name
+		FROM user_entities LEFT JOIN users ON users.id = user_entities.user_id
+		WHERE user_entities.id=?`
+	result := &UserEntityWithUser{}
+	err := db.Get(result, stmt, id)
+	if err == sql.ErrNoRows {
+		result = nil
+		err = notFoundErr(db)
+	}
+	if err != nil || result == nil {
+		return nil, err
+	}
+	resolveUserEntities(optionsOf(db), &result.UserEntity)
+	return result, nil
+}
+
+// 下载器为用户实体目录使用的名称，形如 name(screen_name)，去掉了文件名中不允许的字符
+func UserEntityTitle(screenName, name string) string {
+	return utils.WinFileName(fmt.Sprintf("%s(%s)", name, screenName))
+}
+
+// 返回名称与所属用户当前名称不一致的用户实体，只读，重命名目录和更新记录由调用者完成
+// expectedName 根据用户的 screen_name 和 name 计算实体应有的名称，为 nil 时使用 UserEntityTitle
+func GetUserEntitiesNeedingNameUpdate(db *sqlx.DB, expectedName func(screenName, name string) string) ([]*UserEntityWithUser, error) {
+	res, err := userEntitiesNeedingNameUpdate(db, expectedName)
+	if err != nil {
+		return nil, err
+	}
+	o := optionsOf(db)
+	for _, entity := range res {
+		resolveUserEntities(o, &entity.UserEntity)
+	}
+	return res, nil
+}
+
+// parent_dir 未解析
+func userEntitiesNeedingNameUpdate(q sqlx.Queryer, expectedName func(screenName, name string) string) ([]*UserEntityWithUser, error) {
+	if expectedName == nil {
+		expectedName = UserEntityTitle
+	}
+
+	stmt := `SELECT user_entities.*, users.screen_name AS screen_name, users.name AS user_name
+		FROM user_entities JOIN users ON users.id = user_entities.user_id
+		ORDER BY user_entities.id`
+	entities := []*UserEntityWithUser{}
+	if err := sqlx.Select(q, &entities, stmt); err != nil {
+		return nil, err
+	}
+
+	res := []*UserEntityWithUser{}
+	for _, entity := range entities {
+		if entity.Name != expectedName(entity.ScreenName, entity.UserName) {
+			res = append(res, entity)
+		}
+	}
+	return res, nil
+}
+
+// 按用户所有实体中最晚的 latest_release_time 由新到旧返回用户，没有实体或从未同步过的用户排在最后
+// limit <= 0 时不限制数量
+func GetRecentlyActiveUsers(db *sqlx.DB, limit int) ([]*User, error) {
+	if limit <= 0 {
+		limit = -1
+	}
+	stmt := `SELECT users.* FROM users
+		LEFT JOIN user_entities ON user_entities.user_id = users.id
+		GROUP BY users.id
+		ORDER BY MAX(julianday(user_entities.latest_release_time)) IS NULL,
+			MAX(julianday(user_entities.latest_release_time)) DESC, users.id
+		LIMIT ?`
+	res := []*User{}
+	err := db.Select(&res, stmt, limit)
+	return res, err
+}
+
+// 暂停或恢复实体的下载，暂停的实体保留下载进度，仍出现在统计和查询结果中，只是不再被同步
+// 实体不存在时返回 ErrNotFound
+func SetUserEntityPaused(db *sqlx.DB, id int, paused bool) error {
+	stmt := `UPDATE user_entities SET paused=?, updated_at=CURRENT_TIMESTAMP WHERE id=?`
+	res, err := execWithRetry(db, stmt, paused, id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("%w: user entity %d", ErrNotFound, id)
+	}
+	return nil
+}
+
+// 保存调用方根据实体的文件列表计算出的校验值，实体不存在时返回 ErrNotFound
+func UpdateUserEntityContentHash(db *sqlx.DB, id int, hash string) error {
+	stmt := `UPDATE user_entities SET content_hash=?, updated_at=CURRENT_TIMESTAMP WHERE id=?`
+	res, err := execWithRetry(db, stmt, hash, id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("%w: user entity %d", ErrNotFound, id)
+	}
+	return nil
+}
+
+// hashes 为实体 id 到当前计算出的校验值，返回其中已保存的校验值与之不同或尚未保存校验值的实体，按 id 排序
+// hashes 中不存在的实体被忽略
+func GetUserEntitiesWithChangedContent(db *sqlx.DB, hashes map[int]string) ([]*UserEntity, error) {
+	ids := make([]int, 0, len(hashes))
+	for id := range hashes {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	res := []*UserEntity{}
+	for start := 0; start < len(ids); start += maxInParams {
+		end := min(start+maxInParams, len(ids))
+		query, args, err := sqlx.In(`SELECT * FROM user_entities WHERE id IN (?) ORDER BY id`, ids[start:end])
+		if err != nil {
+			return nil, err
+		}
+		entities := []*UserEntity{}
+		if err := db.Select(&entities, db.Rebind(query), args...); err != nil {
+			return nil, err
+		}
+		for _, entity := range entities {
+			if !entity.ContentHash.Valid || entity.ContentHash.String != hashes[int(entity.Id.Int32)] {
+				res = append(res, entity)
+			}
+		}
+	}
+	resolveUserEntities(optionsOf(db), res...)
+	return res, nil
+}
+
+// 所有未暂停的用户实体，按 id 排序，供选择需要同步的实体
+func ListActiveUserEntities(db *sqlx.DB) ([]*UserEntity, error) {
+	res := []*UserEntity{}
+	err := db.Select(&res, `SELECT * FROM user_entities WHERE NOT paused ORDER BY id`)
+	resolveUserEntities(optionsOf(db), res...)
+	return res, err
+}
+
+// 返回 since 之后创建或修改过的用户实体，按修改时间由旧到新排序
+// updated_at 由 CURRENT_TIMESTAMP 写入，是精确到秒的 UTC 文本，直接按文本比较以便使用索引；
+// 与 since 在同一秒内的修改也会返回，宁可重复也不遗漏
+func GetUserEntitiesModifiedSince(db *sqlx.DB, since time.Time) ([]*UserEntity, error) {
+	stmt := `SELECT * FROM user_entities WHERE updated_at >= ? ORDER BY updated_at, id`
+	res := []*UserEntity{}
+	err := db.Select(&res, stmt, since.UTC().Format(time.DateTime))
+	resolveUserEntities(optionsOf(db), res...)
+	return res, err
+}
+
+// 返回 latest_release_time 为空或早于 olderThan 的用户实体，从未同步过的排在最前，其余由旧到新
+// latest_release_time 以带时区的文本存储，比较时转换为 julianday 以免受时区影响
+// limit <= 0 时不限制数量
+func GetStaleUserEntities(db *sqlx.DB, olderThan time.Time, limit int) ([]*UserEntity, error) {
+	if limit <= 0 {
+		limit = -1
+	}
+	stmt := `SELECT * FROM user_entities
+		WHERE latest_release_time IS NULL OR julianday(latest_release_time) < julianday(?)
+		ORDER BY latest_release_time IS NOT NULL, julianday(latest_release_time), id
+		LIMIT ?`
+	res := []*UserEntity{}
+	err := db.Select(&res, stmt, olderThan, limit)
+	resolveUserEntities(optionsOf(db), res...)
+	return res, err
+}
+
+func QueryUserEntities(db *sqlx.DB, q EntityQuery) ([]*UserEntity, error) {
+	conds := []string{}
+	args := []any{}
+	if q.Protected.Valid {
+		conds = append(conds, `user_id IN (SELECT id FROM users WHERE protected=?)`)
+		args = append(args, q.Protected.Bool)
+	}
+	if q.StaleBefore.Valid {
+		conds = append(conds, `(latest_release_time IS NULL OR julianday(latest_release_time) < julianday(?))`)
+		args = append(args, q.StaleBefore.Time)
+	}
+	if q.MinMediaCount.Valid {
+		conds = append(conds, `media_count >= ?`)
+		args = append(args, q.MinMediaCount.Int32)
+	}
+	if q.MaxMediaCount.Valid {
+		conds = append(conds, `media_count <= ?`)
+		args = append(args, q.MaxMediaCount.Int32)
+	}
+	if q.Paused.Valid {
+		conds = append(conds, `paused=?`)
+		args = append(args, q.Paused.Bool)
+	}
+	if q.Tag.Valid {
+		conds = append(conds, `user_id IN (SELECT uid FROM user_tags JOIN tags ON tags.id = user_tags.tag_id WHERE tags.name=?)`)
+		args = append(args, strings.TrimSpace(q.Tag.String))
+	}
+
+	stmt := `SELECT * FROM user_entities`
+	if len(conds) != 0 {
+		stmt += ` WHERE ` + strings.Join(conds, ` AND `)
+	}
+	stmt += ` ORDER BY id`
+
+	res := []*UserEntity{}
+	err := db.Select(&res, stmt, args...)
+	resolveUserEntities(optionsOf(db), res...)
+	return res, err
+}
+
+// 按 id 顺序逐行读取所有用户实体并调用 fn，不会一次性载入整个表；fn 返回错误时停止并返回该错误
+// 遍历期间占用一个连接，只有一个连接的数据库（如内存数据库）不能在 fn 中再访问 db，否则会一直等待
+func IterUserEntities(db *sqlx.DB, fn func(*UserEntity) error) error {
+	return IterUserEntitiesContext(context.Background(), db, fn)
+}
+
+// 同 IterUserEntities，ctx 的期限代替 WithTimeout 的默认期限
+func IterUserEntitiesContext(ctx context.Context, db *sqlx.DB, fn func(*UserEntity) error) error {
+	rows, err := db.QueryxContext(ctx, `SELECT * FROM user_entities ORDER BY id`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	o := optionsOf(db)
+	for rows.Next() {
+		entity := &UserEntity{}
+		if err := rows.StructScan(entity); err != nil {
+			return err
+		}
+		resolveUserEntities(o, entity)
+		if err := fn(entity); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// ListAllUserEntities 可用的排序字段，值为实际使用的表达式
+var userEntityOrders = map[string]string{
+	"id":                  "user_entities.id",
+	"name":                "user_entities.name COLLATE NOCASE",
+	"screen_name":         "screen_name COLLATE NOCASE",
+	"media_count":         "user_entities.media_count",
+	"latest_release_time": "julianday(user_entities.latest_release_time)",
+	"total_bytes":         "user_entities.total_bytes",
+	"created_at":          "julianday(user_entities.created_at)",
+	"updated_at":          "julianday(user_entities.updated_at)",
+}
+
+// 分页列出所有用户实体及其所属用户的名称，orderBy 为空时按 id 排序
+// orderBy 只能是 userEntityOrders 中的字段，否则返回错误；值相同时按 id 排序，为空的时间升序时在前、降序时在后
+// limit <= 0 时不限制数量
+func ListAllUserEntities(db *sqlx.DB, orderBy string, desc bool, limit, offset int) ([]*UserEntityWithUser, error) {
+	if orderBy == "" {
+		orderBy = "id"
+	}
+	expr, ok := userEntityOrders[orderBy]
+	if !ok {
+		return nil, fmt.Errorf("cannot order user entities by %q", orderBy)
+	}
+	dir := "ASC"
+	if desc {
+		dir = "DESC"
+	}
+	if limit <= 0 {
+		limit = -1
+	}
+
+	stmt := fmt.Sprintf(`SELECT user_entities.*, COALESCE(users.screen_name, '') AS screen_name, COALESCE(users.name, '') AS user_name
+		FROM user_entities LEFT JOIN users ON users.id = user_entities.user_id
+		ORDER BY %s %s, user_entities.id %s
+		LIMIT ? OFFSET ?`, expr, dir, dir)
+	res := []*UserEntityWithUser{}
+	if err := db.Select(&res, stmt, limit, max(offset, 0)); err != nil {
+		return nil, err
+	}
+	o := optionsOf(db)
+	for _, entity := range res {
+		resolveUserEntities(o, &entity.UserEntity)
+	}
+	return res, nil
+}
+
 func UpdateUserEntity(db *sqlx.DB, entity *UserEntity) error {
-	stmt := `UPDATE user_entities SET name=?, latest_release_time=?, media_count=? WHERE id=?`
-	_, err := db.Exec(stmt, entity.Name, entity.LatestReleaseTime, entity.MediaCount, entity.Id)
+	stmt := `UPDATE user_entities SET name=?, latest_release_time=?, media_count=?, updated_at=CURRENT_TIMESTAMP WHERE id=?`
+	_, err := execWithRetry(db, stmt, entity.Name, entity.LatestReleaseTime, entity.MediaCount, entity.Id)
 	return err
 }
 
+// 将每个用户实体的 name 批量更新为按其用户当前名称计算的 UserEntityTitle，返回更新的实体数
+// 仅修改数据库记录，不重命名目录
+func RefreshEntityNamesFromUsers(db *sqlx.DB) (int, error) {
+	n := 0
+	err := withRetry(optionsOf(db), func() error {
+		n = 0
+		return WithTx(db, func(tx *Tx) error {
+			entities, err := userEntitiesNeedingNameUpdate(tx, nil)
+			if err != nil {
+				return err
+			}
+			stmt := `UPDATE user_entities SET name=?, updated_at=CURRENT_TIMESTAMP WHERE id=?`
+			for _, entity := range entities {
+				if _, err := tx.Exec(stmt, UserEntityTitle(entity.ScreenName, entity.UserName), entity.Id); err != nil {
+					return wrapErr(err)
+				}
+				n++
+			}
+			return nil
+		})
+	})
+	return n, err
+}
+
+// 直接写入 count，覆盖已记录的值
+//
+// Deprecated: 在调用方读取、计算后写回的计数会被并发的更新覆盖，累加计数请使用 IncrUserEntityMediaCount
 func UpdateUserEntityMediCount(db *sqlx.DB, eid int, count int) error {
-	stmt := `UPDATE user_entities SET media_count=? WHERE id=?`
-	_, err := db.Exec(stmt, count, eid)
+	stmt := `UPDATE user_entities SET media_count=?, updated_at=CURRENT_TIMESTAMP WHERE id=?`
+	_, err := execWithRetry(db, stmt, count, eid)
 	return err
 }
 
-func UpdateUserEntityTweetStat(db *sqlx.DB, eid int, baseline time.Time, count int) error {
-	stmt := `UPDATE user_entities SET latest_release_time=?, media_count=? WHERE id=?`
-	_, err := db.Exec(stmt, baseline, count, eid)
+// 在单条语句中累加 media_count，并发调用时不会互相覆盖
+func IncrUserEntityMediaCount(db *sqlx.DB, id int, delta int) error {
+	stmt := `UPDATE user_entities SET media_count=media_count+?, updated_at=CURRENT_TIMESTAMP WHERE id=?`
+	_, err := execWithRetry(db, stmt, delta, id)
 	return err
 }
 
+// 仅当 baseline 晚于已记录的 latest_release_time 时才更新，避免重试时传入较旧的 baseline 使其回退
+// 返回记录是否被实际更新
+func UpdateUserEntityTweetStat(db *sqlx.DB, eid int, baseline time.Time, count int) (bool, error) {
+	stmt := `UPDATE user_entities SET latest_release_time=?, media_count=?, updated_at=CURRENT_TIMESTAMP
+		WHERE id=? AND (latest_release_time IS NULL OR julianday(latest_release_time) < julianday(?))`
+	res, err := execWithRetry(db, stmt, baseline, count, eid, baseline)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n != 0, err
+}
+
+// 同时更新各类型媒体数量和 media_count，写入后 media_count 为三者之和
+// UpdateUserEntityTweetStat、IncrUserEntityMediaCount 等只修改 media_count，之后两者不再一致，
+// 各类型数量只反映最近一次调用本函数时的统计
+func UpdateUserEntityMediaBreakdown(db *sqlx.DB, id int, photos, videos, gifs int) error {
+	stmt := `UPDATE user_entities SET photo_count=?, video_count=?, gif_count=?, media_count=?, updated_at=CURRENT_TIMESTAMP WHERE id=?`
+	_, err := execWithRetry(db, stmt, photos, videos, gifs, photos+videos+gifs, id)
+	return err
+}
+
+// 累加实体已下载文件的字节数，在每次写入文件后调用
+func AddUserEntityBytes(db *sqlx.DB, id int, delta int64) error {
+	stmt := `UPDATE user_entities SET total_bytes=total_bytes+?, updated_at=CURRENT_TIMESTAMP WHERE id=?`
+	_, err := execWithRetry(db, stmt, delta, id)
+	return err
+}
+
+// 清空实体的下载进度，下次同步时重新下载全部推文；保留实体与目录的关联
+func ResetUserEntityProgress(db *sqlx.DB, id int) error {
+	stmt := `UPDATE user_entities SET latest_release_time=NULL, media_count=0, photo_count=0, video_count=0, gif_count=0, total_bytes=0, last_cursor=NULL, updated_at=CURRENT_TIMESTAMP WHERE id=?`
+	_, err := execWithRetry(db, stmt, id)
+	return err
+}
+
+// 保存实体的分页游标，cursor 为空时清除，下次同步从最新的推文开始
+// 实体不存在时返回 ErrNotFound
+func SetUserEntityCursor(db *sqlx.DB, id int, cursor string) error {
+	stmt := `UPDATE user_entities SET last_cursor=NULLIF(?, ''), updated_at=CURRENT_TIMESTAMP WHERE id=?`
+	res, err := execWithRetry(db, stmt, cursor, id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("%w: user entity %d", ErrNotFound, id)
+	}
+	return nil
+}
+
+// 实体保存的分页游标，没有保存过时返回空字符串
+// 实体不存在时按 Get* 的约定返回 notFoundErr
+func GetUserEntityCursor(db *sqlx.DB, id int) (string, error) {
+	var res sql.NullString
+	err := db.Get(&res, `SELECT last_cursor FROM user_entities WHERE id=?`, id)
+	if err == sql.ErrNoRows {
+		return "", notFoundErr(db)
+	}
+	return res.String, err
+}
+
 func CreateLst(db *sqlx.DB, lst *Lst) error {
 	stmt := `INSERT INTO lsts(id, name, owner_uid) VALUES(:id, :name, :owner_uid)`
-	_, err := db.NamedExec(stmt, &lst)
+	_, err := namedExecWithRetry(db, stmt, &lst)
 	return err
 }
 
 func DelLst(db *sqlx.DB, lid uint64) error {
 	stmt := `DELETE FROM lsts WHERE id=?`
-	_, err := db.Exec(stmt, lid)
+	_, err := execWithRetry(db, stmt, lid)
 	return err
 }
 
+// 在一个事务中删除列表、列表的所有实体及实体下的用户链接，列表不存在时什么也不做
+func DeleteListAndAllChildren(db *sqlx.DB, lid uint64) error {
+	return withRetry(optionsOf(db), func() error {
+		return WithTx(db, func(tx *Tx) error {
+			stmts := []string{
+				`DELETE FROM user_links WHERE parent_lst_entity_id IN (SELECT id FROM lst_entities WHERE lst_id=?)`,
+				`DELETE FROM lst_entities WHERE lst_id=?`,
+				`DELETE FROM lsts WHERE id=?`,
+			}
+			for _, stmt := range stmts {
+				if _, err := tx.Exec(stmt, lid); err != nil {
+					return wrapErr(err)
+				}
+			}
+			return nil
+		})
+	})
+}
+
 func GetLst(db *sqlx.DB, lid uint64) (*Lst, error) {
 	stmt := `SELECT * FROM lsts WHERE id = ?`
 	result := &Lst{}
 	err := db.Get(result, stmt, lid)
 	if err == sql.ErrNoRows {
-		err = nil
+		err = notFoundErr(db)
 		result = nil
 	}
 	if err != nil {
@@ -435,24 +1213,123 @@ func GetLst(db *sqlx.DB, lid uint64) (*Lst, error) {
 	return result, nil
 }
 
+// 按名称查找某用户拥有的列表，同一用户有多个同名列表时返回 id 最小的
+func GetLstByName(db *sqlx.DB, ownerUid uint64, name string) (*Lst, error) {
+	stmt := `SELECT * FROM lsts WHERE owner_uid = ? AND name = ? ORDER BY id LIMIT 1`
+	result := &Lst{}
+	err := db.Get(result, stmt, ownerUid, name)
+	if err == sql.ErrNoRows {
+		err = notFoundErr(db)
+		result = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func GetLstsByOwner(db *sqlx.DB, ownerUid uint64) ([]*Lst, error) {
+	stmt := `SELECT * FROM lsts WHERE owner_uid = ? ORDER BY id`
+	res := []*Lst{}
+	err := db.Select(&res, stmt, ownerUid)
+	return res, err
+}
+
+// 通过列表实体下的用户链接获取列表的所有成员
+// 不连接 lsts 表：关注列表没有对应的 lsts 记录，但同样有列表实体
+func GetUsersInList(db *sqlx.DB, lid uint64) ([]*User, error) {
+	stmt := `SELECT DISTINCT users.* FROM users
+		JOIN user_links ON user_links.user_id = users.id
+		JOIN lst_entities ON lst_entities.id = user_links.parent_lst_entity_id
+		WHERE lst_entities.lst_id = ?
+		ORDER BY users.screen_name`
+	res := []*User{}
+	err := db.Select(&res, stmt, lid)
+	return res, err
+}
+
+// 获取列表成员及其用户实体的下载统计，没有用户实体的成员 media_count 为 0
+// 一个成员有多个用户实体时每个实体各占一行
+func GetListMemberStats(db *sqlx.DB, lid uint64) ([]*ListMemberStat, error) {
+	stmt := `SELECT users.id AS uid, users.screen_name, users.name,
+		user_entities.id AS entity_id, COALESCE(user_entities.media_count, 0) AS media_count, user_entities.latest_release_time
+		FROM users
+		LEFT JOIN user_entities ON user_entities.user_id = users.id
+		WHERE users.id IN (
+			SELECT user_links.user_id FROM user_links
+			JOIN lst_entities ON lst_entities.id = user_links.parent_lst_entity_id
+			WHERE lst_entities.lst_id = ?)
+		ORDER BY users.screen_name, user_entities.id`
+	res := []*ListMemberStat{}
+	err := db.Select(&res, stmt, lid)
+	return res, err
+}
+
+// 获取用户所属的列表，关注列表没有 lsts 记录因此不会被返回
+func GetListsForUser(db *sqlx.DB, uid uint64) ([]*Lst, error) {
+	stmt := `SELECT DISTINCT lsts.* FROM lsts
+		JOIN lst_entities ON lst_entities.lst_id = lsts.id
+		JOIN user_links ON user_links.parent_lst_entity_id = lst_entities.id
+		WHERE user_links.user_id = ?
+		ORDER BY lsts.id`
+	res := []*Lst{}
+	err := db.Select(&res, stmt, uid)
+	return res, err
+}
+
 func UpdateLst(db *sqlx.DB, lst *Lst) error {
 	stmt := `UPDATE lsts SET name=? WHERE id=?`
-	_, err := db.Exec(stmt, lst.Name, lst.Id)
+	_, err := execWithRetry(db, stmt, lst.Name, lst.Id)
 	return err
 }
 
+// 重命名列表，renameEntities 为 true 时在同一事务中将名称仍等于旧列表名的列表实体一并重命名，
+// 已被手动改名的实体保持不变。返回被重命名的列表实体数量
+func RenameLst(db *sqlx.DB, lid uint64, name string, renameEntities bool) (int, error) {
+	n := 0
+	err := withRetry(optionsOf(db), func() error {
+		return WithTx(db, func(tx *Tx) error {
+			var oldName string
+			err := tx.Get(&oldName, `SELECT name FROM lsts WHERE id=?`, lid)
+			if err == sql.ErrNoRows {
+				return fmt.Errorf("%w: lst %d", ErrNotFound, lid)
+			}
+			if err != nil {
+				return err
+			}
+
+			if _, err := tx.Exec(`UPDATE lsts SET name=? WHERE id=?`, name, lid); err != nil {
+				return wrapErr(err)
+			}
+			if !renameEntities {
+				n = 0
+				return nil
+			}
+
+			res, err := tx.Exec(`UPDATE lst_entities SET name=?, updated_at=CURRENT_TIMESTAMP WHERE lst_id=? AND name=?`, name, lid, oldName)
+			if err != nil {
+				return wrapErr(err)
+			}
+			affected, err := res.RowsAffected()
+			n = int(affected)
+			return err
+		})
+	})
+	return n, err
+}
+
 func CreateLstEntity(db *sqlx.DB, entity *LstEntity) error {
 	// 这里我们使用新的路径变更处理函数
 	// 由于原始函数接口不支持复杂逻辑，我们在这里简单包装
 	// 注意：在main.go中调用时应该使用CreateOrUpdateLstEntityWithPathChange
-	abs, err := filepath.Abs(entity.ParentDir)
+	abs, stored, err := storedPath(optionsOf(db), entity.ParentDir)
 	if err != nil {
 		return err
 	}
 	entity.ParentDir = abs
 
-	stmt := `INSERT INTO lst_entities(id, lst_id, name, parent_dir) VALUES(:id, :lst_id, :name, :parent_dir)`
-	r, err := db.NamedExec(stmt, &entity)
+	stmt := `INSERT INTO lst_entities(id, lst_id, name, parent_dir) VALUES(?, ?, ?, ?)`
+	r, err := execWithRetry(db, stmt, entity.Id, entity.LstId, entity.Name, stored)
 	if err != nil {
 		return err
 	}
@@ -464,10 +1341,19 @@ func CreateLstEntity(db *sqlx.DB, entity *LstEntity) error {
 	return nil
 }
 
+// 删除列表实体及其下所有用户链接，避免留下悬空的 user_links
 func DelLstEntity(db *sqlx.DB, id int) error {
-	stmt := `DELETE FROM lst_entities WHERE id=?`
-	_, err := db.Exec(stmt, id)
-	return err
+	return withRetry(optionsOf(db), func() error {
+		return WithTx(db, func(tx *Tx) error {
+			if _, err := tx.Exec(`DELETE FROM user_links WHERE parent_lst_entity_id=?`, id); err != nil {
+				return wrapErr(err)
+			}
+			if _, err := tx.Exec(`DELETE FROM lst_entities WHERE id=?`, id); err != nil {
+				return wrapErr(err)
+			}
+			return nil
+		})
+	})
 }
 
 func GetLstEntity(db *sqlx.DB, id int) (*LstEntity, error) {
@@ -475,17 +1361,52 @@ func GetLstEntity(db *sqlx.DB, id int) (*LstEntity, error) {
 	result := &LstEntity{}
 	err := db.Get(result, stmt, id)
 	if err == sql.ErrNoRows {
-		err = nil
+		err = notFoundErr(db)
 		result = nil
 	}
 	if err != nil {
 		return nil, err
 	}
+	resolveLstEntities(optionsOf(db), result)
 	return result, nil
 }
 
+// 按 parent_dir 查找列表实体，不需要知道列表 id；不存在时返回 nil
+// 多个列表下载到同一目录时无法确定归属，返回错误
+func GetLstEntityByPath(db *sqlx.DB, parentDir string) (*LstEntity, error) {
+	o := optionsOf(db)
+	_, storedDir, err := storedPath(o, parentDir)
+	if err != nil {
+		return nil, err
+	}
+
+	res := []*LstEntity{}
+	if err := db.Select(&res, `SELECT * FROM lst_entities WHERE parent_dir=? ORDER BY id LIMIT 2`, storedDir); err != nil {
+		return nil, err
+	}
+	switch len(res) {
+	case 0:
+		return nil, notFoundErr(db)
+	case 1:
+		resolveLstEntities(o, res[0])
+		return res[0], nil
+	default:
+		return nil, fmt.Errorf("more than one lst entity is stored under %s", parentDir)
+	}
+}
+
+// 获取列表下载到的所有目录
+func GetLstEntitiesByList(db *sqlx.DB, lstId uint64) ([]*LstEntity, error) {
+	stmt := `SELECT * FROM lst_entities WHERE lst_id=? ORDER BY name, id`
+	res := []*LstEntity{}
+	err := db.Select(&res, stmt, lstId)
+	resolveLstEntities(optionsOf(db), res...)
+	return res, err
+}
+
 func LocateLstEntity(db *sqlx.DB, lid int64, parentDir string) (*LstEntity, error) {
-	absPath, err := filepath.Abs(parentDir)
+	o := optionsOf(db)
+	absPath, storedDir, err := storedPath(o, parentDir)
 	if err != nil {
 		return nil, err
 	}
@@ -493,65 +1414,201 @@ func LocateLstEntity(db *sqlx.DB, lid int64, parentDir string) (*LstEntity, erro
 	// 首先尝试直接匹配路径
 	stmt := `SELECT * FROM lst_entities WHERE lst_id=? AND parent_dir=?`
 	result := &LstEntity{}
-	err = db.Get(result, stmt, lid, absPath)
+	err = db.Get(result, stmt, lid, storedDir)
 	if err == sql.ErrNoRows {
-		// 直接匹配失败，尝试基于列表ID和名称来查找匹配的实体
+		// 直接匹配失败，查找已被移动到 parentDir 下的同名实体
 		var entities []*LstEntity
 		listStmt := `SELECT * FROM lst_entities WHERE lst_id=?`
 		err = db.Select(&entities, listStmt, lid)
 		if err != nil {
 			return nil, err
 		}
-		
-		// 基于列表名称进行匹配（不区分大小写）
+		resolveLstEntities(o, entities...)
+
 		for _, entity := range entities {
-			// 检查目标目录是否存在（作为判断依据）
-			if _, err := os.Stat(absPath); err == nil {
-				// 目录存在，基于列表ID和名称匹配
-				// 打印提示信息，告知用户路径已变更
-				fmt.Printf("路径匹配提示: 列表 %d 的下载记录已从 '%s' 移动到 '%s'\n", 
-					lid, entity.ParentDir, absPath)
-				
-				// 更新数据库中的路径信息
-				updateStmt := `UPDATE lst_entities SET parent_dir=? WHERE id=?`
-				db.Exec(updateStmt, absPath, entity.Id)
-				
-				// 更新实体的路径
-				entity.ParentDir = absPath
-				return entity, nil
+			if !isMovedLstEntity(entity, absPath) {
+				continue
 			}
+			// 打印提示信息，告知用户路径已变更
+			fmt.Printf("路径匹配提示: 列表 %d 的下载记录已从 '%s' 移动到 '%s'\n",
+				lid, entity.ParentDir, absPath)
+
+			updateStmt := `UPDATE lst_entities SET parent_dir=?, updated_at=CURRENT_TIMESTAMP WHERE id=?`
+			if _, err := execWithRetry(db, updateStmt, storedDir, entity.Id); err != nil {
+				return nil, err
+			}
+			entity.ParentDir = absPath
+			return entity, nil
 		}
-		
+
 		return nil, nil
 	}
 	if err != nil {
 		return nil, err
 	}
+	resolveLstEntities(o, result)
 	return result, nil
 }
+
+// 判断列表实体是否已被移动到 parentDir 下：新位置必须存在与实体同名的目录，
+// 目录中有 .lst 文件时以其记录的 lst_id 为准，否则要求实体原来的目录已不存在，
+// 避免把 parentDir 下其他列表的目录误认为是该实体
+func isMovedLstEntity(entity *LstEntity, parentDir string) bool {
+	if entity.Name == "" {
+		return false
+	}
+	dir := filepath.Join(parentDir, entity.Name)
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return false
+	}
+	if lid, err := ReadLstFile(dir); err == nil {
+		return lid == entity.LstId
+	} else if !os.IsNotExist(err) {
+		return false
+	}
+	_, err := os.Stat(entity.Path())
+	return os.IsNotExist(err)
+}
+
 func UpdateLstEntity(db *sqlx.DB, entity *LstEntity) error {
-	stmt := `UPDATE lst_entities SET name=? WHERE id=?`
-	_, err := db.Exec(stmt, entity.Name, entity.Id.Int32)
+	stmt := `UPDATE lst_entities SET name=?, updated_at=CURRENT_TIMESTAMP WHERE id=?`
+	_, err := execWithRetry(db, stmt, entity.Name, entity.Id.Int32)
 	return err
 }
 
+// 将列表实体移动到 newPath，同一列表在 newPath 下已有其他实体时返回 ErrDuplicatePath
+func UpdateLstEntityPath(db *sqlx.DB, id int32, newPath string) error {
+	if newPath == "" {
+		return fmt.Errorf("new path of lst entity %d is empty", id)
+	}
+	newPath, storedDir, err := storedPath(optionsOf(db), newPath)
+	if err != nil {
+		return err
+	}
+
+	return withRetry(optionsOf(db), func() error {
+		return WithTx(db, func(tx *Tx) error {
+			var lid int64
+			err := tx.Get(&lid, `SELECT lst_id FROM lst_entities WHERE id=?`, id)
+			if err == sql.ErrNoRows {
+				return fmt.Errorf("%w: lst entity %d", ErrNotFound, id)
+			}
+			if err != nil {
+				return err
+			}
+
+			var collides bool
+			stmt := `SELECT EXISTS(SELECT 1 FROM lst_entities WHERE lst_id=? AND parent_dir=? AND id<>?)`
+			if err := tx.Get(&collides, stmt, lid, storedDir, id); err != nil {
+				return err
+			}
+			if collides {
+				return fmt.Errorf("%w: lst %d already has an entity under %s", ErrDuplicatePath, lid, newPath)
+			}
+
+			_, err = tx.Exec(`UPDATE lst_entities SET parent_dir=?, updated_at=CURRENT_TIMESTAMP WHERE id=?`, storedDir, id)
+			return wrapErr(err)
+		})
+	})
+}
+
+// 将用户实体改为属于 newUid，用于修正错误关联的目录
+// 实体或新用户不存在时返回 ErrNotFound，新用户在同一目录已有实体时返回 ErrDuplicatePath
+func ReassignUserEntity(db *sqlx.DB, entityId int, newUid uint64) error {
+	return withRetry(optionsOf(db), func() error {
+		return WithTx(db, func(tx *Tx) error {
+			var parentDir string
+			err := tx.Get(&parentDir, `SELECT parent_dir FROM user_entities WHERE id=?`, entityId)
+			if err == sql.ErrNoRows {
+				return fmt.Errorf("%w: user entity %d", ErrNotFound, entityId)
+			}
+			if err != nil {
+				return err
+			}
+
+			var exists bool
+			if err := tx.Get(&exists, `SELECT EXISTS(SELECT 1 FROM users WHERE id=?)`, newUid); err != nil {
+				return err
+			}
+			if !exists {
+				return fmt.Errorf("%w: user %d", ErrNotFound, newUid)
+			}
+
+			var collides bool
+			stmt := `SELECT EXISTS(SELECT 1 FROM user_entities WHERE user_id=? AND parent_dir=? AND id<>?)`
+			if err := tx.Get(&collides, stmt, newUid, parentDir, entityId); err != nil {
+				return err
+			}
+			if collides {
+				return fmt.Errorf("%w: user %d already has an entity under %s", ErrDuplicatePath, newUid, parentDir)
+			}
+
+			_, err = tx.Exec(`UPDATE user_entities SET user_id=?, updated_at=CURRENT_TIMESTAMP WHERE id=?`, newUid, entityId)
+			return wrapErr(err)
+		})
+	})
+}
+
 func SetUserEntityLatestReleaseTime(db *sqlx.DB, id int, t time.Time) error {
-	stmt := `UPDATE user_entities SET latest_release_time=? WHERE id=?`
-	_, err := db.Exec(stmt, t, id)
+	stmt := `UPDATE user_entities SET latest_release_time=?, updated_at=CURRENT_TIMESTAMP WHERE id=?`
+	_, err := execWithRetry(db, stmt, t, id)
 	return err
 }
 
 func RecordUserPreviousName(db *sqlx.DB, uid uint64, name string, screenName string) error {
 	stmt := `INSERT INTO user_previous_names(uid, screen_name, name, record_date) VALUES(?, ?, ?, ?)`
-	_, err := db.Exec(stmt, uid, screenName, name, time.Now())
+	_, err := execWithRetry(db, stmt, uid, screenName, name, time.Now())
 	return err
 }
 
+// 最近一次记录的曾用名，用于判断名称变更是否已记录过，无记录时返回 nil
+func GetLatestPreviousName(db *sqlx.DB, uid uint64) (*UserPreviousName, error) {
+	stmt := `SELECT * FROM user_previous_names WHERE uid=? ORDER BY julianday(record_date) DESC, id DESC LIMIT 1`
+	res := &UserPreviousName{}
+	err := db.Get(res, stmt, uid)
+	if err == sql.ErrNoRows {
+		err = notFoundErr(db)
+		res = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// 同一天内重复记录相同的关注数会被忽略
+func RecordFriendsCount(db *sqlx.DB, uid uint64, count int) error {
+	return withRetry(optionsOf(db), func() error {
+		return recordFriendsCount(db, uid, count)
+	})
+}
+
+func recordFriendsCount(exec sqlx.Execer, uid uint64, count int) error {
+	stmt := `INSERT INTO user_friends_history(uid, friends_count, record_date) VALUES(?, ?, ?)
+		ON CONFLICT(uid, record_date, friends_count) DO NOTHING`
+	_, err := exec.Exec(stmt, uid, count, time.Now().Format("2006-01-02"))
+	return err
+}
+
+func GetFriendsCountHistory(db *sqlx.DB, uid uint64) ([]*FriendsCountRecord, error) {
+	stmt := `SELECT * FROM user_friends_history WHERE uid=? ORDER BY record_date, id`
+	res := []*FriendsCountRecord{}
+	err := db.Select(&res, stmt, uid)
+	return res, err
+}
+
 func CreateUserLink(db *sqlx.DB, lnk *UserLink) error {
+	return withRetry(optionsOf(db), func() error {
+		return CreateUserLinkTx(db, lnk)
+	})
+}
+
+// 在调用者提供的事务（WithTx、Begin 开启的 *Tx）中创建用户链接，不会重试
+func CreateUserLinkTx(ext sqlx.Ext, lnk *UserLink) error {
 	stmt := `INSERT INTO user_links(user_id, name, parent_lst_entity_id) VALUES(:user_id, :name, :parent_lst_entity_id)`
-	res, err := db.NamedExec(stmt, lnk)
+	res, err := sqlx.NamedExec(ext, stmt, lnk)
 	if err != nil {
-		return err
+		return wrapErr(err)
 	}
 
 	id, err := res.LastInsertId()
@@ -563,9 +1620,62 @@ func CreateUserLink(db *sqlx.DB, lnk *UserLink) error {
 	return nil
 }
 
+// 用户已链接到该列表实体时不做任何修改，created 为 false
+func CreateUserLinkIfNotExists(db *sqlx.DB, lnk *UserLink) (created bool, err error) {
+	stmt := `INSERT INTO user_links(user_id, name, parent_lst_entity_id) VALUES(:user_id, :name, :parent_lst_entity_id)
+		ON CONFLICT(user_id, parent_lst_entity_id) DO NOTHING`
+	res, err := namedExecWithRetry(db, stmt, lnk)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if n == 0 {
+		return false, nil
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return false, err
+	}
+	lnk.Id.Scan(id)
+	return true, nil
+}
+
+// 在同一事务中将用户从 fromLstEntityId 下移动到 toLstEntityId 下并以 name 命名，用户不会同时出现在两处或都不出现
+// 原链接或目标列表实体不存在时返回 ErrNotFound，用户在目标列表实体下已有链接时返回 ErrDuplicateLink
+func MoveUserLink(db *sqlx.DB, uid uint64, fromLstEntityId, toLstEntityId int32, name string) error {
+	return withRetry(optionsOf(db), func() error {
+		return WithTx(db, func(tx *Tx) error {
+			res, err := tx.Exec(`DELETE FROM user_links WHERE user_id=? AND parent_lst_entity_id=?`, uid, fromLstEntityId)
+			if err != nil {
+				return err
+			}
+			n, err := res.RowsAffected()
+			if err != nil {
+				return err
+			}
+			if n == 0 {
+				return fmt.Errorf("%w: user %d is not linked under lst entity %d", ErrNotFound, uid, fromLstEntityId)
+			}
+
+			var exists bool
+			if err := tx.Get(&exists, `SELECT EXISTS(SELECT 1 FROM lst_entities WHERE id=?)`, toLstEntityId); err != nil {
+				return err
+			}
+			if !exists {
+				return fmt.Errorf("%w: lst entity %d", ErrNotFound, toLstEntityId)
+			}
+			return CreateUserLinkTx(tx, &UserLink{Uid: uid, Name: name, ParentLstEntityId: toLstEntityId})
+		})
+	})
+}
+
 func DelUserLink(db *sqlx.DB, id int32) error {
 	stmt := `DELETE FROM user_links WHERE id = ?`
-	_, err := db.Exec(stmt, id)
+	_, err := execWithRetry(db, stmt, id)
 	return err
 }
 
@@ -576,12 +1686,40 @@ func GetUserLinks(db *sqlx.DB, uid uint64) ([]*UserLink, error) {
 	return res, err
 }
 
+// 列表实体下的所有用户链接，按名称排序
+func GetUserLinksByLstEntity(db *sqlx.DB, parentLstEntityId int32) ([]*UserLink, error) {
+	stmt := `SELECT * FROM user_links WHERE parent_lst_entity_id = ? ORDER BY name, id`
+	res := []*UserLink{}
+	err := db.Select(&res, stmt, parentLstEntityId)
+	return res, err
+}
+
+// 一次取出多个列表实体下的用户链接，按列表实体 id 分组，每组按名称排序；没有链接的实体不出现在结果中
+func GetUserLinksForEntities(db *sqlx.DB, entityIds []int32) (map[int32][]*UserLink, error) {
+	res := make(map[int32][]*UserLink)
+	for start := 0; start < len(entityIds); start += maxInParams {
+		end := min(start+maxInParams, len(entityIds))
+		query, args, err := sqlx.In(`SELECT * FROM user_links WHERE parent_lst_entity_id IN (?) ORDER BY name, id`, entityIds[start:end])
+		if err != nil {
+			return nil, err
+		}
+		links := []*UserLink{}
+		if err := db.Select(&links, db.Rebind(query), args...); err != nil {
+			return nil, err
+		}
+		for _, link := range links {
+			res[link.ParentLstEntityId] = append(res[link.ParentLstEntityId], link)
+		}
+	}
+	return res, nil
+}
+
 func GetUserLink(db *sqlx.DB, uid uint64, parentLstEntityId int32) (*UserLink, error) {
 	stmt := `SELECT * FROM user_links WHERE user_id = ? AND parent_lst_entity_id = ?`
 	res := &UserLink{}
 	err := db.Get(res, stmt, uid, parentLstEntityId)
 	if err == sql.ErrNoRows {
-		err = nil
+		err = notFoundErr(db)
 		res = nil
 	}
 	if err != nil {
@@ -590,8 +1728,58 @@ func GetUserLink(db *sqlx.DB, uid uint64, parentLstEntityId int32) (*UserLink, e
 	return res, nil
 }
 
+func GetUserLinksByName(db *sqlx.DB, name string) ([]*UserLink, error) {
+	stmt := `SELECT * FROM user_links WHERE name = ? ORDER BY id`
+	res := []*UserLink{}
+	err := db.Select(&res, stmt, name)
+	return res, err
+}
+
+// 按列表实体下显示的名称查找用户链接，有多个同名链接时返回 id 最小的
+func GetUserLinkByName(db *sqlx.DB, parentLstEntityId int32, name string) (*UserLink, error) {
+	stmt := `SELECT * FROM user_links WHERE parent_lst_entity_id = ? AND name = ? ORDER BY id LIMIT 1`
+	res := &UserLink{}
+	err := db.Get(res, stmt, parentLstEntityId, name)
+	if err == sql.ErrNoRows {
+		err = notFoundErr(db)
+		res = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// 只判断用户链接是否存在，不需要链接本身时使用
+func UserLinkExists(db *sqlx.DB, uid uint64, parentLstEntityId int32) (bool, error) {
+	stmt := `SELECT EXISTS(SELECT 1 FROM user_links WHERE user_id = ? AND parent_lst_entity_id = ?)`
+	var exists bool
+	err := db.Get(&exists, stmt, uid, parentLstEntityId)
+	return exists, err
+}
+
 func UpdateUserLink(db *sqlx.DB, id int32, name string) error {
 	stmt := `UPDATE user_links SET name = ? WHERE id = ?`
-	_, err := db.Exec(stmt, name, id)
+	_, err := execWithRetry(db, stmt, name, id)
 	return err
 }
+
+// 查找父列表实体已不存在的用户链接（外键启用前遗留的脏数据）
+func GetOrphanedUserLinks(db *sqlx.DB) ([]*UserLink, error) {
+	stmt := `SELECT user_links.* FROM user_links
+		LEFT JOIN lst_entities ON user_links.parent_lst_entity_id = lst_entities.id
+		WHERE lst_entities.id IS NULL`
+	res := []*UserLink{}
+	err := db.Select(&res, stmt)
+	return res, err
+}
+
+func PruneOrphanedUserLinks(db *sqlx.DB) (int, error) {
+	stmt := `DELETE FROM user_links WHERE parent_lst_entity_id NOT IN (SELECT id FROM lst_entities)`
+	res, err := execWithRetry(db, stmt)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
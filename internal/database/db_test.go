@@ -1,16 +1,26 @@
 package database
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/jmoiron/sqlx"
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
 )
 
 var db *sqlx.DB
@@ -23,16 +33,101 @@ func opentmpdb() *sqlx.DB {
 	}
 	path := tmpFile.Name()
 
-	db, err = sqlx.Connect("sqlite3", fmt.Sprintf("file:%s?_journal_mode=WAL&cache=shared", path))
+	tmpFile.Close()
 
+	// 与生产环境使用相同的连接参数，包括外键约束
+	db, err = OpenDB(path)
 	if err != nil {
 		panic(err)
 	}
-
-	CreateTables(db)
 	return db
 }
 
+// 关闭 db 的外键约束以便构造外键启用前遗留的数据
+// PRAGMA foreign_keys 只作用于当前连接，因此先将连接池限制为一个连接
+func disableForeignKeys(t *testing.T) {
+	t.Helper()
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(`PRAGMA foreign_keys=OFF`); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// seedDB 插入的示例数据：
+// user1、user2 是列表 1 的成员并各有一个用户实体，user3 不属于任何列表也没有实体
+type fixtures struct {
+	root         string // 所有实体目录的根目录，测试结束后删除
+	users        []*User
+	lst          *Lst
+	lstEntity    *LstEntity
+	userEntities []*UserEntity
+	links        []*UserLink
+}
+
+// 打开已迁移的内存数据库（同时赋值给 db）并插入示例数据，测试结束时自动关闭
+func seedDB(t *testing.T) *fixtures {
+	t.Helper()
+	var err error
+	db, err = OpenDB(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	f := &fixtures{root: t.TempDir()}
+	usersDir := filepath.Join(f.root, "users")
+	listsDir := filepath.Join(f.root, "lists")
+	for _, dir := range []string{usersDir, listsDir} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 1; i <= 3; i++ {
+		usr := generateUser(i)
+		usr.FriendsCount = i * 10
+		if err := CreateUser(db, usr); err != nil {
+			t.Fatal(err)
+		}
+		f.users = append(f.users, usr)
+	}
+
+	f.lst = &Lst{Id: 1, Name: "lst1", OwnerId: f.users[0].Id}
+	if err := CreateLst(db, f.lst); err != nil {
+		t.Fatal(err)
+	}
+	f.lstEntity = &LstEntity{LstId: int64(f.lst.Id), Name: f.lst.Name, ParentDir: listsDir}
+	if err := CreateLstEntity(db, f.lstEntity); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, usr := range f.users[:2] {
+		entity := &UserEntity{Uid: usr.Id, Name: UserEntityTitle(usr.ScreenName, usr.Name), ParentDir: usersDir}
+		if err := CreateUserEntity(db, entity); err != nil {
+			t.Fatal(err)
+		}
+		f.userEntities = append(f.userEntities, entity)
+
+		link := &UserLink{Uid: usr.Id, Name: usr.Name, ParentLstEntityId: f.lstEntity.Id.Int32}
+		if err := CreateUserLink(db, link); err != nil {
+			t.Fatal(err)
+		}
+		f.links = append(f.links, link)
+	}
+	return f
+}
+
+// created_at 和 updated_at 由数据库在写入时填充，比较记录时忽略
+func withoutTimestamps[T any](v *T) T {
+	c := *v
+	for _, name := range []string{"CreatedAt", "UpdatedAt"} {
+		if field := reflect.ValueOf(&c).Elem().FieldByName(name); field.IsValid() {
+			field.Set(reflect.Zero(field.Type()))
+		}
+	}
+	return c
+}
+
 func generateUser(n int) *User {
 	usr := &User{}
 	usr.Id = uint64(n)
@@ -112,9 +207,181 @@ func testUser(t *testing.T, usr *User) {
 	}
 }
 
+func TestSearchUsersByScreenName(t *testing.T) {
+	db = opentmpdb()
+	defer db.Close()
+
+	names := []string{"Alice", "alice_b", "aliceXb", "al%ice", "bob"}
+	for i, name := range names {
+		usr := generateUser(i)
+		usr.ScreenName = name
+		if err := CreateUser(db, usr); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		prefix string
+		limit  int
+		want   []string
+	}{
+		{"ali", 0, []string{"Alice", "alice_b", "aliceXb"}},
+		{"ALICE", 2, []string{"Alice", "alice_b"}},
+		{"alice_", 0, []string{"alice_b"}},
+		{"al%", 0, []string{"al%ice"}},
+		{"", 0, []string{"al%ice", "Alice", "alice_b", "aliceXb", "bob"}},
+		{"carol", 0, []string{}},
+	}
+	for _, test := range tests {
+		users, err := SearchUsersByScreenName(db, test.prefix, test.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := []string{}
+		for _, usr := range users {
+			got = append(got, usr.ScreenName)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("SearchUsersByScreenName(%q, %d) = %v want %v", test.prefix, test.limit, got, test.want)
+		}
+	}
+}
+
+func TestListUsersByProtected(t *testing.T) {
+	db = opentmpdb()
+	defer db.Close()
+
+	for i, name := range []string{"bob", "Alice", "carol", "Dave"} {
+		usr := &User{Id: uint64(i + 1), ScreenName: name, Name: name, IsProtected: i%2 == 1}
+		if err := CreateUser(db, usr); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	screenNames := func(users []*User) []string {
+		res := []string{}
+		for _, usr := range users {
+			res = append(res, usr.ScreenName)
+		}
+		return res
+	}
+
+	protected, err := ListProtectedUsers(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := screenNames(protected); !reflect.DeepEqual(got, []string{"Alice", "Dave"}) {
+		t.Errorf("ListProtectedUsers() = %v want [Alice Dave]", got)
+	}
+	accessible, err := ListAccessibleUsers(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := screenNames(accessible); !reflect.DeepEqual(got, []string{"bob", "carol"}) {
+		t.Errorf("ListAccessibleUsers() = %v want [bob carol]", got)
+	}
+}
+
+func TestGetUsersByIds(t *testing.T) {
+	f := seedDB(t)
+
+	// 超过单条语句的参数数量，需要分批查询
+	ids := []uint64{}
+	for i := 0; i < 3*maxInParams; i++ {
+		ids = append(ids, uint64(1000+i))
+	}
+	ids = append(ids, f.users[2].Id, f.users[0].Id)
+
+	users, err := GetUsersByIds(db, ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 {
+		t.Errorf("GetUsersByIds() returned %d users want 2", len(users))
+	}
+	for _, usr := range []*User{f.users[0], f.users[2]} {
+		if got := users[usr.Id]; got == nil || withoutTimestamps(got) != withoutTimestamps(usr) {
+			t.Errorf("users[%d] = %v want %v", usr.Id, got, usr)
+		}
+	}
+
+	users, err = GetUsersByIds(db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 0 {
+		t.Errorf("GetUsersByIds(nil) = %v want empty", users)
+	}
+}
+
+func TestSearchEntitiesByPath(t *testing.T) {
+	f := seedDB(t)
+	archive := filepath.Join(f.root, "Old_Archive")
+	decoy := filepath.Join(f.root, "oldXarchive")
+	entity := &UserEntity{Uid: f.users[2].Id, Name: f.users[2].Name, ParentDir: archive}
+	if err := CreateUserEntity(db, entity); err != nil {
+		t.Fatal(err)
+	}
+	if err := CreateUserEntity(db, &UserEntity{Uid: f.users[2].Id, Name: f.users[2].Name, ParentDir: decoy}); err != nil {
+		t.Fatal(err)
+	}
+	le := &LstEntity{LstId: int64(f.lst.Id), Name: f.lst.Name, ParentDir: archive}
+	if err := CreateLstEntity(db, le); err != nil {
+		t.Fatal(err)
+	}
+
+	entities, err := SearchEntitiesByPath(db, "d_arch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entities) != 1 || entities[0].Id != entity.Id {
+		t.Errorf("SearchEntitiesByPath() = %v want only entity %d", entities, entity.Id.Int32)
+	}
+
+	matches, err := SearchAllEntitiesByPath(db, "D_ARCH")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*EntityPathMatch{
+		{EntityKindUser, entity.Id.Int32, int64(entity.Uid), entity.Name, archive},
+		{EntityKindLst, le.Id.Int32, le.LstId, le.Name, archive},
+	}
+	if !reflect.DeepEqual(matches, want) {
+		t.Errorf("SearchAllEntitiesByPath() = %v want %v", matches, want)
+	}
+}
+func TestGetUserByScreenName(t *testing.T) {
+	db = opentmpdb()
+	defer db.Close()
+
+	usr := generateUser(1)
+	usr.ScreenName = "Alice"
+	if err := CreateUser(db, usr); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"Alice", "alice", "ALICE"} {
+		got, err := GetUserByScreenName(db, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got == nil || withoutTimestamps(got) != withoutTimestamps(usr) {
+			t.Errorf("GetUserByScreenName(%q) = %v want %v", name, got, usr)
+		}
+	}
+
+	got, err := GetUserByScreenName(db, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != nil {
+		t.Errorf("GetUserByScreenName(\"bob\") = %v want nil", got)
+	}
+}
+
 func hasSameUserRecord(usr *User) (bool, error) {
 	retrieved, err := GetUserById(db, usr.Id)
-	return retrieved != nil && *retrieved == *usr, err
+	return retrieved != nil && withoutTimestamps(retrieved) == withoutTimestamps(usr), err
 }
 
 func generateList(id int) *Lst {
@@ -184,9 +451,226 @@ func TestList(t *testing.T) {
 	}
 }
 
+func TestDeleteListAndAllChildren(t *testing.T) {
+	db = opentmpdb()
+	defer db.Close()
+
+	// 列表 1 有两个实体，每个实体下一个链接；列表 2 不应受影响
+	links := []*UserLink{}
+	entities := []*LstEntity{}
+	if err := CreateLst(db, generateList(1)); err != nil {
+		t.Fatal(err)
+	}
+	for i, dir := range []string{"a", "b"} {
+		le := &LstEntity{LstId: 1, Name: "lst1", ParentDir: filepath.Join(os.TempDir(), dir)}
+		if err := CreateLstEntity(db, le); err != nil {
+			t.Fatal(err)
+		}
+		usr := generateUser(i)
+		if err := CreateUser(db, usr); err != nil {
+			t.Fatal(err)
+		}
+		link := &UserLink{Uid: usr.Id, Name: usr.Name, ParentLstEntityId: le.Id.Int32}
+		if err := CreateUserLink(db, link); err != nil {
+			t.Fatal(err)
+		}
+		entities = append(entities, le)
+		links = append(links, link)
+	}
+	other := generateLink(2, 2)
+	if err := CreateUserLink(db, other); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := DeleteListAndAllChildren(db, 1); err != nil {
+		t.Fatal(err)
+	}
+	lst, err := GetLst(db, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lst != nil {
+		t.Error("lst still exists")
+	}
+	for _, le := range entities {
+		if yes, err := hasSameLstEntityRecord(le); err != nil || yes {
+			t.Errorf("lst entity %d still exists, err: %v", le.Id.Int32, err)
+		}
+	}
+	for _, link := range links {
+		if yes, err := hasSameUserLinkRecord(link); err != nil || yes {
+			t.Errorf("user link %d still exists, err: %v", link.Id.Int32, err)
+		}
+	}
+	if yes, err := hasSameUserLinkRecord(other); err != nil || !yes {
+		t.Errorf("unrelated user link was deleted, err: %v", err)
+	}
+
+	// 不存在的列表
+	if err := DeleteListAndAllChildren(db, 12345); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGetUsersInList(t *testing.T) {
+	db = opentmpdb()
+	defer db.Close()
+
+	// 列表 1 有两个实体，用户 2 同时链接到两者
+	entities := []*LstEntity{}
+	for _, dir := range []string{"a", "b"} {
+		le := &LstEntity{LstId: 1, Name: "lst1", ParentDir: filepath.Join(os.TempDir(), dir)}
+		if err := CreateLstEntity(db, le); err != nil {
+			t.Fatal(err)
+		}
+		entities = append(entities, le)
+	}
+	members := map[int][]*LstEntity{
+		3: {entities[0]},
+		2: {entities[0], entities[1]},
+		1: {entities[1]},
+	}
+	for uid, les := range members {
+		usr := generateUser(uid)
+		if err := CreateUser(db, usr); err != nil {
+			t.Fatal(err)
+		}
+		for _, le := range les {
+			if err := CreateUserLink(db, &UserLink{Uid: usr.Id, Name: usr.Name, ParentLstEntityId: le.Id.Int32}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	other := generateLink(4, 2)
+	if err := CreateUserLink(db, other); err != nil {
+		t.Fatal(err)
+	}
+
+	users, err := GetUsersInList(db, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for _, usr := range users {
+		got = append(got, usr.ScreenName)
+	}
+	want := []string{"user1", "user2", "user3"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("GetUsersInList() = %v want %v", got, want)
+	}
+}
+
+func TestGetListMemberStats(t *testing.T) {
+	f := seedDB(t)
+
+	// user1 有下载记录，user2 没有，user3 不在列表中
+	entity := f.userEntities[0]
+	if _, err := UpdateUserEntityTweetStat(db, int(entity.Id.Int32), time.Now(), 7); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := GetListMemberStats(db, f.lst.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 2 {
+		t.Fatalf("len(stats) = %d want 2", len(stats))
+	}
+	if s := stats[0]; s.Uid != 1 || s.ScreenName != "user1" || s.EntityId != entity.Id || s.MediaCount != 7 || !s.LatestReleaseTime.Valid {
+		t.Errorf("stats[0] = %+v", s)
+	}
+	if s := stats[1]; s.Uid != 2 || s.EntityId != f.userEntities[1].Id || s.MediaCount != 0 || s.LatestReleaseTime.Valid {
+		t.Errorf("stats[1] = %+v", s)
+	}
+
+	// 没有用户实体的成员也会出现
+	if err := DelUserEntity(db, uint32(f.userEntities[1].Id.Int32)); err != nil {
+		t.Fatal(err)
+	}
+	stats, err = GetListMemberStats(db, f.lst.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 2 || stats[1].Uid != 2 || stats[1].EntityId.Valid || stats[1].MediaCount != 0 {
+		t.Errorf("stats = %+v want user2 without entity", stats)
+	}
+}
+
+func TestSeedDB(t *testing.T) {
+	f := seedDB(t)
+
+	for _, usr := range f.users {
+		if yes, err := hasSameUserRecord(usr); err != nil || !yes {
+			t.Errorf("user %d mismatch, err: %v", usr.Id, err)
+		}
+	}
+	for _, entity := range f.userEntities {
+		if yes, err := hasSameUserEntityRecord(entity); err != nil || !yes {
+			t.Errorf("user entity %d mismatch, err: %v", entity.Id.Int32, err)
+		}
+		if _, err := os.Stat(entity.ParentDir); err != nil {
+			t.Error(err)
+		}
+	}
+	for _, link := range f.links {
+		if yes, err := hasSameUserLinkRecord(link); err != nil || !yes {
+			t.Errorf("user link %d mismatch, err: %v", link.Id.Int32, err)
+		}
+	}
+	if err := CheckIntegrity(db); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGetListsForUser(t *testing.T) {
+	db = opentmpdb()
+	defer db.Close()
+
+	usr := generateUser(1)
+	if err := CreateUser(db, usr); err != nil {
+		t.Fatal(err)
+	}
+	// 列表 1 的两个实体和列表 2 的一个实体都链接到用户，列表 3 与用户无关
+	lists := []*Lst{generateList(1), generateList(2), generateList(3)}
+	for _, lst := range lists {
+		if err := CreateLst(db, lst); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := []struct {
+		lid int64
+		dir string
+	}{{1, "a"}, {1, "b"}, {2, "a"}}
+	for _, link := range links {
+		le := &LstEntity{LstId: link.lid, Name: "lst", ParentDir: filepath.Join(os.TempDir(), link.dir)}
+		if err := CreateLstEntity(db, le); err != nil {
+			t.Fatal(err)
+		}
+		if err := CreateUserLink(db, &UserLink{Uid: usr.Id, Name: usr.Name, ParentLstEntityId: le.Id.Int32}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	res, err := GetListsForUser(db, usr.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 2 || withoutTimestamps(res[0]) != withoutTimestamps(lists[0]) || withoutTimestamps(res[1]) != withoutTimestamps(lists[1]) {
+		t.Errorf("GetListsForUser() = %v want %v", res, lists[:2])
+	}
+
+	res, err = GetListsForUser(db, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 0 {
+		t.Errorf("GetListsForUser() of unlinked user = %v", res)
+	}
+}
+
 func isSameLstRecord(lst *Lst) (bool, error) {
 	record, err := GetLst(db, lst.Id)
-	return record != nil && *record == *lst, err
+	return record != nil && withoutTimestamps(record) == withoutTimestamps(lst), err
 }
 
 func TestUserEntity(t *testing.T) {
@@ -242,11 +726,11 @@ func TestUserEntity(t *testing.T) {
 
 		// latest release time
 		now := time.Now()
-		if err = UpdateUserEntityTweetStat(db, int(entity.Id.Int32), now, 25); err != nil {
+		if _, err = UpdateUserEntityTweetStat(db, int(entity.Id.Int32), now, 25); err != nil {
 			t.Error(err)
 			return
 		}
-		entity.MediaCount.Scan(25)
+		entity.MediaCount = 25
 
 		// locate
 		record, err := LocateUserEntity(db, entity.Uid, tempDir)
@@ -264,7 +748,7 @@ func TestUserEntity(t *testing.T) {
 		}
 		record.LatestReleaseTime = sql.NullTime{}
 		entity.LatestReleaseTime = sql.NullTime{}
-		if *record != *entity {
+		if withoutTimestamps(record) != withoutTimestamps(entity) {
 			t.Error("record mismatch on locate user entity")
 			return
 		}
@@ -286,58 +770,339 @@ func TestUserEntity(t *testing.T) {
 	}
 }
 
-func generateUserEntity(uid uint64, pdir string) *UserEntity {
-	ue := UserEntity{}
-	user := generateUser(int(uid))
-	if err := CreateUser(db, user); err != nil {
-		panic(err)
-	}
-
-	ue.Name = user.Name
-	ue.Uid = uid
-	ue.ParentDir = pdir
-	return &ue
-}
-
-func hasSameUserEntityRecord(entity *UserEntity) (bool, error) {
-	record, err := GetUserEntity(db, int(entity.Id.Int32))
-	return record != nil && *record == *entity, err
-}
-
-func TestLstEntity(t *testing.T) {
+func TestRefreshEntityNamesFromUsers(t *testing.T) {
 	db = opentmpdb()
 	defer db.Close()
-	tempdir := os.TempDir()
-	n := 100
-	entities := make([]*LstEntity, n)
+
+	n := 5
+	entities := make([]*UserEntity, n)
 	for i := 0; i < n; i++ {
-		entities[i] = generateLstEntity(int64(i), tempdir)
+		entities[i] = generateUserEntity(uint64(i), os.TempDir())
+		usr, err := GetUserById(db, uint64(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		entities[i].Name = UserEntityTitle(usr.ScreenName, usr.Name)
+		if err := CreateUserEntity(db, entities[i]); err != nil {
+			t.Fatal(err)
+		}
 	}
 
-	for _, entity := range entities {
-		// path
-		expectedPath := filepath.Join(tempdir, entity.Name)
-		if expectedPath != entity.Path() {
-			t.Errorf("entity.Path() = %v want %v", entity.Path(), expectedPath)
-			return
+	// 重命名部分用户，新名称带有文件名中不允许的字符
+	renamed := 0
+	for i := 0; i < n; i += 2 {
+		usr, err := GetUserById(db, uint64(i))
+		if err != nil {
+			t.Fatal(err)
 		}
-		// create
-		if err := CreateLstEntity(db, entity); err != nil {
-			t.Error(err)
-			return
+		usr.Name = usr.Name + "renamed?"
+		if err := UpdateUser(db, usr); err != nil {
+			t.Fatal(err)
 		}
+		renamed++
+	}
 
-		// read
-		yes, err := hasSameLstEntityRecord(entity)
+	updated, err := RefreshEntityNamesFromUsers(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated != renamed {
+		t.Errorf("RefreshEntityNamesFromUsers() = %d want %d", updated, renamed)
+	}
+
+	for _, entity := range entities {
+		record, err := GetUserEntity(db, int(entity.Id.Int32))
 		if err != nil {
-			t.Error(err)
-			return
+			t.Fatal(err)
 		}
-		if !yes {
-			t.Error("record mismatch after create lst entity")
+		usr, err := GetUserById(db, entity.Uid)
+		if err != nil {
+			t.Fatal(err)
 		}
+		if want := UserEntityTitle(usr.ScreenName, usr.Name); record.Name != want {
+			t.Errorf("entity name = %s want %s", record.Name, want)
+		}
+		if strings.Contains(record.Name, "?") {
+			t.Errorf("entity name %s contains characters not allowed in file names", record.Name)
+		}
+	}
 
-		// update
+	if updated, err := RefreshEntityNamesFromUsers(db); err != nil || updated != 0 {
+		t.Errorf("second RefreshEntityNamesFromUsers() = %d, %v want 0", updated, err)
+	}
+}
+
+func TestGetRecentlyActiveUsers(t *testing.T) {
+	f := seedDB(t)
+	now := time.Now()
+	if err := SetUserEntityLatestReleaseTime(db, int(f.userEntities[0].Id.Int32), now.Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	// users[1] 的另一个实体最近更新过，其原有实体从未同步
+	other := &UserEntity{Uid: f.users[1].Id, Name: f.users[1].Name, ParentDir: filepath.Join(f.root, "other")}
+	if err := CreateUserEntity(db, other); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetUserEntityLatestReleaseTime(db, int(other.Id.Int32), now.In(time.FixedZone("", -8*3600))); err != nil {
+		t.Fatal(err)
+	}
+
+	ids := func(users []*User) []uint64 {
+		res := []uint64{}
+		for _, usr := range users {
+			res = append(res, usr.Id)
+		}
+		return res
+	}
+
+	users, err := GetRecentlyActiveUsers(db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []uint64{f.users[1].Id, f.users[0].Id, f.users[2].Id}
+	if got := ids(users); !reflect.DeepEqual(got, want) {
+		t.Errorf("GetRecentlyActiveUsers() = %v want %v", got, want)
+	}
+
+	users, err = GetRecentlyActiveUsers(db, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ids(users); !reflect.DeepEqual(got, want[:1]) {
+		t.Errorf("GetRecentlyActiveUsers(1) = %v want %v", got, want[:1])
+	}
+}
+
+func TestGetStaleUserEntities(t *testing.T) {
+	db = opentmpdb()
+	defer db.Close()
+
+	now := time.Now()
+	// 不同时区的时间也应当被正确比较
+	releases := []*time.Time{
+		nil,
+		ptr(now.Add(-48 * time.Hour).UTC()),
+		ptr(now.Add(-72 * time.Hour).In(time.FixedZone("", 8*3600))),
+		ptr(now.Add(-1 * time.Hour)),
+		nil,
+	}
+	entities := make([]*UserEntity, len(releases))
+	for i, release := range releases {
+		entities[i] = generateUserEntity(uint64(i), os.TempDir())
+		if err := CreateUserEntity(db, entities[i]); err != nil {
+			t.Fatal(err)
+		}
+		if release == nil {
+			continue
+		}
+		if err := SetUserEntityLatestReleaseTime(db, int(entities[i].Id.Int32), *release); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cutoff := now.Add(-24 * time.Hour)
+	stale, err := GetStaleUserEntities(db, cutoff, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []int{0, 4, 2, 1}
+	if len(stale) != len(want) {
+		t.Fatalf("len(GetStaleUserEntities()) = %d want %d", len(stale), len(want))
+	}
+	for i, index := range want {
+		if stale[i].Id != entities[index].Id {
+			t.Errorf("GetStaleUserEntities()[%d] = entity %d want %d", i, stale[i].Id.Int32, entities[index].Id.Int32)
+		}
+	}
+
+	stale, err = GetStaleUserEntities(db, cutoff, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stale) != 3 || stale[2].Id != entities[2].Id {
+		t.Errorf("GetStaleUserEntities() with limit = %v", stale)
+	}
+}
+
+func TestQueryUserEntities(t *testing.T) {
+	db = opentmpdb()
+	defer db.Close()
+
+	now := time.Now()
+	fixtures := []struct {
+		protected bool
+		release   *time.Time
+		count     *int
+	}{
+		{false, nil, nil},
+		{true, ptr(now.Add(-48 * time.Hour)), ptr(5)},
+		{false, ptr(now), ptr(50)},
+		{true, ptr(now), ptr(500)},
+	}
+	entities := make([]*UserEntity, len(fixtures))
+	for i, fixture := range fixtures {
+		usr := generateUser(i)
+		usr.IsProtected = fixture.protected
+		if err := CreateUser(db, usr); err != nil {
+			t.Fatal(err)
+		}
+		entities[i] = &UserEntity{Uid: usr.Id, Name: usr.Name, ParentDir: os.TempDir()}
+		if err := CreateUserEntity(db, entities[i]); err != nil {
+			t.Fatal(err)
+		}
+		if fixture.release != nil {
+			if _, err := UpdateUserEntityTweetStat(db, int(entities[i].Id.Int32), *fixture.release, *fixture.count); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	tests := []struct {
+		name  string
+		query EntityQuery
+		want  []int
+	}{
+		{"all", EntityQuery{}, []int{0, 1, 2, 3}},
+		{"protected", EntityQuery{Protected: sql.NullBool{Bool: true, Valid: true}}, []int{1, 3}},
+		{"stale", EntityQuery{StaleBefore: sql.NullTime{Time: now.Add(-time.Hour), Valid: true}}, []int{0, 1}},
+		{"media range", EntityQuery{
+			MinMediaCount: sql.NullInt32{Int32: 5, Valid: true},
+			MaxMediaCount: sql.NullInt32{Int32: 50, Valid: true},
+		}, []int{1, 2}},
+		{"public and stale", EntityQuery{
+			Protected:   sql.NullBool{Bool: false, Valid: true},
+			StaleBefore: sql.NullTime{Time: now.Add(-time.Hour), Valid: true},
+		}, []int{0}},
+		{"no match", EntityQuery{
+			Protected:     sql.NullBool{Bool: false, Valid: true},
+			MinMediaCount: sql.NullInt32{Int32: 100, Valid: true},
+		}, []int{}},
+	}
+	for _, test := range tests {
+		res, err := QueryUserEntities(db, test.query)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		got := []int{}
+		for _, entity := range res {
+			for i := range entities {
+				if entity.Id == entities[i].Id {
+					got = append(got, i)
+				}
+			}
+		}
+		if fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("%s: QueryUserEntities() = %v want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func TestUpdateUserEntityTweetStatMonotonic(t *testing.T) {
+	db = opentmpdb()
+	defer db.Close()
+
+	entity := generateUserEntity(1, os.TempDir())
+	if err := CreateUserEntity(db, entity); err != nil {
+		t.Fatal(err)
+	}
+	eid := int(entity.Id.Int32)
+	now := time.Now()
+
+	tests := []struct {
+		baseline time.Time
+		count    int
+		advanced bool
+		want     time.Time
+	}{
+		{now, 10, true, now},
+		{now.Add(-time.Hour), 5, false, now}, // 较旧的 baseline 不应使其回退
+		{now, 5, false, now},                 // 相同的 baseline 不是更新
+		{now.Add(time.Hour).UTC(), 20, true, now.Add(time.Hour)},
+	}
+	for i, test := range tests {
+		advanced, err := UpdateUserEntityTweetStat(db, eid, test.baseline, test.count)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if advanced != test.advanced {
+			t.Errorf("%d: UpdateUserEntityTweetStat() = %v want %v", i, advanced, test.advanced)
+		}
+		record, err := GetUserEntity(db, eid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !record.LatestReleaseTime.Time.Equal(test.want) {
+			t.Errorf("%d: latest release time = %v want %v", i, record.LatestReleaseTime.Time, test.want)
+		}
+	}
+}
+
+func generateUserEntity(uid uint64, pdir string) *UserEntity {
+	ue := UserEntity{}
+	user := generateUser(int(uid))
+	if err := CreateUser(db, user); err != nil {
+		panic(err)
+	}
+
+	ue.Name = user.Name
+	ue.Uid = uid
+	ue.ParentDir = pdir
+	return &ue
+}
+
+// 在 parentDir 下名为 name 的用户实体目录中写入 .user 文件
+func writeEntityUserFile(parentDir, name string, uid uint64) error {
+	dir := filepath.Join(parentDir, name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	return WriteUserFile(dir, uid)
+}
+
+func hasSameUserEntityRecord(entity *UserEntity) (bool, error) {
+	record, err := GetUserEntity(db, int(entity.Id.Int32))
+	return record != nil && withoutTimestamps(record) == withoutTimestamps(entity), err
+}
+
+func TestLstEntity(t *testing.T) {
+	db = opentmpdb()
+	defer db.Close()
+	tempdir := os.TempDir()
+	n := 100
+	entities := make([]*LstEntity, n)
+	for i := 0; i < n; i++ {
+		entities[i] = generateLstEntity(int64(i), tempdir)
+	}
+
+	for _, entity := range entities {
+		// path
+		expectedPath := filepath.Join(tempdir, entity.Name)
+		if expectedPath != entity.Path() {
+			t.Errorf("entity.Path() = %v want %v", entity.Path(), expectedPath)
+			return
+		}
+		// create
+		if err := CreateLstEntity(db, entity); err != nil {
+			t.Error(err)
+			return
+		}
+
+		// read
+		yes, err := hasSameLstEntityRecord(entity)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if !yes {
+			t.Error("record mismatch after create lst entity")
+		}
+
+		// update
 		entity.Name = entity.Name + "renamed"
 		if err = UpdateLstEntity(db, entity); err != nil {
 			t.Error(err)
@@ -359,7 +1124,7 @@ func TestLstEntity(t *testing.T) {
 			t.Error(err)
 			return
 		}
-		if record == nil || *record != *entity {
+		if record == nil || withoutTimestamps(record) != withoutTimestamps(entity) {
 			t.Error("record mismatch after locate lst entity")
 			return
 		}
@@ -395,7 +1160,7 @@ func generateLstEntity(lid int64, pdir string) *LstEntity {
 
 func hasSameLstEntityRecord(entity *LstEntity) (bool, error) {
 	record, err := GetLstEntity(db, int(entity.Id.Int32))
-	return record != nil && *record == *entity, err
+	return record != nil && withoutTimestamps(record) == withoutTimestamps(entity), err
 }
 
 func TestLink(t *testing.T) {
@@ -447,7 +1212,7 @@ func TestLink(t *testing.T) {
 			t.Error(err)
 			return
 		}
-		if len(records) != 1 || *records[0] != *link {
+		if len(records) != 1 || withoutTimestamps(records[0]) != withoutTimestamps(link) {
 			t.Error("mismatch record after get all user links")
 			return
 		}
@@ -485,8 +1250,16 @@ func TestLink(t *testing.T) {
 	}
 }
 
+// 生成指向新列表实体的链接，链接的用户不存在时一并创建
 func generateLink(uid int, lid int) *UserLink {
 	usr := generateUser(uid)
+	if exists, err := GetUserById(db, usr.Id); err != nil {
+		panic(err)
+	} else if exists == nil {
+		if err := CreateUser(db, usr); err != nil {
+			panic(err)
+		}
+	}
 	le := generateLstEntity(int64(lid), os.TempDir())
 	if err := CreateLstEntity(db, le); err != nil {
 		panic(err)
@@ -499,60 +1272,3987 @@ func generateLink(uid int, lid int) *UserLink {
 	return &ul
 }
 
-func hasSameUserLinkRecord(link *UserLink) (bool, error) {
-	record, err := GetUserLink(db, link.Uid, link.ParentLstEntityId)
-	return record != nil && *record == *link, err
+func TestUserLinkExists(t *testing.T) {
+	db = opentmpdb()
+	defer db.Close()
+
+	link := generateLink(1, 1)
+	if err := CreateUserLink(db, link); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		uid    uint64
+		parent int32
+		want   bool
+	}{
+		{link.Uid, link.ParentLstEntityId, true},
+		{link.Uid + 1, link.ParentLstEntityId, false},
+		{link.Uid, link.ParentLstEntityId + 1, false},
+	}
+	for _, test := range tests {
+		exists, err := UserLinkExists(db, test.uid, test.parent)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exists != test.want {
+			t.Errorf("UserLinkExists(%d, %d) = %v want %v", test.uid, test.parent, exists, test.want)
+		}
+	}
 }
 
-func benchmarkUpdateUser(b *testing.B, routines int) {
+func TestCreateUserLinkIfNotExists(t *testing.T) {
 	db = opentmpdb()
 	defer db.Close()
 
-	n := 500
-	users := make(chan *User, n)
-	for i := 0; i < n; i++ {
-		user := generateUser(i)
-		if err := CreateUser(db, user); err != nil {
-			b.Error(err)
-			return
-		}
-		user.Name = user.Name + "renamed"
-		users <- user
+	link := generateLink(1, 1)
+	created, err := CreateUserLinkIfNotExists(db, link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !created || !link.Id.Valid {
+		t.Errorf("created = %v, id = %v, want a new link", created, link.Id)
 	}
-	close(users)
 
-	wg := sync.WaitGroup{}
-	routine := func() {
-		defer wg.Done()
-		for user := range users {
-			if err := UpdateUser(db, user); err != nil {
-				b.Error(err)
-			}
-		}
+	dup := &UserLink{Uid: link.Uid, Name: "other", ParentLstEntityId: link.ParentLstEntityId}
+	created, err = CreateUserLinkIfNotExists(db, dup)
+	if err != nil {
+		t.Fatal(err)
 	}
+	if created || dup.Id.Valid {
+		t.Errorf("created = %v, id = %v, want no new link", created, dup.Id)
+	}
+	// 已有的链接保持不变
+	if yes, err := hasSameUserLinkRecord(link); err != nil || !yes {
+		t.Errorf("existing link was changed, err: %v", err)
+	}
+}
 
-	b.ResetTimer()
-	for i := 0; i < b.N; i++ {
-		for j := 0; j < routines; j++ {
-			wg.Add(1)
-			go routine()
-		}
-		wg.Wait()
+func TestDelLstEntityCascade(t *testing.T) {
+	db = opentmpdb()
+	defer db.Close()
+
+	link := generateLink(1, 1)
+	if err := CreateUserLink(db, link); err != nil {
+		t.Fatal(err)
+	}
+	other := generateLink(2, 2)
+	if err := CreateUserLink(db, other); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := DelLstEntity(db, int(link.ParentLstEntityId)); err != nil {
+		t.Fatal(err)
+	}
+	yes, err := hasSameUserLinkRecord(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if yes {
+		t.Error("user link still exists after delete parent lst entity")
+	}
+
+	// 其他列表实体下的链接不受影响
+	yes, err = hasSameUserLinkRecord(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !yes {
+		t.Error("unrelated user link was deleted")
 	}
 }
 
-func BenchmarkUpdateUser1(b *testing.B) {
-	benchmarkUpdateUser(b, 1)
+func TestForeignKeys(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpFile.Close()
+	fkdb, err := sqlx.Connect("sqlite3", fmt.Sprintf("file:%s?_foreign_keys=on", tmpFile.Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fkdb.Close()
+	CreateTables(fkdb)
+
+	usr := generateUser(1)
+	if err := CreateUser(fkdb, usr); err != nil {
+		t.Fatal(err)
+	}
+
+	// 父列表实体不存在
+	link := &UserLink{Uid: usr.Id, Name: "orphan", ParentLstEntityId: 12345}
+	if err := CreateUserLink(fkdb, link); err == nil {
+		t.Error("created a user link with non-existent parent lst entity")
+	}
+
+	// 用户不存在
+	entity := &UserEntity{Uid: 54321, Name: "orphan", ParentDir: os.TempDir()}
+	if err := CreateUserEntity(fkdb, entity); err == nil {
+		t.Error("created a user entity with non-existent user")
+	}
 }
 
-func BenchmarkUpdateUser6(b *testing.B) {
-	benchmarkUpdateUser(b, 6)
+func TestCheckIntegrity(t *testing.T) {
+	db = opentmpdb()
+	defer db.Close()
+
+	link := generateLink(1, 1)
+	if err := CreateUserLink(db, link); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckIntegrity(db); err != nil {
+		t.Fatal(err)
+	}
+
+	// 关闭外键后直接制造悬空的链接
+	disableForeignKeys(t)
+	if _, err := db.Exec(`DELETE FROM lst_entities WHERE id=?`, link.ParentLstEntityId); err != nil {
+		t.Fatal(err)
+	}
+	err := CheckIntegrity(db)
+	if err == nil {
+		t.Fatal("expected integrity error for orphaned user link")
+	}
+	if !strings.Contains(err.Error(), "user_links") || !strings.Contains(err.Error(), "lst_entities") {
+		t.Errorf("error does not describe the orphaned row: %v", err)
+	}
 }
 
-func BenchmarkUpdateUser12(b *testing.B) {
-	benchmarkUpdateUser(b, 12)
+func TestVacuum(t *testing.T) {
+	db = opentmpdb()
+	defer db.Close()
+
+	for i := 0; i < 100; i++ {
+		entity := generateUserEntity(uint64(i), os.TempDir())
+		if err := CreateUserEntity(db, entity); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.Exec(`DELETE FROM user_entities`); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Vacuum(db); err != nil {
+		t.Fatal(err)
+	}
+	// ANALYZE 会创建 sqlite_stat1
+	var exists bool
+	if err := db.Get(&exists, `SELECT EXISTS(SELECT 1 FROM sqlite_master WHERE name='sqlite_stat1')`); err != nil {
+		t.Fatal(err)
+	}
+	if !exists {
+		t.Error("sqlite_stat1 was not created by ANALYZE")
+	}
 }
 
-func BenchmarkUpdateUser24(b *testing.B) {
-	benchmarkUpdateUser(b, 24)
+func TestOrphanedUserLinks(t *testing.T) {
+	db = opentmpdb()
+	defer db.Close()
+
+	kept := generateLink(1, 1)
+	if err := CreateUserLink(db, kept); err != nil {
+		t.Fatal(err)
+	}
+	// 绕过 DelLstEntity 的级联删除，模拟外键启用前遗留的数据
+	orphan := generateLink(2, 2)
+	if err := CreateUserLink(db, orphan); err != nil {
+		t.Fatal(err)
+	}
+	disableForeignKeys(t)
+	if _, err := db.Exec(`DELETE FROM lst_entities WHERE id=?`, orphan.ParentLstEntityId); err != nil {
+		t.Fatal(err)
+	}
+
+	orphans, err := GetOrphanedUserLinks(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orphans) != 1 || withoutTimestamps(orphans[0]) != withoutTimestamps(orphan) {
+		t.Errorf("GetOrphanedUserLinks() = %v want [%v]", orphans, orphan)
+	}
+
+	n, err := PruneOrphanedUserLinks(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("PruneOrphanedUserLinks() = %d want 1", n)
+	}
+	orphans, err = GetOrphanedUserLinks(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orphans) != 0 {
+		t.Errorf("orphaned links remain after prune: %v", orphans)
+	}
+	yes, err := hasSameUserLinkRecord(kept)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !yes {
+		t.Error("valid user link was pruned")
+	}
+}
+
+func hasSameUserLinkRecord(link *UserLink) (bool, error) {
+	record, err := GetUserLink(db, link.Uid, link.ParentLstEntityId)
+	return record != nil && withoutTimestamps(record) == withoutTimestamps(link), err
+}
+
+func TestUserFile(t *testing.T) {
+	db = opentmpdb()
+	defer db.Close()
+
+	dir, err := os.MkdirTemp("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// read/write
+	if err := WriteUserFile(dir, 42); err != nil {
+		t.Fatal(err)
+	}
+	uid, err := ReadUserFile(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uid != 42 {
+		t.Errorf("ReadUserFile() = %d want 42", uid)
+	}
+
+	for _, content := range []string{"", "  \n", "not a uid"} {
+		if err := os.WriteFile(filepath.Join(dir, userFileName), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ReadUserFile(dir); err == nil {
+			t.Errorf("ReadUserFile() with content %q should fail", content)
+		}
+	}
+
+	// 其他用户的 .user 文件不应导致记录被迁移
+	oldDir, err := os.MkdirTemp("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(oldDir)
+	entity := generateUserEntity(1, oldDir)
+	if err := CreateUserEntity(db, entity); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writeEntityUserFile(dir, entity.Name, 2); err != nil {
+		t.Fatal(err)
+	}
+	record, err := LocateUserEntity(db, entity.Uid, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record != nil {
+		t.Errorf("located %v by the user file of another user", record)
+	}
+
+	if err := writeEntityUserFile(dir, entity.Name, entity.Uid); err != nil {
+		t.Fatal(err)
+	}
+	record, err = LocateUserEntity(db, entity.Uid, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record == nil || record.Id != entity.Id || record.ParentDir != dir {
+		t.Errorf("LocateUserEntity() = %v want entity %d relocated to %s", record, entity.Id.Int32, dir)
+	}
+}
+
+func TestDeleteUserCascade(t *testing.T) {
+	f := seedDB(t)
+	usr := f.users[0]
+	if err := RecordUserPreviousName(db, usr.Id, "old", "old"); err != nil {
+		t.Fatal(err)
+	}
+	if err := RecordDownloadError(db, int(f.userEntities[0].Id.Int32), 1, "url", errors.New("failed")); err != nil {
+		t.Fatal(err)
+	}
+	if err := AddToWatchlist(db, usr.ScreenName); err != nil {
+		t.Fatal(err)
+	}
+	if err := ResolveWatchlistEntry(db, usr.ScreenName, usr.Id); err != nil {
+		t.Fatal(err)
+	}
+
+	deleted, err := DeleteUserCascade(db, usr.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !deleted {
+		t.Error("DeleteUserCascade() = false want true")
+	}
+
+	for _, table := range []string{"user_links WHERE user_id=?", "user_entities WHERE user_id=?",
+		"user_previous_names WHERE uid=?", "user_friends_history WHERE uid=?", "users WHERE id=?",
+		"watchlist WHERE resolved_uid=?"} {
+		var n int
+		if err := db.Get(&n, `SELECT COUNT(*) FROM `+table, usr.Id); err != nil {
+			t.Fatal(err)
+		}
+		if n != 0 {
+			t.Errorf("%d rows left in %s", n, table)
+		}
+	}
+	var n int
+	if err := db.Get(&n, `SELECT COUNT(*) FROM download_errors`); err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("%d download errors left", n)
+	}
+
+	// 其他用户不受影响
+	if yes, err := hasSameUserEntityRecord(f.userEntities[1]); err != nil || !yes {
+		t.Errorf("entity of other user changed, err: %v", err)
+	}
+
+	deleted, err = DeleteUserCascade(db, usr.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted {
+		t.Error("DeleteUserCascade() = true for a missing user")
+	}
+}
+
+func TestMergePlaceholderIntoUser(t *testing.T) {
+	db = opentmpdb()
+	defer db.Close()
+
+	dirA, dirB := filepath.Join(os.TempDir(), "a"), filepath.Join(os.TempDir(), "b")
+	realEntity := generateUserEntity(1, dirA)
+	if err := CreateUserEntity(db, realEntity); err != nil {
+		t.Fatal(err)
+	}
+	// 占位用户在 dirA 的实体与真实用户冲突，在 dirB 的实体应被转移
+	conflicted := generateUserEntity(100, dirA)
+	if err := CreateUserEntity(db, conflicted); err != nil {
+		t.Fatal(err)
+	}
+	moved := &UserEntity{Uid: 100, Name: "placeholder", ParentDir: dirB}
+	if err := CreateUserEntity(db, moved); err != nil {
+		t.Fatal(err)
+	}
+	le := generateLstEntity(1, os.TempDir())
+	if err := CreateLstEntity(db, le); err != nil {
+		t.Fatal(err)
+	}
+	link := &UserLink{Uid: 100, Name: "placeholder", ParentLstEntityId: le.Id.Int32}
+	if err := CreateUserLink(db, link); err != nil {
+		t.Fatal(err)
+	}
+	if err := RecordUserPreviousName(db, 100, "placeholder", "placeholder"); err != nil {
+		t.Fatal(err)
+	}
+	if err := AddUserTag(db, 100, "art"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := MergePlaceholderIntoUser(db, 100, 2); !errors.Is(err, ErrNotFound) {
+		t.Errorf("merge into a non-existent user: %v want ErrNotFound", err)
+	}
+	if err := MergePlaceholderIntoUser(db, 100, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	usr, err := GetUserById(db, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usr != nil {
+		t.Error("placeholder user still exists after merge")
+	}
+
+	record, err := GetUserEntity(db, int(moved.Id.Int32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record == nil || record.Uid != 1 {
+		t.Errorf("entity in %s = %v want owned by user 1", dirB, record)
+	}
+	record, err = GetUserEntity(db, int(conflicted.Id.Int32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record != nil {
+		t.Errorf("conflicted placeholder entity still exists: %v", record)
+	}
+	yes, err := hasSameUserEntityRecord(realEntity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !yes {
+		t.Error("entity of real user changed after merge")
+	}
+
+	if tags, err := GetUserTags(db, 1); err != nil || !reflect.DeepEqual(tags, []string{"art"}) {
+		t.Errorf("tags of real user = %v, %v want [art]", tags, err)
+	}
+
+	links, err := GetUserLinks(db, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(links) != 1 || links[0].Id != link.Id {
+		t.Errorf("links of real user = %v", links)
+	}
+
+	var count int
+	if err := db.Get(&count, `SELECT COUNT(*) FROM user_previous_names WHERE uid=1`); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("previous names of real user = %d want 1", count)
+	}
+}
+
+func TestMergeUserEntities(t *testing.T) {
+	db = opentmpdb()
+	defer db.Close()
+
+	now := time.Now()
+	dirs := []string{"a", "b", "c"}
+	entities := make([]*UserEntity, len(dirs))
+	for i, dir := range dirs {
+		if i == 0 {
+			entities[i] = generateUserEntity(1, filepath.Join(os.TempDir(), dir))
+		} else {
+			entities[i] = &UserEntity{Uid: 1, Name: "user1", ParentDir: filepath.Join(os.TempDir(), dir)}
+		}
+		if err := CreateUserEntity(db, entities[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	single := generateUserEntity(2, os.TempDir())
+	if err := CreateUserEntity(db, single); err != nil {
+		t.Fatal(err)
+	}
+	// a: 较新但数量少，b: 较旧但数量多，c: 从未同步
+	if _, err := UpdateUserEntityTweetStat(db, int(entities[0].Id.Int32), now, 10); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := UpdateUserEntityTweetStat(db, int(entities[1].Id.Int32), now.Add(-time.Hour), 30); err != nil {
+		t.Fatal(err)
+	}
+	for i, n := range []int64{100, 200, 300} {
+		if err := AddUserEntityBytes(db, int(entities[i].Id.Int32), n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := RecordDownloadError(db, int(entities[0].Id.Int32), 1, "https://example.com/1.jpg", errors.New("404")); err != nil {
+		t.Fatal(err)
+	}
+
+	dups, err := FindDuplicateUserEntities(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dups) != 1 || len(dups[1]) != 3 {
+		t.Fatalf("FindDuplicateUserEntities() = %v", dups)
+	}
+
+	if err := MergeUserEntities(db, int(entities[2].Id.Int32), []int{int(single.Id.Int32)}); err == nil {
+		t.Error("merged user entities of different users")
+	}
+	if err := MergeUserEntities(db, int(entities[2].Id.Int32), []int{12345}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("merge a non-existent entity: %v want ErrNotFound", err)
+	}
+
+	keepId := int(entities[2].Id.Int32)
+	if err := MergeUserEntities(db, keepId, []int{int(entities[0].Id.Int32), int(entities[1].Id.Int32)}); err != nil {
+		t.Fatal(err)
+	}
+	kept, err := GetUserEntity(db, keepId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kept.MediaCount != 30 || !kept.LatestReleaseTime.Time.Equal(now) || kept.TotalBytes != 600 {
+		t.Errorf("merged entity = %v want media count 30, total bytes 600 and latest release time %v", kept, now)
+	}
+	// 被合并实体的下载失败记录转移到保留的实体
+	if errs, err := GetRecentDownloadErrors(db, keepId, 0); err != nil || len(errs) != 1 {
+		t.Errorf("download errors of merged entity = %v, err: %v want 1 record", errs, err)
+	}
+
+	dups, err = FindDuplicateUserEntities(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dups) != 0 {
+		t.Errorf("duplicates remain after merge: %v", dups)
+	}
+}
+
+func TestListMissingUserEntities(t *testing.T) {
+	db = opentmpdb()
+	defer db.Close()
+
+	existing, err := os.MkdirTemp("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(existing)
+	missing := filepath.Join(existing, "missing")
+
+	present := generateUserEntity(1, existing)
+	if err := CreateUserEntity(db, present); err != nil {
+		t.Fatal(err)
+	}
+	absent := generateUserEntity(2, missing)
+	if err := CreateUserEntity(db, absent); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := ListMissingUserEntities(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 1 || withoutTimestamps(res[0]) != withoutTimestamps(absent) {
+		t.Errorf("ListMissingUserEntities() = %v want [%v]", res, absent)
+	}
+	// 只读
+	if yes, err := hasSameUserEntityRecord(absent); err != nil || !yes {
+		t.Errorf("missing entity was changed, err: %v", err)
+	}
+}
+
+func TestRebaseEntityPaths(t *testing.T) {
+	db = opentmpdb()
+	defer db.Close()
+
+	oldRoot := filepath.Join(os.TempDir(), "old")
+	newRoot := filepath.Join(os.TempDir(), "new")
+
+	atRoot := generateUserEntity(1, oldRoot)
+	nested := generateUserEntity(2, filepath.Join(oldRoot, "sub"))
+	upper := generateUserEntity(3, filepath.Join(os.TempDir(), "OLD", "sub"))
+	sibling := generateUserEntity(4, oldRoot+"er")
+	for _, entity := range []*UserEntity{atRoot, nested, upper, sibling} {
+		if err := CreateUserEntity(db, entity); err != nil {
+			t.Fatal(err)
+		}
+	}
+	le := generateLstEntity(1, filepath.Join(oldRoot, "lists"))
+	if err := CreateLstEntity(db, le); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := RebaseEntityPaths(db, oldRoot+string(filepath.Separator), newRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 4 {
+		t.Errorf("RebaseEntityPaths() = %d want 4", n)
+	}
+
+	atRoot.ParentDir = newRoot
+	nested.ParentDir = filepath.Join(newRoot, "sub")
+	upper.ParentDir = filepath.Join(newRoot, "sub")
+	for _, entity := range []*UserEntity{atRoot, nested, upper, sibling} {
+		if yes, err := hasSameUserEntityRecord(entity); err != nil || !yes {
+			t.Errorf("user entity %d mismatch after rebase, err: %v", entity.Id.Int32, err)
+		}
+	}
+	le.ParentDir = filepath.Join(newRoot, "lists")
+	if yes, err := hasSameLstEntityRecord(le); err != nil || !yes {
+		t.Errorf("lst entity mismatch after rebase, err: %v", err)
+	}
+}
+
+func TestDistinctParentDirs(t *testing.T) {
+	db = opentmpdb()
+	defer db.Close()
+
+	root := filepath.Join(os.TempDir(), "roots")
+	a := filepath.Join(root, "a")
+	aSpace := filepath.Join(root, "a b")
+	aNested := filepath.Join(root, "a", "x")
+	other := filepath.Join(os.TempDir(), "other")
+	// 与 COLLATE NOCASE 一致，非 ASCII 字母区分大小写
+	upper := filepath.Join(root, "Ä")
+	lowerNested := filepath.Join(root, "ä", "x")
+
+	for i, dir := range []string{a, aNested, a, other, upper, lowerNested} {
+		if err := CreateUserEntity(db, generateUserEntity(uint64(i+1), dir)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := CreateLstEntity(db, generateLstEntity(1, aSpace)); err != nil {
+		t.Fatal(err)
+	}
+	if err := CreateLstEntity(db, generateLstEntity(2, other)); err != nil {
+		t.Fatal(err)
+	}
+
+	dirs, err := DistinctParentDirs(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{a, aSpace, aNested, other, upper, lowerNested}
+	sort.Strings(want)
+	if !reflect.DeepEqual(dirs, want) {
+		t.Errorf("DistinctParentDirs() = %v want %v", dirs, want)
+	}
+
+	groups, err := GroupParentDirsByRoot(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantGroups := map[string][]string{
+		a:           {a, aNested},
+		aSpace:      {aSpace},
+		other:       {other},
+		upper:       {upper},
+		lowerNested: {lowerNested},
+	}
+	if !reflect.DeepEqual(groups, wantGroups) {
+		t.Errorf("GroupParentDirsByRoot() = %v want %v", groups, wantGroups)
+	}
+}
+
+func TestExportImportConfig(t *testing.T) {
+	db = opentmpdb()
+	defer db.Close()
+
+	dir, err := os.MkdirTemp("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	missing := filepath.Join(dir, "missing")
+
+	present := generateUserEntity(1, dir)
+	if err := CreateUserEntity(db, present); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := UpdateUserEntityTweetStat(db, int(present.Id.Int32), time.Now(), 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := UpdateUserEntityMediaBreakdown(db, int(present.Id.Int32), 3, 4, 3); err != nil {
+		t.Fatal(err)
+	}
+	if present, err = GetUserEntity(db, int(present.Id.Int32)); err != nil {
+		t.Fatal(err)
+	}
+	absent := generateUserEntity(2, missing)
+	if err := CreateUserEntity(db, absent); err != nil {
+		t.Fatal(err)
+	}
+	lst := generateList(1)
+	if err := CreateLst(db, lst); err != nil {
+		t.Fatal(err)
+	}
+	le := &LstEntity{LstId: int64(lst.Id), Name: lst.Name, ParentDir: dir}
+	if err := CreateLstEntity(db, le); err != nil {
+		t.Fatal(err)
+	}
+	absentLe := &LstEntity{LstId: int64(lst.Id), Name: lst.Name, ParentDir: missing}
+	if err := CreateLstEntity(db, absentLe); err != nil {
+		t.Fatal(err)
+	}
+	link := &UserLink{Uid: 1, Name: "link", ParentLstEntityId: le.Id.Int32}
+	if err := CreateUserLink(db, link); err != nil {
+		t.Fatal(err)
+	}
+	absentLink := &UserLink{Uid: 2, Name: "link", ParentLstEntityId: absentLe.Id.Int32}
+	if err := CreateUserLink(db, absentLink); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := ExportConfig(db, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	dst, err := OpenDB(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	// 导入两次，第二次应当只更新已有记录
+	for i := 0; i < 2; i++ {
+		if err := ImportConfig(dst, bytes.NewReader(buf.Bytes())); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, uid := range []uint64{1, 2} {
+		want, _ := GetUserById(db, uid)
+		got, err := GetUserById(dst, uid)
+		if err != nil || got == nil || withoutTimestamps(got) != withoutTimestamps(want) {
+			t.Errorf("user %d = %v want %v, err: %v", uid, got, want, err)
+		}
+	}
+	if got, err := GetLst(dst, lst.Id); err != nil || got == nil || withoutTimestamps(got) != withoutTimestamps(lst) {
+		t.Errorf("lst = %v want %v, err: %v", got, lst, err)
+	}
+
+	entities := []*UserEntity{}
+	if err := dst.Select(&entities, `SELECT * FROM user_entities`); err != nil {
+		t.Fatal(err)
+	}
+	if len(entities) != 1 {
+		t.Fatalf("len(user_entities) = %d want 1", len(entities))
+	}
+	got := entities[0]
+	if got.Uid != present.Uid || got.Name != present.Name || got.ParentDir != present.ParentDir ||
+		got.MediaCount != present.MediaCount || !got.LatestReleaseTime.Time.Equal(present.LatestReleaseTime.Time) {
+		t.Errorf("user entity = %v want %v", got, present)
+	}
+
+	// 已有实体的 media_count 为 0 时各类型数量也一并取导入的值，保持 media_count 为三者之和
+	if _, err := dst.Exec(`UPDATE user_entities SET media_count=0, photo_count=1, video_count=0, gif_count=0`); err != nil {
+		t.Fatal(err)
+	}
+	if err := ImportConfig(dst, bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if got, err = GetUserEntity(dst, int(got.Id.Int32)); err != nil {
+		t.Fatal(err)
+	}
+	if got.MediaCount != present.MediaCount || got.PhotoCount != 3 || got.VideoCount != 4 || got.GifCount != 3 {
+		t.Errorf("counts after import = %d (%d/%d/%d) want %d (3/4/3)",
+			got.MediaCount, got.PhotoCount, got.VideoCount, got.GifCount, present.MediaCount)
+	}
+
+	lstEntities := []*LstEntity{}
+	if err := dst.Select(&lstEntities, `SELECT * FROM lst_entities`); err != nil {
+		t.Fatal(err)
+	}
+	if len(lstEntities) != 1 || lstEntities[0].ParentDir != dir {
+		t.Fatalf("lst_entities = %v want one entity under %s", lstEntities, dir)
+	}
+	links, err := GetUserLinks(dst, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(links) != 1 || links[0].Name != link.Name || links[0].ParentLstEntityId != lstEntities[0].Id.Int32 {
+		t.Errorf("user links = %v want [%v]", links, link)
+	}
+	if links, err := GetUserLinks(dst, 2); err != nil || len(links) != 0 {
+		t.Errorf("links of skipped entity = %v, err: %v", links, err)
+	}
+
+	if err := ImportConfig(dst, strings.NewReader(`{"version": 999}`)); err == nil {
+		t.Error("expected error for unsupported version")
+	}
+}
+
+func TestDumpSQL(t *testing.T) {
+	db = opentmpdb()
+	defer db.Close()
+
+	usr := generateUser(1)
+	usr.Name = `it's a "quoted" name`
+	if err := CreateUser(db, usr); err != nil {
+		t.Fatal(err)
+	}
+	if err := RecordUserPreviousName(db, usr.Id, usr.Name, usr.ScreenName); err != nil {
+		t.Fatal(err)
+	}
+	ue := &UserEntity{Uid: usr.Id, Name: usr.Name, ParentDir: os.TempDir()}
+	if err := CreateUserEntity(db, ue); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := UpdateUserEntityTweetStat(db, int(ue.Id.Int32), time.Now(), 10); err != nil {
+		t.Fatal(err)
+	}
+	link := generateLink(2, 2)
+	if err := CreateUserLink(db, link); err != nil {
+		t.Fatal(err)
+	}
+
+	dumped := bytes.Buffer{}
+	if err := DumpSQL(db, &dumped); err != nil {
+		t.Fatal(err)
+	}
+
+	// 还原到一个空数据库后再次导出，两次导出的内容应当一致
+	tmpFile, err := os.CreateTemp("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpFile.Close()
+	restored, err := sqlx.Connect("sqlite3", tmpFile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	if _, err := restored.Exec(dumped.String()); err != nil {
+		t.Fatal(err)
+	}
+
+	redumped := bytes.Buffer{}
+	if err := DumpSQL(restored, &redumped); err != nil {
+		t.Fatal(err)
+	}
+	if dumped.String() != redumped.String() {
+		t.Errorf("dump mismatch after restore:\n%s\nwant:\n%s", redumped.String(), dumped.String())
+	}
+
+	record, err := GetUserById(restored, usr.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record == nil || withoutTimestamps(record) != withoutTimestamps(usr) {
+		t.Errorf("restored user = %v want %v", record, usr)
+	}
+	entity, err := GetUserEntity(restored, int(ue.Id.Int32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entity == nil || !entity.LatestReleaseTime.Valid || entity.MediaCount != 10 {
+		t.Errorf("restored user entity = %v", entity)
+	}
+	// 时间列按存储的文本原样还原，DATE 列不会变成完整的时间戳
+	for _, stmt := range []string{
+		`SELECT CAST(record_date AS TEXT) FROM user_friends_history`,
+		`SELECT CAST(created_at AS TEXT) FROM users`,
+		`SELECT CAST(latest_release_time AS TEXT) FROM user_entities`,
+	} {
+		var want, got []string
+		if err := db.Select(&want, stmt); err != nil {
+			t.Fatal(err)
+		}
+		if err := restored.Select(&got, stmt); err != nil {
+			t.Fatal(err)
+		}
+		if len(want) == 0 || !reflect.DeepEqual(got, want) {
+			t.Errorf("%s = %v after restore want %v", stmt, got, want)
+		}
+	}
+
+	// 还原的数据库已是最新版本，OpenDB 不应重复执行迁移
+	restored.Close()
+	reopened, err := OpenDB(tmpFile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	var version int
+	if err := reopened.Get(&version, `PRAGMA user_version`); err != nil {
+		t.Fatal(err)
+	}
+	if version != len(migrations) {
+		t.Errorf("user_version = %d want %d", version, len(migrations))
+	}
+}
+
+func TestOpenDBConcurrentWrites(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpFile.Close()
+	db, err = OpenDB(tmpFile.Name(), WithBusyTimeout(10*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var mode string
+	if err := db.Get(&mode, `PRAGMA journal_mode`); err != nil {
+		t.Fatal(err)
+	}
+	if mode != "wal" {
+		t.Errorf("journal_mode = %s want wal", mode)
+	}
+
+	n := 10
+	entities := make([]*UserEntity, n)
+	for i := 0; i < n; i++ {
+		entities[i] = generateUserEntity(uint64(i), os.TempDir())
+		if err := CreateUserEntity(db, entities[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	routines := 24
+	wg := sync.WaitGroup{}
+	errs := make(chan error, routines)
+	for r := 0; r < routines; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				entity := entities[(r+i)%n]
+				if err := UpdateUserEntityMediCount(db, int(entity.Id.Int32), i); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(r)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestOpenDBCacheOptions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.db")
+	cached, err := OpenDB(path, WithCacheSize(-8192), WithMmapSize(1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cached.Close()
+
+	// 同时占用多个连接，确认每个新连接都设置了 PRAGMA
+	conns := []*sqlx.Conn{}
+	for i := 0; i < 3; i++ {
+		conn, err := cached.Connx(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+	for _, conn := range conns {
+		var cacheSize, mmapSize int64
+		if err := conn.GetContext(context.Background(), &cacheSize, `PRAGMA cache_size`); err != nil {
+			t.Fatal(err)
+		}
+		if err := conn.GetContext(context.Background(), &mmapSize, `PRAGMA mmap_size`); err != nil {
+			t.Fatal(err)
+		}
+		if cacheSize != -8192 {
+			t.Errorf("cache_size = %d want -8192", cacheSize)
+		}
+		// 编译时禁用了 mmap 的 SQLite 总是返回 0
+		if mmapSize != 1<<20 && mmapSize != 0 {
+			t.Errorf("mmap_size = %d want %d", mmapSize, 1<<20)
+		}
+	}
+
+	if _, err := OpenDB(":memory:", WithCacheSize(0)); err == nil {
+		t.Error("opened database with cache size 0")
+	}
+	if _, err := OpenDB(":memory:", WithMmapSize(-1)); err == nil {
+		t.Error("opened database with negative mmap size")
+	}
+}
+
+func TestOpenDBReadOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ro.db")
+	rw, err := OpenDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	usr := generateUser(1)
+	if err := CreateUser(rw, usr); err != nil {
+		t.Fatal(err)
+	}
+	rw.Close()
+
+	ro, err := OpenDBReadOnly(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ro.Close()
+
+	record, err := GetUserById(ro, usr.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record == nil || record.ScreenName != usr.ScreenName {
+		t.Errorf("GetUserById() = %v want %v", record, usr)
+	}
+	if err := CreateUser(ro, generateUser(2)); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("CreateUser() on read-only database: %v want ErrReadOnly", err)
+	}
+	if n, err := CountUsers(ro); err != nil || n != 1 {
+		t.Errorf("CountUsers() = %d, %v want 1", n, err)
+	}
+
+	if _, err := OpenDBReadOnly(filepath.Join(t.TempDir(), "missing.db")); err == nil {
+		t.Error("opened a missing database read-only")
+	}
+}
+
+func TestOpenDBMemory(t *testing.T) {
+	mem, err := OpenDB(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mem.Close()
+
+	var version int
+	if err := mem.Get(&version, `PRAGMA user_version`); err != nil {
+		t.Fatal(err)
+	}
+	if version != len(migrations) {
+		t.Errorf("user_version = %d want %d", version, len(migrations))
+	}
+	// 重复迁移不应出错
+	if err := Migrate(mem); err != nil {
+		t.Fatal(err)
+	}
+
+	usr := generateUser(1)
+	if err := CreateUser(mem, usr); err != nil {
+		t.Fatal(err)
+	}
+	record, err := GetUserById(mem, usr.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record == nil || withoutTimestamps(record) != withoutTimestamps(usr) {
+		t.Errorf("GetUserById() = %v want %v", record, usr)
+	}
+
+	// 不同的内存数据库相互独立
+	other, err := OpenDB(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	record, err = GetUserById(other, usr.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record != nil {
+		t.Errorf("user %v leaked into another in-memory database", record)
+	}
+}
+
+func TestCounts(t *testing.T) {
+	db = opentmpdb()
+	defer db.Close()
+
+	for i := 0; i < 3; i++ {
+		if err := CreateUserEntity(db, generateUserEntity(uint64(i), os.TempDir())); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := CreateUser(db, generateUser(3)); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := CreateLstEntity(db, generateLstEntity(int64(i), os.TempDir())); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		count func(*sqlx.DB) (int, error)
+		want  int
+	}{
+		{"CountUsers", CountUsers, 4},
+		{"CountUserEntities", CountUserEntities, 3},
+		{"CountLstEntities", CountLstEntities, 2},
+	}
+	for _, test := range tests {
+		got, err := test.count(db)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s() = %d want %d", test.name, got, test.want)
+		}
+	}
+}
+
+func TestSumMediaCount(t *testing.T) {
+	db = opentmpdb()
+	defer db.Close()
+
+	n, err := SumMediaCount(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("SumMediaCount() on empty db = %d want 0", n)
+	}
+
+	// 用户 0,1 属于列表 0，用户 2 属于列表 1，用户 3 不属于任何列表且 media_count 为 NULL
+	le0 := generateLstEntity(0, os.TempDir())
+	if err := CreateLstEntity(db, le0); err != nil {
+		t.Fatal(err)
+	}
+	le1 := generateLstEntity(1, os.TempDir())
+	if err := CreateLstEntity(db, le1); err != nil {
+		t.Fatal(err)
+	}
+	parents := []*LstEntity{le0, le0, le1, nil}
+	for i, parent := range parents {
+		entity := generateUserEntity(uint64(i), os.TempDir())
+		if err := CreateUserEntity(db, entity); err != nil {
+			t.Fatal(err)
+		}
+		if parent == nil {
+			continue
+		}
+		if err := UpdateUserEntityMediCount(db, int(entity.Id.Int32), (i+1)*10); err != nil {
+			t.Fatal(err)
+		}
+		link := &UserLink{Uid: entity.Uid, Name: entity.Name, ParentLstEntityId: parent.Id.Int32}
+		if err := CreateUserLink(db, link); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n, err = SumMediaCount(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 60 {
+		t.Errorf("SumMediaCount() = %d want 60", n)
+	}
+
+	tests := []struct {
+		lid  uint64
+		want int64
+	}{{0, 30}, {1, 30}, {2, 0}}
+	for _, test := range tests {
+		n, err = SumMediaCountByLst(db, test.lid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != test.want {
+			t.Errorf("SumMediaCountByLst(%d) = %d want %d", test.lid, n, test.want)
+		}
+	}
+}
+
+func TestWatchlist(t *testing.T) {
+	db = opentmpdb()
+	defer db.Close()
+
+	names := []string{"alice", "bob", "carol"}
+	for _, name := range names {
+		if err := AddToWatchlist(db, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 重复添加
+	if err := AddToWatchlist(db, "Alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := ListWatchlist(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != len(names) {
+		t.Fatalf("len(ListWatchlist()) = %d want %d", len(entries), len(names))
+	}
+	for i, entry := range entries {
+		if entry.ScreenName != names[i] || entry.ResolvedUid.Valid || entry.AddedAt.IsZero() {
+			t.Errorf("entry %d = %v", i, entry)
+		}
+	}
+
+	// resolve
+	usr := generateUser(1)
+	if err := CreateUser(db, usr); err != nil {
+		t.Fatal(err)
+	}
+	if err := ResolveWatchlistEntry(db, "BOB", usr.Id); err != nil {
+		t.Fatal(err)
+	}
+	if err := ResolveWatchlistEntry(db, "dave", usr.Id); !errors.Is(err, ErrNotFound) {
+		t.Errorf("ResolveWatchlistEntry(dave) = %v want ErrNotFound", err)
+	}
+
+	entries, err = ListWatchlist(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		resolved := entry.ScreenName == "bob"
+		if entry.ResolvedUid.Valid != resolved || (resolved && uint64(entry.ResolvedUid.Int64) != usr.Id) {
+			t.Errorf("entry after resolve = %v", entry)
+		}
+	}
+}
+
+func benchmarkUpdateUser(b *testing.B, routines int) {
+	db = opentmpdb()
+	defer db.Close()
+
+	n := 500
+	users := make(chan *User, n)
+	for i := 0; i < n; i++ {
+		user := generateUser(i)
+		if err := CreateUser(db, user); err != nil {
+			b.Error(err)
+			return
+		}
+		user.Name = user.Name + "renamed"
+		users <- user
+	}
+	close(users)
+
+	wg := sync.WaitGroup{}
+	routine := func() {
+		defer wg.Done()
+		for user := range users {
+			if err := UpdateUser(db, user); err != nil {
+				b.Error(err)
+			}
+		}
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < routines; j++ {
+			wg.Add(1)
+			go routine()
+		}
+		wg.Wait()
+	}
+}
+
+func BenchmarkUpdateUser1(b *testing.B) {
+	benchmarkUpdateUser(b, 1)
+}
+
+func BenchmarkUpdateUser6(b *testing.B) {
+	benchmarkUpdateUser(b, 6)
+}
+
+func BenchmarkUpdateUser12(b *testing.B) {
+	benchmarkUpdateUser(b, 12)
+}
+
+func BenchmarkUpdateUser24(b *testing.B) {
+	benchmarkUpdateUser(b, 24)
+}
+
+func TestWithRetry(t *testing.T) {
+	o := &options{maxRetries: 3, maxRetryDelay: 20 * time.Millisecond}
+	busy := sqlite3.Error{Code: sqlite3.ErrBusy}
+	locked := sqlite3.Error{Code: sqlite3.ErrLocked}
+	other := sqlite3.Error{Code: sqlite3.ErrConstraint}
+
+	tests := []struct {
+		name      string
+		errs      []error // 每次调用返回的错误，超出部分返回 nil
+		wantCalls int
+		wantErr   error
+	}{
+		{"success", nil, 1, nil},
+		{"busy then success", []error{busy, locked}, 3, nil},
+		{"other error", []error{other}, 1, other},
+		{"always busy", []error{busy, busy, busy, busy, busy}, 4, busy},
+	}
+	for _, test := range tests {
+		calls := 0
+		err := withRetry(o, func() error {
+			calls++
+			if calls <= len(test.errs) {
+				return test.errs[calls-1]
+			}
+			return nil
+		})
+		if calls != test.wantCalls {
+			t.Errorf("%s: calls = %d want %d", test.name, calls, test.wantCalls)
+		}
+		if err != test.wantErr {
+			t.Errorf("%s: err = %v want %v", test.name, err, test.wantErr)
+		}
+	}
+}
+
+func TestGetLatestPreviousName(t *testing.T) {
+	f := seedDB(t)
+	uid := f.users[0].Id
+
+	latest, err := GetLatestPreviousName(db, uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest != nil {
+		t.Errorf("GetLatestPreviousName() = %v want nil", latest)
+	}
+
+	// 较晚的记录使用了更大偏移的时区，按字符串比较会排在前面
+	now := time.Now().UTC()
+	stmt := `INSERT INTO user_previous_names(uid, screen_name, name, record_date) VALUES(?, ?, ?, ?)`
+	if _, err := db.Exec(stmt, uid, "older", "older", now.Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(stmt, uid, "newer", "newer", now.In(time.FixedZone("", -8*3600))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(stmt, f.users[1].Id, "other", "other", now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	latest, err = GetLatestPreviousName(db, uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest == nil || latest.ScreenName != "newer" {
+		t.Errorf("GetLatestPreviousName() = %v want newer", latest)
+	}
+}
+
+func TestPrunePreviousNames(t *testing.T) {
+	f := seedDB(t)
+
+	now := time.Now()
+	stmt := `INSERT INTO user_previous_names(uid, screen_name, name, record_date) VALUES(?, ?, ?, ?)`
+	for i := 0; i < 5; i++ {
+		name := fmt.Sprintf("name%d", i)
+		if _, err := db.Exec(stmt, f.users[0].Id, name, name, now.Add(time.Duration(i)*time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := RecordUserPreviousName(db, f.users[1].Id, "only", "only"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := PrunePreviousNames(db, -1); err == nil {
+		t.Error("PrunePreviousNames(-1) succeeded")
+	}
+	n, err := PrunePreviousNames(db, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("PrunePreviousNames() = %d want 3", n)
+	}
+
+	names := []string{}
+	if err := db.Select(&names, `SELECT name FROM user_previous_names WHERE uid=? ORDER BY name`, f.users[0].Id); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(names, []string{"name3", "name4"}) {
+		t.Errorf("names left = %v want [name3 name4]", names)
+	}
+	latest, err := GetLatestPreviousName(db, f.users[1].Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest == nil {
+		t.Error("record of other user was pruned")
+	}
+}
+
+func TestFriendsCountHistory(t *testing.T) {
+	db = opentmpdb()
+	defer db.Close()
+
+	usr := generateUser(1)
+	usr.FriendsCount = 10
+	if err := CreateUser(db, usr); err != nil {
+		t.Fatal(err)
+	}
+
+	// 关注数未变化时不追加记录
+	usr.Name = "renamed"
+	if err := UpdateUser(db, usr); err != nil {
+		t.Fatal(err)
+	}
+	usr.FriendsCount = 20
+	if err := UpdateUser(db, usr); err != nil {
+		t.Fatal(err)
+	}
+	// 同一天内相同的值只记录一次
+	if err := RecordFriendsCount(db, usr.Id, 20); err != nil {
+		t.Fatal(err)
+	}
+	usr.FriendsCount = 10
+	if err := UpdateUser(db, usr); err != nil {
+		t.Fatal(err)
+	}
+
+	history, err := GetFriendsCountHistory(db, usr.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []int{10, 20}
+	if len(history) != len(want) {
+		t.Fatalf("len(history) = %d want %d", len(history), len(want))
+	}
+	today := time.Now().Format("2006-01-02")
+	for i, record := range history {
+		if record.Uid != usr.Id || record.FriendsCount != want[i] {
+			t.Errorf("history[%d] = %+v want friends_count %d", i, record, want[i])
+		}
+		if record.RecordDate.Format("2006-01-02") != today {
+			t.Errorf("history[%d].RecordDate = %v want %s", i, record.RecordDate, today)
+		}
+	}
+
+	other, err := GetFriendsCountHistory(db, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(other) != 0 {
+		t.Errorf("len(other) = %d want 0", len(other))
+	}
+}
+
+func TestUserEntitiesIndexes(t *testing.T) {
+	db = opentmpdb()
+	defer db.Close()
+
+	tests := []struct {
+		query string
+		index string
+	}{
+		{`SELECT * FROM user_entities WHERE latest_release_time < '2024-01-01'`, "idx_user_entities_latest_release"},
+		{`SELECT * FROM user_entities ORDER BY latest_release_time`, "idx_user_entities_latest_release"},
+		{`SELECT * FROM user_entities WHERE user_id=1`, "idx_user_entities_user_id"},
+	}
+	for _, test := range tests {
+		rows, err := db.Queryx(`EXPLAIN QUERY PLAN ` + test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plan := []string{}
+		for rows.Next() {
+			var id, parent, notused int
+			var detail string
+			if err := rows.Scan(&id, &parent, &notused, &detail); err != nil {
+				t.Fatal(err)
+			}
+			plan = append(plan, detail)
+		}
+		rows.Close()
+
+		if !strings.Contains(strings.Join(plan, "\n"), test.index) {
+			t.Errorf("%s: plan %q does not use %s", test.query, plan, test.index)
+		}
+	}
+}
+
+func TestTypedErrors(t *testing.T) {
+	db = opentmpdb()
+	defer db.Close()
+
+	usr := generateUser(1)
+	if err := CreateUser(db, usr); err != nil {
+		t.Fatal(err)
+	}
+
+	dup := generateUser(2)
+	dup.ScreenName = usr.ScreenName
+	err := CreateUser(db, dup)
+	if !errors.Is(err, ErrDuplicateScreenName) {
+		t.Errorf("CreateUser() with duplicate screen name = %v want ErrDuplicateScreenName", err)
+	}
+	var sqliteErr sqlite3.Error
+	if !errors.As(err, &sqliteErr) {
+		t.Errorf("driver error is not reachable from %v", err)
+	}
+
+	dup.ScreenName = "other"
+	if err := CreateUser(db, dup); err != nil {
+		t.Fatal(err)
+	}
+	dup.ScreenName = usr.ScreenName
+	if err := UpdateUser(db, dup); !errors.Is(err, ErrDuplicateScreenName) {
+		t.Errorf("UpdateUser() with duplicate screen name = %v want ErrDuplicateScreenName", err)
+	}
+
+	entity := &UserEntity{Uid: usr.Id, Name: usr.Name, ParentDir: os.TempDir()}
+	if err := CreateUserEntity(db, entity); err != nil {
+		t.Fatal(err)
+	}
+	entity = &UserEntity{Uid: usr.Id, Name: usr.Name, ParentDir: os.TempDir()}
+	if err := CreateUserEntity(db, entity); !errors.Is(err, ErrDuplicatePath) {
+		t.Errorf("CreateUserEntity() at existing path = %v want ErrDuplicatePath", err)
+	}
+
+	lst := generateList(1)
+	if err := CreateLst(db, lst); err != nil {
+		t.Fatal(err)
+	}
+	if err := CreateLst(db, lst); !errors.Is(err, ErrConstraint) {
+		t.Errorf("CreateLst() with existing id = %v want ErrConstraint", err)
+	}
+
+	// 默认不存在时返回 nil, nil
+	if got, err := GetUserById(db, 12345); got != nil || err != nil {
+		t.Errorf("GetUserById() = %v, %v want nil, nil", got, err)
+	}
+
+	strict, err := OpenDB(":memory:", WithNotFoundError())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer strict.Close()
+	if _, err := GetUserById(strict, 12345); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetUserById() = %v want ErrNotFound", err)
+	}
+	if _, err := GetUserEntity(strict, 12345); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetUserEntity() = %v want ErrNotFound", err)
+	}
+}
+
+func TestPreviewRelocation(t *testing.T) {
+	db = opentmpdb()
+	defer db.Close()
+
+	oldDir, err := os.MkdirTemp("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(oldDir)
+	newDir, err := os.MkdirTemp("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(newDir)
+
+	entity := generateUserEntity(1, oldDir)
+	if err := CreateUserEntity(db, entity); err != nil {
+		t.Fatal(err)
+	}
+
+	// 未找到可匹配的实体
+	rel, err := PreviewRelocation(db, entity.Uid, newDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rel != nil {
+		t.Errorf("PreviewRelocation() = %+v want nil", rel)
+	}
+
+	rel, err = PreviewRelocation(db, entity.Uid, oldDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rel == nil || rel.Matched != MatchedExactPath || rel.OldDir != oldDir || rel.NewDir != oldDir {
+		t.Errorf("PreviewRelocation() = %+v want exact path match", rel)
+	}
+
+	if err := writeEntityUserFile(oldDir, entity.Name, entity.Uid); err != nil {
+		t.Fatal(err)
+	}
+	rel, err = PreviewRelocation(db, entity.Uid, newDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rel == nil || rel.Matched != MatchedUserFileInOldDir || rel.OldDir != oldDir || rel.NewDir != newDir {
+		t.Errorf("PreviewRelocation() = %+v want move from old dir", rel)
+	}
+
+	if err := writeEntityUserFile(newDir, entity.Name, entity.Uid); err != nil {
+		t.Fatal(err)
+	}
+	rel, err = PreviewRelocation(db, entity.Uid, newDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rel == nil || rel.Matched != MatchedUserFileInNewDir || rel.OldDir != oldDir || rel.NewDir != newDir {
+		t.Errorf("PreviewRelocation() = %+v want move to new dir", rel)
+	}
+
+	// 预览不修改数据库
+	if yes, err := hasSameUserEntityRecord(entity); err != nil || !yes {
+		t.Errorf("entity was changed by preview, err: %v", err)
+	}
+
+	located, err := LocateUserEntity(db, entity.Uid, newDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entity.ParentDir = newDir
+	if located == nil || withoutTimestamps(located) != withoutTimestamps(entity) {
+		t.Errorf("LocateUserEntity() = %v want %v", located, entity)
+	}
+	if yes, err := hasSameUserEntityRecord(entity); err != nil || !yes {
+		t.Errorf("entity was not relocated, err: %v", err)
+	}
+}
+
+func TestGetLstByName(t *testing.T) {
+	db = opentmpdb()
+	defer db.Close()
+
+	lsts := []*Lst{
+		{Id: 1, Name: "art", OwnerId: 100},
+		{Id: 2, Name: "art", OwnerId: 200},
+		{Id: 3, Name: "photo", OwnerId: 100},
+	}
+	for _, lst := range lsts {
+		if err := CreateLst(db, lst); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		owner uint64
+		name  string
+		want  *Lst
+	}{
+		{100, "art", lsts[0]},
+		{200, "art", lsts[1]},
+		{200, "photo", nil},
+		{300, "art", nil},
+	}
+	for _, test := range tests {
+		got, err := GetLstByName(db, test.owner, test.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (got == nil) != (test.want == nil) || (got != nil && withoutTimestamps(got) != withoutTimestamps(test.want)) {
+			t.Errorf("GetLstByName(%d, %q) = %v want %v", test.owner, test.name, got, test.want)
+		}
+	}
+
+	owned, err := GetLstsByOwner(db, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(owned) != 2 || withoutTimestamps(owned[0]) != withoutTimestamps(lsts[0]) || withoutTimestamps(owned[1]) != withoutTimestamps(lsts[2]) {
+		t.Errorf("GetLstsByOwner(100) = %v want [%v %v]", owned, lsts[0], lsts[2])
+	}
+}
+
+func TestDownloadErrors(t *testing.T) {
+	db = opentmpdb()
+	defer db.Close()
+
+	entity := generateUserEntity(1, os.TempDir())
+	if err := CreateUserEntity(db, entity); err != nil {
+		t.Fatal(err)
+	}
+	eid := int(entity.Id.Int32)
+
+	for i := 1; i <= 3; i++ {
+		url := fmt.Sprintf("https://example.com/%d.jpg", i)
+		if err := RecordDownloadError(db, eid, uint64(i), url, fmt.Errorf("error %d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := RecordDownloadError(db, eid, 4, "https://example.com/4.jpg", nil); err == nil {
+		t.Error("recorded a nil download error")
+	}
+
+	errs, err := GetRecentDownloadErrors(db, eid, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(errs) != 2 {
+		t.Fatalf("len(errs) = %d want 2", len(errs))
+	}
+	for i, want := range []uint64{3, 2} {
+		got := errs[i]
+		if got.EntityId != eid || got.TweetId != want || got.Error != fmt.Sprintf("error %d", want) ||
+			got.Url != fmt.Sprintf("https://example.com/%d.jpg", want) {
+			t.Errorf("errs[%d] = %+v want tweet %d", i, got, want)
+		}
+	}
+
+	all, err := GetRecentDownloadErrors(db, eid, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 3 {
+		t.Errorf("len(all) = %d want 3", len(all))
+	}
+	other, err := GetRecentDownloadErrors(db, eid+1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(other) != 0 {
+		t.Errorf("len(other) = %d want 0", len(other))
+	}
+}
+
+func TestResetUserEntityProgress(t *testing.T) {
+	db = opentmpdb()
+	defer db.Close()
+
+	entity := generateUserEntity(1, os.TempDir())
+	if err := CreateUserEntity(db, entity); err != nil {
+		t.Fatal(err)
+	}
+	eid := int(entity.Id.Int32)
+	if _, err := UpdateUserEntityTweetStat(db, eid, time.Now(), 10); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ResetUserEntityProgress(db, eid); err != nil {
+		t.Fatal(err)
+	}
+	entity.LatestReleaseTime = sql.NullTime{}
+	entity.MediaCount = 0
+	entity.PhotoCount, entity.VideoCount, entity.GifCount = 0, 0, 0
+	if yes, err := hasSameUserEntityRecord(entity); err != nil || !yes {
+		t.Errorf("entity progress was not reset, err: %v", err)
+	}
+}
+
+// 所有字段都应被读回非零值，db 标签与列名不一致时会留下零值，
+// 表中多出的列则会让 sqlx 报告 missing destination
+func assertAllFieldsSet(t *testing.T, name string, v any) {
+	t.Helper()
+	rv := reflect.ValueOf(v).Elem()
+	for i := 0; i < rv.NumField(); i++ {
+		field := rv.Type().Field(i)
+		if field.Tag.Get("db") == "" {
+			t.Errorf("%s.%s has no db tag", name, field.Name)
+		}
+		if rv.Field(i).IsZero() {
+			t.Errorf("%s.%s was not populated", name, field.Name)
+		}
+	}
+}
+
+func TestStructTagsRoundTrip(t *testing.T) {
+	db = opentmpdb()
+	defer db.Close()
+
+	usr := &User{Id: 1, ScreenName: "user1", Name: "name1", IsProtected: true, FriendsCount: 10}
+	if err := CreateUser(db, usr); err != nil {
+		t.Fatal(err)
+	}
+	gotUser, err := GetUserById(db, usr.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertAllFieldsSet(t, "User", gotUser)
+
+	ue := &UserEntity{Uid: usr.Id, Name: usr.Name, ParentDir: os.TempDir()}
+	if err := CreateUserEntity(db, ue); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := UpdateUserEntityTweetStat(db, int(ue.Id.Int32), time.Now(), 5); err != nil {
+		t.Fatal(err)
+	}
+	if err := UpdateUserEntityMediaBreakdown(db, int(ue.Id.Int32), 1, 2, 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := AddUserEntityBytes(db, int(ue.Id.Int32), 1024); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetUserEntityPaused(db, int(ue.Id.Int32), true); err != nil {
+		t.Fatal(err)
+	}
+	if err := UpdateUserEntityContentHash(db, int(ue.Id.Int32), "hash"); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetUserEntityCursor(db, int(ue.Id.Int32), "cursor"); err != nil {
+		t.Fatal(err)
+	}
+	gotUe, err := GetUserEntity(db, int(ue.Id.Int32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertAllFieldsSet(t, "UserEntity", gotUe)
+
+	lst := &Lst{Id: 1, Name: "lst1", OwnerId: usr.Id}
+	if err := CreateLst(db, lst); err != nil {
+		t.Fatal(err)
+	}
+	gotLst, err := GetLst(db, lst.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertAllFieldsSet(t, "Lst", gotLst)
+
+	le := &LstEntity{LstId: int64(lst.Id), Name: lst.Name, ParentDir: os.TempDir()}
+	if err := CreateLstEntity(db, le); err != nil {
+		t.Fatal(err)
+	}
+	if err := UpdateLstEntity(db, le); err != nil {
+		t.Fatal(err)
+	}
+	gotLe, err := GetLstEntity(db, int(le.Id.Int32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertAllFieldsSet(t, "LstEntity", gotLe)
+
+	link := &UserLink{Uid: usr.Id, Name: "link1", ParentLstEntityId: le.Id.Int32}
+	if err := CreateUserLink(db, link); err != nil {
+		t.Fatal(err)
+	}
+	gotLink, err := GetUserLink(db, usr.Id, le.Id.Int32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertAllFieldsSet(t, "UserLink", gotLink)
+}
+
+func TestIncrUserEntityMediaCount(t *testing.T) {
+	f := seedDB(t)
+	id := int(f.userEntities[0].Id.Int32)
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := IncrUserEntityMediaCount(db, id, 2); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	entity, err := GetUserEntity(db, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entity.MediaCount != 20 {
+		t.Errorf("media_count = %v want 20", entity.MediaCount)
+	}
+}
+
+func TestUpdateUserEntityMediaBreakdown(t *testing.T) {
+	db = opentmpdb()
+	defer db.Close()
+
+	entity := generateUserEntity(1, os.TempDir())
+	if err := CreateUserEntity(db, entity); err != nil {
+		t.Fatal(err)
+	}
+	if err := UpdateUserEntityMediaBreakdown(db, int(entity.Id.Int32), 3, 2, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	entity.PhotoCount, entity.VideoCount, entity.GifCount = 3, 2, 1
+	entity.MediaCount = 6
+	if yes, err := hasSameUserEntityRecord(entity); err != nil || !yes {
+		t.Errorf("media breakdown mismatch, err: %v", err)
+	}
+}
+
+func TestFindUserEntity(t *testing.T) {
+	db = opentmpdb()
+	defer db.Close()
+
+	oldDir, err := os.MkdirTemp("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(oldDir)
+	newDir := filepath.Join(oldDir, "new")
+
+	entity := generateUserEntity(1, oldDir)
+	if err := CreateUserEntity(db, entity); err != nil {
+		t.Fatal(err)
+	}
+
+	found, changed, err := FindUserEntity(db, entity.Uid, oldDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found == nil || withoutTimestamps(found) != withoutTimestamps(entity) || changed {
+		t.Errorf("FindUserEntity(old) = %v, %v want %v, false", found, changed, entity)
+	}
+
+	found, _, err = FindUserEntity(db, entity.Uid, newDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found != nil {
+		t.Errorf("FindUserEntity(new) = %v want nil", found)
+	}
+
+	if err := writeEntityUserFile(oldDir, entity.Name, entity.Uid); err != nil {
+		t.Fatal(err)
+	}
+	found, changed, err = FindUserEntity(db, entity.Uid, newDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found == nil || withoutTimestamps(found) != withoutTimestamps(entity) || !changed {
+		t.Errorf("FindUserEntity(new) = %v, %v want %v, true", found, changed, entity)
+	}
+	if yes, err := hasSameUserEntityRecord(entity); err != nil || !yes {
+		t.Errorf("entity was changed by FindUserEntity, err: %v", err)
+	}
+}
+
+func TestCreatedAt(t *testing.T) {
+	db = opentmpdb()
+	defer db.Close()
+
+	before := time.Now().Add(-time.Second)
+	link := generateLink(1, 1)
+	if err := CreateUserLink(db, link); err != nil {
+		t.Fatal(err)
+	}
+	entity := generateUserEntity(2, os.TempDir())
+	if err := CreateUserEntity(db, entity); err != nil {
+		t.Fatal(err)
+	}
+	after := time.Now().Add(time.Second)
+
+	usr, _ := GetUserById(db, 1)
+	lst, _ := GetLst(db, 1)
+	le, _ := GetLstEntity(db, int(link.ParentLstEntityId))
+	ue, _ := GetUserEntity(db, int(entity.Id.Int32))
+	ul, _ := GetUserLink(db, link.Uid, link.ParentLstEntityId)
+	records := map[string]sql.NullTime{
+		"users":         usr.CreatedAt,
+		"lsts":          lst.CreatedAt,
+		"lst_entities":  le.CreatedAt,
+		"user_entities": ue.CreatedAt,
+		"user_links":    ul.CreatedAt,
+	}
+	for table, createdAt := range records {
+		// CURRENT_TIMESTAMP 精确到秒
+		if !createdAt.Valid || createdAt.Time.Before(before.Truncate(time.Second)) || createdAt.Time.After(after) {
+			t.Errorf("%s.created_at = %v want between %v and %v", table, createdAt, before, after)
+		}
+	}
+}
+
+func TestUpdatedAt(t *testing.T) {
+	f := seedDB(t)
+	entity, err := GetUserEntity(db, int(f.userEntities[0].Id.Int32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	newLe, err := GetLstEntity(db, int(f.lstEntity.Id.Int32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 创建时即设置
+	if !entity.UpdatedAt.Valid || !newLe.UpdatedAt.Valid {
+		t.Errorf("updated_at of new entities = %v, %v want creation time", entity.UpdatedAt, newLe.UpdatedAt)
+	}
+
+	before := time.Now().UTC()
+	if err := SetUserEntityLatestReleaseTime(db, int(entity.Id.Int32), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := UpdateLstEntity(db, f.lstEntity); err != nil {
+		t.Fatal(err)
+	}
+	after := time.Now().UTC()
+
+	entity, err = GetUserEntity(db, int(entity.Id.Int32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	le, err := GetLstEntity(db, int(f.lstEntity.Id.Int32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, updatedAt := range map[string]sql.NullTime{"user entity": entity.UpdatedAt, "lst entity": le.UpdatedAt} {
+		// CURRENT_TIMESTAMP 精确到秒
+		if !updatedAt.Valid || updatedAt.Time.Before(before.Truncate(time.Second)) || updatedAt.Time.After(after) {
+			t.Errorf("%s updated_at = %v want between %v and %v", name, updatedAt, before, after)
+		}
+	}
+}
+
+func TestGetUserLinksByName(t *testing.T) {
+	f := seedDB(t)
+
+	// 另一个列表实体下的同名链接
+	other := &LstEntity{LstId: 2, Name: "lst2", ParentDir: filepath.Join(f.root, "lists")}
+	if err := CreateLstEntity(db, other); err != nil {
+		t.Fatal(err)
+	}
+	dup := &UserLink{Uid: f.users[0].Id, Name: f.links[0].Name, ParentLstEntityId: other.Id.Int32}
+	if err := CreateUserLink(db, dup); err != nil {
+		t.Fatal(err)
+	}
+
+	links, err := GetUserLinksByName(db, f.links[0].Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(links) != 2 || links[0].Id != f.links[0].Id || links[1].Id != dup.Id {
+		t.Errorf("GetUserLinksByName() = %v want [%v %v]", links, f.links[0], dup)
+	}
+
+	link, err := GetUserLinkByName(db, other.Id.Int32, dup.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link == nil || withoutTimestamps(link) != withoutTimestamps(dup) {
+		t.Errorf("GetUserLinkByName() = %v want %v", link, dup)
+	}
+
+	link, err = GetUserLinkByName(db, other.Id.Int32, f.links[1].Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link != nil {
+		t.Errorf("GetUserLinkByName() = %v want nil", link)
+	}
+}
+
+func TestUserSnapshot(t *testing.T) {
+	f := seedDB(t)
+
+	usr := f.users[0]
+	if err := RecordUserPreviousName(db, usr.Id, "old name", "old_screen_name"); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := WriteUserSnapshot(db, usr.Id, buf); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := &snapshotDoc{}
+	if err := json.Unmarshal(buf.Bytes(), snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.User == nil || snapshot.User.Id != usr.Id || snapshot.User.ScreenName != usr.ScreenName {
+		t.Errorf("snapshot.User = %v want %v", snapshot.User, usr)
+	}
+	if len(snapshot.Entities) != 1 || snapshot.Entities[0].Id != f.userEntities[0].Id.Int32 {
+		t.Errorf("snapshot.Entities = %v want [%v]", snapshot.Entities, f.userEntities[0])
+	}
+	if len(snapshot.PreviousNames) != 1 || snapshot.PreviousNames[0].ScreenName != "old_screen_name" {
+		t.Errorf("snapshot.PreviousNames = %v", snapshot.PreviousNames)
+	}
+	if len(snapshot.Links) != 1 || snapshot.Links[0].Id != f.links[0].Id.Int32 {
+		t.Errorf("snapshot.Links = %v want [%v]", snapshot.Links, f.links[0])
+	}
+	// 可为空的列不应以 {"Int32":...,"Valid":...} 的形式输出
+	if bytes.Contains(buf.Bytes(), []byte(`"Valid"`)) {
+		t.Errorf("snapshot contains sql.Null* fields:\n%s", buf.String())
+	}
+
+	// 不存在的用户不是错误
+	missing, err := GetUserSnapshot(db, 12345)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if missing.User != nil || len(missing.Entities) != 0 || len(missing.Links) != 0 {
+		t.Errorf("GetUserSnapshot(12345) = %+v want empty snapshot", missing)
+	}
+}
+
+func TestNormalizePath(t *testing.T) {
+	db = opentmpdb()
+	defer db.Close()
+
+	dir := filepath.Join(os.TempDir(), "dl")
+	entity := generateUserEntity(1, dir+string(filepath.Separator))
+	if err := CreateUserEntity(db, entity); err != nil {
+		t.Fatal(err)
+	}
+	if entity.ParentDir != dir {
+		t.Errorf("stored parent_dir = %q want %q", entity.ParentDir, dir)
+	}
+
+	variants := []string{
+		dir + string(filepath.Separator) + string(filepath.Separator),
+		filepath.Join(dir, ".") + string(filepath.Separator) + ".",
+		filepath.Join(dir, "sub", ".."),
+		strings.ToUpper(dir),
+	}
+	for _, variant := range variants {
+		dup := &UserEntity{Uid: entity.Uid, Name: entity.Name, ParentDir: variant}
+		if err := CreateUserEntity(db, dup); !errors.Is(err, ErrDuplicatePath) {
+			t.Errorf("CreateUserEntity(%q) = %v want ErrDuplicatePath", variant, err)
+		}
+
+		found, changed, err := FindUserEntity(db, entity.Uid, variant)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found == nil || found.Id != entity.Id || changed {
+			t.Errorf("FindUserEntity(%q) = %v, %v want %v, false", variant, found, changed, entity)
+		}
+	}
+
+	if runtime.GOOS == "windows" {
+		lower, err := normalizePath(`c:\dl\`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lower != `C:\dl` {
+			t.Errorf(`normalizePath("c:\dl\") = %q want "C:\dl"`, lower)
+		}
+	}
+}
+
+func TestStrictPaths(t *testing.T) {
+	oldDir, err := os.MkdirTemp("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(oldDir)
+	newDir, err := os.MkdirTemp("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(newDir)
+
+	db, err = OpenDB(":memory:", WithStrictPaths())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	entity := generateUserEntity(1, oldDir)
+	if err := CreateUserEntity(db, entity); err != nil {
+		t.Fatal(err)
+	}
+	// 两个目录下都有该用户的 .user 文件，宽松模式下会迁移记录
+	if err := writeEntityUserFile(oldDir, entity.Name, entity.Uid); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeEntityUserFile(newDir, entity.Name, entity.Uid); err != nil {
+		t.Fatal(err)
+	}
+
+	located, err := LocateUserEntity(db, entity.Uid, newDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if located != nil {
+		t.Errorf("LocateUserEntity(new) = %v want nil", located)
+	}
+	located, err = LocateUserEntity(db, entity.Uid, oldDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if located == nil || located.Id != entity.Id {
+		t.Errorf("LocateUserEntity(old) = %v want %v", located, entity)
+	}
+
+	created, err := CreateOrUpdateUserEntityWithPathChange(db, &UserEntity{Uid: entity.Uid, Name: entity.Name, ParentDir: newDir}, newDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.Id == entity.Id || created.ParentDir != newDir {
+		t.Errorf("CreateOrUpdateUserEntityWithPathChange() = %v want a new entity under %s", created, newDir)
+	}
+	if yes, err := hasSameUserEntityRecord(entity); err != nil || !yes {
+		t.Errorf("existing entity was relocated in strict mode, err: %v", err)
+	}
+
+	// 同一路径复用已有实体
+	again, err := CreateOrUpdateUserEntityWithPathChange(db, &UserEntity{Uid: entity.Uid, Name: "renamed", ParentDir: newDir}, newDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Id != created.Id || again.Name != "renamed" {
+		t.Errorf("CreateOrUpdateUserEntityWithPathChange() = %v want entity %d renamed", again, created.Id.Int32)
+	}
+}
+
+func TestGetLstEntitiesByList(t *testing.T) {
+	f := seedDB(t)
+
+	// 同一列表被下载到另一个目录
+	other := &LstEntity{LstId: f.lstEntity.LstId, Name: "another", ParentDir: f.root}
+	if err := CreateLstEntity(db, other); err != nil {
+		t.Fatal(err)
+	}
+	unrelated := &LstEntity{LstId: 2, Name: "lst2", ParentDir: f.root}
+	if err := CreateLstEntity(db, unrelated); err != nil {
+		t.Fatal(err)
+	}
+
+	entities, err := GetLstEntitiesByList(db, f.lst.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entities) != 2 || entities[0].Id != other.Id || entities[1].Id != f.lstEntity.Id {
+		t.Errorf("GetLstEntitiesByList() = %v want [%v %v]", entities, other, f.lstEntity)
+	}
+
+	entities, err = GetLstEntitiesByList(db, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entities) != 0 {
+		t.Errorf("GetLstEntitiesByList(3) = %v want []", entities)
+	}
+}
+
+func TestGetDatabaseStats(t *testing.T) {
+	f := seedDB(t)
+	if err := RecordUserPreviousName(db, f.users[0].Id, "old", "old"); err != nil {
+		t.Fatal(err)
+	}
+	if err := UpdateUserEntityMediaBreakdown(db, int(f.userEntities[0].Id.Int32), 1, 2, 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := AddUserEntityBytes(db, int(f.userEntities[1].Id.Int32), 1024); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := GetDatabaseStats(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := DBStats{Users: 3, Lsts: 1, LstEntities: 1, UserEntities: 2, UserLinks: 2, PreviousNames: 1,
+		MediaCount: 6, TotalBytes: 1024}
+	if *stats != want {
+		t.Errorf("GetDatabaseStats() = %+v want %+v", *stats, want)
+	}
+}
+
+func TestCountUserLinks(t *testing.T) {
+	f := seedDB(t)
+
+	empty := &LstEntity{LstId: f.lstEntity.LstId, Name: "empty", ParentDir: f.root}
+	if err := CreateLstEntity(db, empty); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := CountUserLinksByLstEntity(db, f.lstEntity.Id.Int32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(f.links) {
+		t.Errorf("CountUserLinksByLstEntity() = %d want %d", n, len(f.links))
+	}
+
+	counts, err := CountUserLinksByLst(db, f.lst.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[int32]int{f.lstEntity.Id.Int32: len(f.links), empty.Id.Int32: 0}
+	if fmt.Sprint(counts) != fmt.Sprint(want) {
+		t.Errorf("CountUserLinksByLst() = %v want %v", counts, want)
+	}
+}
+
+func TestWithTx(t *testing.T) {
+	db = opentmpdb()
+	defer db.Close()
+
+	le := generateLstEntity(1, os.TempDir())
+	if err := CreateLstEntity(db, le); err != nil {
+		t.Fatal(err)
+	}
+
+	create := func(tx *Tx, uid int) (*User, *UserEntity, *UserLink, error) {
+		usr := generateUser(uid)
+		if err := CreateUserTx(tx, usr); err != nil {
+			return nil, nil, nil, err
+		}
+		entity := &UserEntity{Uid: usr.Id, Name: usr.Name, ParentDir: os.TempDir()}
+		if err := CreateUserEntityTx(tx, entity); err != nil {
+			return nil, nil, nil, err
+		}
+		link := &UserLink{Uid: usr.Id, Name: usr.Name, ParentLstEntityId: le.Id.Int32}
+		if err := CreateUserLinkTx(tx, link); err != nil {
+			return nil, nil, nil, err
+		}
+		return usr, entity, link, nil
+	}
+
+	var usr *User
+	var entity *UserEntity
+	var link *UserLink
+	err := WithTx(db, func(tx *Tx) error {
+		var err error
+		usr, entity, link, err = create(tx, 1)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if yes, err := hasSameUserRecord(usr); err != nil || !yes {
+		t.Errorf("user was not committed, err: %v", err)
+	}
+	if yes, err := hasSameUserEntityRecord(entity); err != nil || !yes {
+		t.Errorf("user entity was not committed, err: %v", err)
+	}
+	if yes, err := hasSameUserLinkRecord(link); err != nil || !yes {
+		t.Errorf("user link was not committed, err: %v", err)
+	}
+
+	// 出错时回滚事务中的所有写入
+	errAbort := errors.New("abort")
+	err = WithTx(db, func(tx *Tx) error {
+		if _, _, _, err := create(tx, 2); err != nil {
+			return err
+		}
+		return errAbort
+	})
+	if err != errAbort {
+		t.Errorf("WithTx() = %v want %v", err, errAbort)
+	}
+	if got, err := GetUserById(db, 2); err != nil || got != nil {
+		t.Errorf("user 2 = %v, err: %v want rolled back", got, err)
+	}
+	if links, err := GetUserLinks(db, 2); err != nil || len(links) != 0 {
+		t.Errorf("links of user 2 = %v, err: %v want rolled back", links, err)
+	}
+
+	// db.Beginx 开启的事务不知道数据库的选项
+	raw, err := db.Beginx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CreateUserEntityTx(raw, &UserEntity{Uid: usr.Id, Name: "raw", ParentDir: t.TempDir()}); err == nil {
+		t.Error("created user entity in a transaction without database options")
+	}
+	raw.Rollback()
+
+	// Begin 开启的事务沿用数据库的选项
+	root := t.TempDir()
+	rdb, err := OpenDB(":memory:", WithLibraryRoot(root))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rdb.Close()
+	tx, err := Begin(rdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if err := CreateUserTx(tx, generateUser(3)); err != nil {
+		t.Fatal(err)
+	}
+	rooted := &UserEntity{Uid: 3, Name: "user3", ParentDir: filepath.Join(root, "users")}
+	if err := CreateUserEntityTx(tx, rooted); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	var stored string
+	if err := rdb.Get(&stored, `SELECT parent_dir FROM user_entities WHERE id=?`, rooted.Id); err != nil {
+		t.Fatal(err)
+	}
+	if filepath.IsAbs(stored) {
+		t.Errorf("parent_dir stored as %s want a path relative to the library root", stored)
+	}
+}
+
+func TestGetUserEntityWithUser(t *testing.T) {
+	f := seedDB(t)
+
+	entity := f.userEntities[0]
+	got, err := GetUserEntityWithUser(db, int(entity.Id.Int32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got == nil || withoutTimestamps(&got.UserEntity) != withoutTimestamps(entity) ||
+		got.ScreenName != f.users[0].ScreenName || got.UserName != f.users[0].Name {
+		t.Errorf("GetUserEntityWithUser() = %+v want %v of %v", got, entity, f.users[0])
+	}
+
+	// 用户记录缺失时仍返回实体
+	if _, err := db.Exec(`PRAGMA foreign_keys=OFF`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`DELETE FROM users WHERE id=?`, f.users[1].Id); err != nil {
+		t.Fatal(err)
+	}
+	orphan := f.userEntities[1]
+	got, err = GetUserEntityWithUser(db, int(orphan.Id.Int32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got == nil || got.Id != orphan.Id || got.ScreenName != "" || got.UserName != "" {
+		t.Errorf("GetUserEntityWithUser() = %+v want %v without user", got, orphan)
+	}
+
+	got, err = GetUserEntityWithUser(db, 12345)
+	if err != nil || got != nil {
+		t.Errorf("GetUserEntityWithUser(12345) = %v, %v want nil, nil", got, err)
+	}
+}
+
+func TestGetUserEntitiesNeedingNameUpdate(t *testing.T) {
+	f := seedDB(t)
+	renamed := f.users[1]
+	renamed.Name = "renamed"
+	if err := UpdateUser(db, renamed); err != nil {
+		t.Fatal(err)
+	}
+
+	entities, err := GetUserEntitiesNeedingNameUpdate(db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entities) != 1 || entities[0].Id != f.userEntities[1].Id || entities[0].UserName != "renamed" {
+		t.Errorf("GetUserEntitiesNeedingNameUpdate(nil) = %v want entity %d", entities, f.userEntities[1].Id.Int32)
+	}
+
+	bare := func(_, name string) string { return name }
+	entities, err = GetUserEntitiesNeedingNameUpdate(db, bare)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entities) != 2 {
+		t.Errorf("GetUserEntitiesNeedingNameUpdate(bare) returned %d entities want 2", len(entities))
+	}
+}
+
+func TestUserEntityBytes(t *testing.T) {
+	f := seedDB(t)
+
+	first, second := f.userEntities[0], f.userEntities[1]
+	for _, delta := range []int64{100, 200} {
+		if err := AddUserEntityBytes(db, int(first.Id.Int32), delta); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := AddUserEntityBytes(db, int(second.Id.Int32), 50); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := GetUserEntity(db, int(first.Id.Int32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.TotalBytes != 300 {
+		t.Errorf("TotalBytes = %d want 300", got.TotalBytes)
+	}
+	total, err := SumTotalBytes(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 350 {
+		t.Errorf("SumTotalBytes() = %d want 350", total)
+	}
+
+	if err := ResetUserEntityProgress(db, int(first.Id.Int32)); err != nil {
+		t.Fatal(err)
+	}
+	if total, err = SumTotalBytes(db); err != nil {
+		t.Fatal(err)
+	}
+	if total != 50 {
+		t.Errorf("SumTotalBytes() after reset = %d want 50", total)
+	}
+}
+
+func TestRenameLst(t *testing.T) {
+	f := seedDB(t)
+	manual := &LstEntity{LstId: int64(f.lst.Id), Name: "my list", ParentDir: filepath.Join(f.root, "manual")}
+	if err := CreateLstEntity(db, manual); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := RenameLst(db, f.lst.Id, "first", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("RenameLst(false) = %d want 0", n)
+	}
+	f.lst.Name = "first"
+	if same, err := isSameLstRecord(f.lst); err != nil || !same {
+		t.Errorf("lst mismatch after rename, err: %v", err)
+	}
+	if same, err := hasSameLstEntityRecord(f.lstEntity); err != nil || !same {
+		t.Errorf("lst entity renamed with renameEntities=false, err: %v", err)
+	}
+
+	// 实体名称仍为 lst1，不等于当前的列表名 first，不应被修改
+	n, err = RenameLst(db, f.lst.Id, "second", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("RenameLst(true) = %d want 0", n)
+	}
+
+	if _, err := RenameLst(db, f.lst.Id, f.lstEntity.Name, false); err != nil {
+		t.Fatal(err)
+	}
+	n, err = RenameLst(db, f.lst.Id, "third", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("RenameLst(true) = %d want 1", n)
+	}
+	f.lstEntity.Name = "third"
+	if same, err := hasSameLstEntityRecord(f.lstEntity); err != nil || !same {
+		t.Errorf("lst entity mismatch after rename, err: %v", err)
+	}
+	if same, err := hasSameLstEntityRecord(manual); err != nil || !same {
+		t.Errorf("manually renamed lst entity changed, err: %v", err)
+	}
+
+	if _, err := RenameLst(db, 404, "missing", true); !errors.Is(err, ErrNotFound) {
+		t.Errorf("RenameLst() on missing lst: %v want ErrNotFound", err)
+	}
+}
+
+func TestReassignUserEntity(t *testing.T) {
+	f := seedDB(t)
+	entity := f.userEntities[0]
+
+	// users[1] 在同一目录已有实体
+	if err := ReassignUserEntity(db, int(entity.Id.Int32), f.users[1].Id); !errors.Is(err, ErrDuplicatePath) {
+		t.Errorf("ReassignUserEntity() onto existing entity: %v want ErrDuplicatePath", err)
+	}
+	if err := ReassignUserEntity(db, int(entity.Id.Int32), 404); !errors.Is(err, ErrNotFound) {
+		t.Errorf("ReassignUserEntity() to missing user: %v want ErrNotFound", err)
+	}
+	if err := ReassignUserEntity(db, 404, f.users[2].Id); !errors.Is(err, ErrNotFound) {
+		t.Errorf("ReassignUserEntity() of missing entity: %v want ErrNotFound", err)
+	}
+	if same, err := hasSameUserEntityRecord(entity); err != nil || !same {
+		t.Errorf("user entity changed by failed reassignment, err: %v", err)
+	}
+
+	if err := ReassignUserEntity(db, int(entity.Id.Int32), f.users[2].Id); err != nil {
+		t.Fatal(err)
+	}
+	entity.Uid = f.users[2].Id
+	if same, err := hasSameUserEntityRecord(entity); err != nil || !same {
+		t.Errorf("user entity mismatch after reassignment, err: %v", err)
+	}
+}
+
+func TestUpdateLstEntityPath(t *testing.T) {
+	f := seedDB(t)
+
+	other := &LstEntity{LstId: f.lstEntity.LstId, Name: f.lstEntity.Name, ParentDir: f.root}
+	if err := CreateLstEntity(db, other); err != nil {
+		t.Fatal(err)
+	}
+
+	// 与同一列表的其他实体冲突
+	err := UpdateLstEntityPath(db, f.lstEntity.Id.Int32, f.root+string(filepath.Separator))
+	if !errors.Is(err, ErrDuplicatePath) {
+		t.Errorf("UpdateLstEntityPath() = %v want ErrDuplicatePath", err)
+	}
+	if yes, err := hasSameLstEntityRecord(f.lstEntity); err != nil || !yes {
+		t.Errorf("lst entity was changed after collision, err: %v", err)
+	}
+
+	newPath := filepath.Join(f.root, "moved")
+	if err := UpdateLstEntityPath(db, f.lstEntity.Id.Int32, newPath+string(filepath.Separator)); err != nil {
+		t.Fatal(err)
+	}
+	f.lstEntity.ParentDir = newPath
+	if yes, err := hasSameLstEntityRecord(f.lstEntity); err != nil || !yes {
+		t.Errorf("lst entity was not moved, err: %v", err)
+	}
+
+	if err := UpdateLstEntityPath(db, 12345, newPath); !errors.Is(err, ErrNotFound) {
+		t.Errorf("UpdateLstEntityPath(12345) = %v want ErrNotFound", err)
+	}
+	if err := UpdateLstEntityPath(db, f.lstEntity.Id.Int32, ""); err == nil {
+		t.Error("UpdateLstEntityPath() with empty path succeeded")
+	}
+}
+
+func TestLibraryRoot(t *testing.T) {
+	tmp := t.TempDir()
+	path := filepath.Join(tmp, "lib.db")
+	root := filepath.Join(tmp, "library")
+	outside := filepath.Join(tmp, "outside")
+
+	// 未设置库根目录时写入的绝对路径，以该选项打开时应被转换
+	plain, err := OpenDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	usr := generateUser(1)
+	if err := CreateUser(plain, usr); err != nil {
+		t.Fatal(err)
+	}
+	legacy := &UserEntity{Uid: usr.Id, Name: "legacy", ParentDir: filepath.Join(root, "old")}
+	if err := CreateUserEntity(plain, legacy); err != nil {
+		t.Fatal(err)
+	}
+	plain.Close()
+
+	db, err := OpenDB(path, WithLibraryRoot(root))
+	if err != nil {
+		t.Fatal(err)
+	}
+	storedDir := func(id int32) string {
+		var dir string
+		if err := db.Get(&dir, `SELECT parent_dir FROM user_entities WHERE id=?`, id); err != nil {
+			t.Fatal(err)
+		}
+		return dir
+	}
+	if dir := storedDir(legacy.Id.Int32); dir != "old" {
+		t.Errorf("stored parent_dir of legacy entity = %q want %q", dir, "old")
+	}
+
+	inside := &UserEntity{Uid: usr.Id, Name: "inside", ParentDir: filepath.Join(root, "users")}
+	if err := CreateUserEntity(db, inside); err != nil {
+		t.Fatal(err)
+	}
+	if dir := storedDir(inside.Id.Int32); dir != "users" {
+		t.Errorf("stored parent_dir = %q want %q", dir, "users")
+	}
+	other := &UserEntity{Uid: usr.Id, Name: "other", ParentDir: outside}
+	if err := CreateUserEntity(db, other); err != nil {
+		t.Fatal(err)
+	}
+	if dir := storedDir(other.Id.Int32); dir != outside {
+		t.Errorf("stored parent_dir outside the root = %q want %q", dir, outside)
+	}
+
+	lst := &Lst{Id: 7, Name: "lst", OwnerId: usr.Id}
+	if err := CreateLst(db, lst); err != nil {
+		t.Fatal(err)
+	}
+	lstEntity := &LstEntity{LstId: int64(lst.Id), Name: "lst", ParentDir: filepath.Join(root, "lists")}
+	if err := CreateLstEntity(db, lstEntity); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	// 移动整个库后以新的根目录打开
+	moved := filepath.Join(tmp, "moved")
+	db, err = OpenDB(path, WithLibraryRoot(moved))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	want := map[int32]string{
+		legacy.Id.Int32: filepath.Join(moved, "old"),
+		inside.Id.Int32: filepath.Join(moved, "users"),
+		other.Id.Int32:  outside,
+	}
+	for id, dir := range want {
+		entity, err := GetUserEntity(db, int(id))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entity.ParentDir != dir {
+			t.Errorf("entity %d: ParentDir = %q want %q", id, entity.ParentDir, dir)
+		}
+	}
+
+	le, err := GetLstEntity(db, int(lstEntity.Id.Int32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if le.ParentDir != filepath.Join(moved, "lists") {
+		t.Errorf("lst entity ParentDir = %q want %q", le.ParentDir, filepath.Join(moved, "lists"))
+	}
+
+	located, err := LocateUserEntity(db, usr.Id, filepath.Join(moved, "users"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if located == nil || located.Id != inside.Id {
+		t.Errorf("LocateUserEntity() = %v want entity %d", located, inside.Id.Int32)
+	}
+	if got := ResolveParentDir(db, "users"); got != filepath.Join(moved, "users") {
+		t.Errorf("ResolveParentDir() = %q", got)
+	}
+}
+
+func TestGetUserLinksByLstEntity(t *testing.T) {
+	f := seedDB(t)
+
+	links, err := GetUserLinksByLstEntity(db, f.lstEntity.Id.Int32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := append([]*UserLink{}, f.links...)
+	sort.Slice(want, func(i, j int) bool { return want[i].Name < want[j].Name })
+	if len(links) != len(want) {
+		t.Fatalf("GetUserLinksByLstEntity() returned %d links want %d", len(links), len(want))
+	}
+	for i := range want {
+		if withoutTimestamps(links[i]) != withoutTimestamps(want[i]) {
+			t.Errorf("links[%d] = %v want %v", i, links[i], want[i])
+		}
+	}
+
+	links, err = GetUserLinksByLstEntity(db, f.lstEntity.Id.Int32+100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(links) != 0 {
+		t.Errorf("GetUserLinksByLstEntity() on unknown entity = %v want empty", links)
+	}
+}
+
+func TestWithTimeout(t *testing.T) {
+	tdb, err := OpenDB(":memory:", WithTimeout(50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tdb.Close()
+
+	// 足够慢的查询，不被中断时需要很久才能完成
+	slow := `WITH RECURSIVE c(x) AS (SELECT 1 UNION ALL SELECT x+1 FROM c WHERE x < 1000000000) SELECT COUNT(*) FROM c`
+	var n int
+	start := time.Now()
+	err = tdb.Get(&n, slow)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("slow query: %v want context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("slow query took %v, it was not interrupted", elapsed)
+	}
+
+	// 连接在中断后仍然可用
+	if _, err := CountUsers(tdb); err != nil {
+		t.Fatal(err)
+	}
+	if err := CreateUser(tdb, generateUser(1)); err != nil {
+		t.Fatal(err)
+	}
+
+	// 调用方自己的期限优先于默认期限
+	long, err := OpenDB(":memory:", WithTimeout(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer long.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := long.GetContext(ctx, &n, slow); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("slow query with caller deadline: %v want context.DeadlineExceeded", err)
+	}
+
+	moderate := `WITH RECURSIVE c(x) AS (SELECT 1 UNION ALL SELECT x+1 FROM c WHERE x < 2000000) SELECT COUNT(*) FROM c`
+	if err := tdb.GetContext(WithoutTimeout(context.Background()), &n, moderate); err != nil {
+		t.Fatal(err)
+	}
+	if n != 2000000 {
+		t.Errorf("COUNT(*) = %d want 2000000", n)
+	}
+
+	if _, err := OpenDB(":memory:", WithTimeout(-time.Second)); err == nil {
+		t.Error("opened database with a negative timeout")
+	}
+
+	// 流式接口中处理每行的时间不计入期限
+	streaming, err := OpenDB(":memory:", WithTimeout(100*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer streaming.Close()
+	for i := 1; i <= 5; i++ {
+		usr := generateUser(i)
+		if err := CreateUser(streaming, usr); err != nil {
+			t.Fatal(err)
+		}
+		ue := &UserEntity{Uid: usr.Id, Name: usr.Name, ParentDir: os.TempDir()}
+		if err := CreateUserEntity(streaming, ue); err != nil {
+			t.Fatal(err)
+		}
+	}
+	visited := 0
+	err = IterUserEntities(streaming, func(*UserEntity) error {
+		time.Sleep(50 * time.Millisecond)
+		visited++
+		return nil
+	})
+	if err != nil || visited != 5 {
+		t.Errorf("IterUserEntities() visited %d entities, err: %v want 5, nil", visited, err)
+	}
+
+	// *Context 函数使用调用方的 ctx
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	visited = 0
+	err = IterUserEntitiesContext(canceled, streaming, func(*UserEntity) error {
+		visited++
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) || visited != 0 {
+		t.Errorf("IterUserEntitiesContext(canceled) visited %d entities, err: %v want 0, context.Canceled", visited, err)
+	}
+	if err := CheckIntegrityContext(canceled, streaming); !errors.Is(err, context.Canceled) {
+		t.Errorf("CheckIntegrityContext(canceled) = %v want context.Canceled", err)
+	}
+	if err := DumpSQLContext(canceled, streaming, io.Discard); !errors.Is(err, context.Canceled) {
+		t.Errorf("DumpSQLContext(canceled) = %v want context.Canceled", err)
+	}
+	if err := VacuumContext(canceled, streaming); !errors.Is(err, context.Canceled) {
+		t.Errorf("VacuumContext(canceled) = %v want context.Canceled", err)
+	}
+}
+
+func TestGetUserEntityByName(t *testing.T) {
+	f := seedDB(t)
+	usr := f.users[0]
+	first := f.userEntities[0]
+
+	got, err := GetUserEntityByName(db, usr.Id, strings.ToUpper(first.Name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got == nil || got.Id != first.Id {
+		t.Errorf("GetUserEntityByName() = %v want %v", got, first)
+	}
+
+	// 同名实体中返回 latest_release_time 最晚的
+	older := &UserEntity{Uid: usr.Id, Name: first.Name, ParentDir: filepath.Join(f.root, "older")}
+	newer := &UserEntity{Uid: usr.Id, Name: strings.ToLower(first.Name), ParentDir: filepath.Join(f.root, "newer")}
+	for _, entity := range []*UserEntity{older, newer} {
+		if err := CreateUserEntity(db, entity); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now()
+	if err := SetUserEntityLatestReleaseTime(db, int(older.Id.Int32), now.Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetUserEntityLatestReleaseTime(db, int(newer.Id.Int32), now); err != nil {
+		t.Fatal(err)
+	}
+	got, err = GetUserEntityByName(db, usr.Id, first.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got == nil || got.Id != newer.Id {
+		t.Errorf("GetUserEntityByName() = %v want %v", got, newer)
+	}
+
+	// 只在该用户的实体中查找
+	got, err = GetUserEntityByName(db, f.users[1].Id, first.Name)
+	if err != nil || got != nil {
+		t.Errorf("GetUserEntityByName() of another user = %v, %v want nil, nil", got, err)
+	}
+	got, err = GetUserEntityByName(db, usr.Id, "missing")
+	if err != nil || got != nil {
+		t.Errorf("GetUserEntityByName(missing) = %v, %v want nil, nil", got, err)
+	}
+}
+
+func TestMigrateMediaCountNotNull(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "v8.db")
+	old, err := sqlx.Connect("sqlite3", fmt.Sprintf("file:%s?_foreign_keys=on", path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 构造迁移 9 之前的数据库，其中有 media_count 为 NULL 的实体和引用它的下载失败记录
+	stmts := append([]string{schema}, migrations[:8]...)
+	stmts = append(stmts, `PRAGMA user_version = 8`,
+		`INSERT INTO users(id, screen_name, name, protected, friends_count) VALUES(1, 'user1', 'user1', 0, 0)`,
+		`INSERT INTO user_entities(id, user_id, name, parent_dir, media_count) VALUES(1, 1, 'a', '/a', NULL)`,
+		`INSERT INTO user_entities(id, user_id, name, parent_dir, media_count) VALUES(2, 1, 'b', '/b', 5)`,
+		`INSERT INTO download_errors(entity_id, tweet_id, url, error, record_date) VALUES(1, 1, 'url', 'err', CURRENT_TIMESTAMP)`)
+	for _, stmt := range stmts {
+		if _, err := old.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old.Close()
+
+	db, err := OpenDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for id, want := range map[int]int{1: 0, 2: 5} {
+		entity, err := GetUserEntity(db, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entity == nil || entity.MediaCount != want {
+			t.Errorf("entity %d: media_count = %v want %d", id, entity, want)
+		}
+	}
+	if errs, err := GetRecentDownloadErrors(db, 1, 10); err != nil || len(errs) != 1 {
+		t.Errorf("download errors of entity 1 = %v, %v want 1 record", errs, err)
+	}
+	if _, err := db.Exec(`UPDATE user_entities SET media_count=NULL WHERE id=1`); !errors.Is(wrapErr(err), ErrConstraint) {
+		t.Errorf("setting media_count to NULL: %v want ErrConstraint", err)
+	}
+
+	// 重建后的表仍有索引、触发器和外键约束
+	var indexes int
+	stmt := `SELECT COUNT(*) FROM sqlite_master WHERE type='index' AND tbl_name='user_entities'
+		AND name IN ('idx_user_entities_latest_release', 'idx_user_entities_user_id')`
+	if err := db.Get(&indexes, stmt); err != nil {
+		t.Fatal(err)
+	}
+	if indexes != 2 {
+		t.Errorf("user_entities has %d of its 2 indexes", indexes)
+	}
+	entity := &UserEntity{Uid: 1, Name: "c", ParentDir: t.TempDir()}
+	if err := CreateUserEntity(db, entity); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := GetUserEntity(db, int(entity.Id.Int32)); err != nil || !got.CreatedAt.Valid || got.MediaCount != 0 {
+		t.Errorf("new entity = %v, %v want created_at set and media_count 0", got, err)
+	}
+	if err := CreateUserEntity(db, &UserEntity{Uid: 2, Name: "d", ParentDir: t.TempDir()}); !errors.Is(err, ErrConstraint) {
+		t.Errorf("CreateUserEntity() for missing user: %v want ErrConstraint", err)
+	}
+}
+
+func TestListAllUserEntities(t *testing.T) {
+	f := seedDB(t)
+	first, second := f.userEntities[0], f.userEntities[1]
+	if err := IncrUserEntityMediaCount(db, int(first.Id.Int32), 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := IncrUserEntityMediaCount(db, int(second.Id.Int32), 9); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetUserEntityLatestReleaseTime(db, int(first.Id.Int32), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	ids := func(entities []*UserEntityWithUser) []int32 {
+		res := []int32{}
+		for _, entity := range entities {
+			res = append(res, entity.Id.Int32)
+		}
+		return res
+	}
+	tests := []struct {
+		orderBy       string
+		desc          bool
+		limit, offset int
+		want          []int32
+	}{
+		{"", false, 0, 0, []int32{first.Id.Int32, second.Id.Int32}},
+		{"media_count", true, 0, 0, []int32{second.Id.Int32, first.Id.Int32}},
+		{"media_count", false, 1, 0, []int32{first.Id.Int32}},
+		{"media_count", false, 1, 1, []int32{second.Id.Int32}},
+		// 从未同步的实体降序时在后
+		{"latest_release_time", true, 0, 0, []int32{first.Id.Int32, second.Id.Int32}},
+		{"screen_name", true, 0, 0, []int32{second.Id.Int32, first.Id.Int32}},
+	}
+	for _, test := range tests {
+		entities, err := ListAllUserEntities(db, test.orderBy, test.desc, test.limit, test.offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := ids(entities); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ListAllUserEntities(%q, %v, %d, %d) = %v want %v", test.orderBy, test.desc, test.limit, test.offset, got, test.want)
+		}
+	}
+
+	entities, err := ListAllUserEntities(db, "media_count", true, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entities) != 1 || entities[0].ScreenName != f.users[1].ScreenName || entities[0].ParentDir != second.ParentDir {
+		t.Errorf("ListAllUserEntities() = %+v want entity of %v", entities, f.users[1])
+	}
+
+	if _, err := ListAllUserEntities(db, "media_count; DROP TABLE users", false, 0, 0); err == nil {
+		t.Error("ListAllUserEntities() accepted an unknown column")
+	}
+}
+
+func TestCanCreateUserEntity(t *testing.T) {
+	f := seedDB(t)
+	entity := f.userEntities[0]
+
+	ok, existing, err := CanCreateUserEntity(db, entity.Uid, strings.ToUpper(entity.ParentDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok || existing == nil || existing.Id != entity.Id {
+		t.Errorf("CanCreateUserEntity() on occupied path = %v, %v want false, %v", ok, existing, entity)
+	}
+
+	// 其他用户或其他目录不冲突
+	for _, test := range []struct {
+		uid uint64
+		dir string
+	}{
+		{f.users[2].Id, entity.ParentDir},
+		{entity.Uid, filepath.Join(f.root, "other")},
+	} {
+		ok, existing, err := CanCreateUserEntity(db, test.uid, test.dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok || existing != nil {
+			t.Errorf("CanCreateUserEntity(%d, %s) = %v, %v want true, nil", test.uid, test.dir, ok, existing)
+		}
+	}
+}
+
+func TestOpenProfile(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "profiles")
+
+	names, err := ListProfiles(dir)
+	if err != nil || len(names) != 0 {
+		t.Fatalf("ListProfiles() on missing dir = %v, %v want empty", names, err)
+	}
+
+	alice, err := OpenProfile(dir, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	bob, err := OpenProfile(dir, "bob", WithNotFoundError())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bob.Close()
+
+	// 两个配置的数据和选项互不影响
+	usr := generateUser(1)
+	if err := CreateUser(alice, usr); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := GetUserById(alice, usr.Id); err != nil || got == nil {
+		t.Errorf("GetUserById(alice) = %v, %v", got, err)
+	}
+	if _, err := GetUserById(bob, usr.Id); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetUserById(bob) = %v want ErrNotFound", err)
+	}
+
+	names, err = ListProfiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(names, []string{"alice", "bob"}) {
+		t.Errorf("ListProfiles() = %v want [alice bob]", names)
+	}
+
+	for _, name := range []string{"", "..", "a/b", `a\b`} {
+		if _, err := OpenProfile(dir, name); err == nil {
+			t.Errorf("OpenProfile(%q) succeeded", name)
+		}
+	}
+}
+
+// 关闭的句柄不应被包内的任何状态引用，反复打开和关闭配置时内存不会增长
+func TestOpenProfileReleasesClosedHandles(t *testing.T) {
+	dir := t.TempDir()
+	const n = 20
+	var released atomic.Int32
+	for i := 0; i < n; i++ {
+		profile, err := OpenProfile(dir, fmt.Sprintf("p%d", i%3), WithNotFoundError())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := GetUserById(profile, 1); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("GetUserById() = %v want ErrNotFound", err)
+		}
+		runtime.SetFinalizer(profile, func(*sqlx.DB) { released.Add(1) })
+		if err := profile.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 50 && released.Load() < n; i++ {
+		runtime.GC()
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := released.Load(); got != n {
+		t.Errorf("%d of %d closed handles were released", got, n)
+	}
+}
+
+func TestVerifyUserFiles(t *testing.T) {
+	db = opentmpdb()
+	defer db.Close()
+
+	// 所有实体位于同一 parent_dir 下，各自的 .user 文件在实体目录中
+	root := t.TempDir()
+	dirs := map[string]string{}
+	for i, name := range []string{"ok", "missing", "wrong", "malformed"} {
+		usr := generateUser(i + 1)
+		if err := CreateUser(db, usr); err != nil {
+			t.Fatal(err)
+		}
+		if err := CreateUserEntity(db, &UserEntity{Uid: usr.Id, Name: name, ParentDir: root}); err != nil {
+			t.Fatal(err)
+		}
+		dirs[name] = filepath.Join(root, name)
+		if err := os.Mkdir(dirs[name], 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := WriteUserFile(dirs["ok"], 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteUserFile(dirs["wrong"], 99); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dirs["malformed"], userFileName), []byte("abc\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	issues, err := VerifyUserFiles(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]UserFileIssue{}
+	for _, issue := range issues {
+		got[issue.Entity.Name] = issue
+	}
+	if len(issues) != 3 {
+		t.Errorf("VerifyUserFiles() returned %d issues want 3: %v", len(issues), issues)
+	}
+	if issue, ok := got["missing"]; !ok || issue.Problem != UserFileMissing {
+		t.Errorf("issue of missing = %+v want %s", issue, UserFileMissing)
+	}
+	if issue, ok := got["wrong"]; !ok || issue.Problem != UserFileWrongUid || issue.RecordedUid != 99 {
+		t.Errorf("issue of wrong = %+v want %s with uid 99", issue, UserFileWrongUid)
+	}
+	if issue, ok := got["malformed"]; !ok || issue.Problem != UserFileUnreadable || issue.Err == nil {
+		t.Errorf("issue of malformed = %+v want %s", issue, UserFileUnreadable)
+	}
+	if issue, ok := got["ok"]; ok {
+		t.Errorf("unexpected issue of ok: %+v", issue)
+	}
+}
+
+func TestListsWithMemberCounts(t *testing.T) {
+	f := seedDB(t)
+
+	// 同一成员链接到列表的另一个实体下，只计算一次
+	other := &LstEntity{LstId: int64(f.lst.Id), Name: "lst1", ParentDir: filepath.Join(f.root, "other")}
+	if err := CreateLstEntity(db, other); err != nil {
+		t.Fatal(err)
+	}
+	if err := CreateUserLink(db, &UserLink{Uid: f.links[0].Uid, Name: f.links[0].Name, ParentLstEntityId: other.Id.Int32}); err != nil {
+		t.Fatal(err)
+	}
+	empty := &Lst{Id: 2, Name: "empty", OwnerId: f.users[1].Id}
+	if err := CreateLst(db, empty); err != nil {
+		t.Fatal(err)
+	}
+
+	lsts, err := ListsWithMemberCounts(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*LstWithMemberCount{
+		{f.lst.Id, f.lst.Name, f.lst.OwnerId, len(f.links)},
+		{empty.Id, empty.Name, empty.OwnerId, 0},
+	}
+	if !reflect.DeepEqual(lsts, want) {
+		t.Errorf("ListsWithMemberCounts() = %v want %v", lsts, want)
+	}
+}
+
+func TestDeduplicateUserEntities(t *testing.T) {
+	f := seedDB(t)
+	uid := f.users[2].Id
+	dir := filepath.Join(f.root, "dup")
+
+	// 用未规范化的路径直接写入，模拟旧版本留下的重复记录
+	insert := `INSERT INTO user_entities(user_id, name, parent_dir, media_count, latest_release_time) VALUES(?, ?, ?, ?, ?)`
+	now := time.Now()
+	rows := []struct {
+		dir    string
+		count  int
+		latest any
+	}{
+		{dir + string(filepath.Separator), 5, now.Add(-time.Hour)},
+		{filepath.Join(f.root, "x", "..") + string(filepath.Separator) + "dup", 10, now.Add(-time.Hour)},
+		{dir + string(filepath.Separator) + ".", 10, now},
+	}
+	ids := []int64{}
+	for _, row := range rows {
+		res, err := db.Exec(insert, uid, "dup", row.dir, row.count, row.latest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, _ := res.LastInsertId()
+		ids = append(ids, id)
+	}
+
+	n, err := DeduplicateUserEntities(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("DeduplicateUserEntities() = %d want 2", n)
+	}
+
+	entities := []*UserEntity{}
+	if err := db.Select(&entities, `SELECT * FROM user_entities WHERE user_id=?`, uid); err != nil {
+		t.Fatal(err)
+	}
+	if len(entities) != 1 || int64(entities[0].Id.Int32) != ids[2] || entities[0].ParentDir != dir {
+		t.Errorf("remaining entities = %v want entity %d under %s", entities, ids[2], dir)
+	}
+
+	// 其他实体不受影响，再次执行不会删除任何记录
+	for _, entity := range f.userEntities {
+		if yes, err := hasSameUserEntityRecord(entity); err != nil || !yes {
+			t.Errorf("entity %d changed, err: %v", entity.Id.Int32, err)
+		}
+	}
+	if n, err := DeduplicateUserEntities(db); err != nil || n != 0 {
+		t.Errorf("second DeduplicateUserEntities() = %d, %v want 0", n, err)
+	}
+}
+
+func TestUserTags(t *testing.T) {
+	f := seedDB(t)
+	art, news := f.users[0], f.users[1]
+
+	for _, test := range []struct {
+		uid uint64
+		tag string
+	}{
+		{art.Id, "art"},
+		{art.Id, " Art "}, // 重复添加不报错
+		{art.Id, "news"},
+		{news.Id, "NEWS"},
+	} {
+		if err := AddUserTag(db, test.uid, test.tag); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := AddUserTag(db, 12345, "art"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("AddUserTag() for missing user: %v want ErrNotFound", err)
+	}
+	if err := AddUserTag(db, art.Id, "  "); err == nil {
+		t.Error("AddUserTag() accepted an empty tag")
+	}
+
+	screenNames := func(users []*User) []string {
+		res := []string{}
+		for _, usr := range users {
+			res = append(res, usr.ScreenName)
+		}
+		return res
+	}
+	users, err := GetUsersByTag(db, "news")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := screenNames(users), []string{art.ScreenName, news.ScreenName}; !reflect.DeepEqual(got, want) {
+		t.Errorf("GetUsersByTag(news) = %v want %v", got, want)
+	}
+	if tags, err := GetUserTags(db, art.Id); err != nil || !reflect.DeepEqual(tags, []string{"art", "news"}) {
+		t.Errorf("GetUserTags() = %v, %v want [art news]", tags, err)
+	}
+
+	entities, err := QueryUserEntities(db, EntityQuery{Tag: sql.NullString{String: "ART", Valid: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entities) != 1 || entities[0].Uid != art.Id {
+		t.Errorf("QueryUserEntities(tag=art) = %v want entities of %d", entities, art.Id)
+	}
+
+	if err := RemoveUserTag(db, art.Id, "news"); err != nil {
+		t.Fatal(err)
+	}
+	if err := RemoveUserTag(db, art.Id, "missing"); err != nil {
+		t.Fatal(err)
+	}
+	users, err = GetUsersByTag(db, "news")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := screenNames(users); !reflect.DeepEqual(got, []string{news.ScreenName}) {
+		t.Errorf("GetUsersByTag(news) after removal = %v want [%s]", got, news.ScreenName)
+	}
+
+	// 删除用户时其标签关联随之删除
+	if _, err := DeleteUserCascade(db, art.Id); err != nil {
+		t.Fatal(err)
+	}
+	if users, err := GetUsersByTag(db, "art"); err != nil || len(users) != 0 {
+		t.Errorf("GetUsersByTag(art) after deleting user = %v, %v want empty", users, err)
+	}
+}
+
+func TestGetUserEntitiesModifiedSince(t *testing.T) {
+	f := seedDB(t)
+	older, newer := f.userEntities[0], f.userEntities[1]
+	created := &UserEntity{Uid: f.users[2].Id, Name: "created", ParentDir: filepath.Join(f.root, "created")}
+	if err := CreateUserEntity(db, created); err != nil {
+		t.Fatal(err)
+	}
+	// 与 CURRENT_TIMESTAMP 的格式一致
+	for id, updatedAt := range map[int32]string{older.Id.Int32: "2024-01-01 00:00:00", newer.Id.Int32: "2024-06-01 12:00:00"} {
+		if _, err := db.Exec(`UPDATE user_entities SET updated_at=? WHERE id=?`, updatedAt, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	east := time.FixedZone("UTC+8", 8*60*60)
+	tests := []struct {
+		since time.Time
+		want  []int32
+	}{
+		{time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC), []int32{older.Id.Int32, newer.Id.Int32, created.Id.Int32}},
+		{time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), []int32{newer.Id.Int32, created.Id.Int32}},
+		// 按 UTC 比较，同一秒内的修改也会返回
+		{time.Date(2024, 6, 1, 20, 0, 0, 500, east), []int32{newer.Id.Int32, created.Id.Int32}},
+		// 新建的实体以创建时间作为修改时间
+		{time.Date(2024, 6, 1, 12, 0, 1, 0, time.UTC), []int32{created.Id.Int32}},
+		{time.Now().Add(time.Hour), []int32{}},
+	}
+	for _, test := range tests {
+		entities, err := GetUserEntitiesModifiedSince(db, test.since)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := []int32{}
+		for _, entity := range entities {
+			got = append(got, entity.Id.Int32)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("GetUserEntitiesModifiedSince(%v) = %v want %v", test.since, got, test.want)
+		}
+	}
+}
+
+func TestWithEncryptionKey(t *testing.T) {
+	// 测试使用的 go-sqlite3 未链接 SQLCipher
+	path := filepath.Join(t.TempDir(), "encrypted.db")
+	for _, p := range []string{":memory:", path} {
+		edb, err := OpenDB(p, WithEncryptionKey("it's a secret"))
+		if err == nil {
+			edb.Close()
+		}
+		if !errors.Is(err, ErrEncryptionUnsupported) {
+			t.Errorf("OpenDB(%s) with key: %v want ErrEncryptionUnsupported", p, err)
+		}
+	}
+
+	opts := defaultOptions()
+	WithEncryptionKey("it's a secret")(opts)
+	if got, want := opts.keyPragma(), `PRAGMA key = 'it''s a secret';`; got != want {
+		t.Errorf("keyPragma() = %q want %q", got, want)
+	}
+}
+
+// 只在链接了 SQLCipher 的构建中运行：有密钥时可以读取 sqlite_master，没有或密钥错误时不能
+func TestEncryptedDatabase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "encrypted.db")
+	edb, err := OpenDB(path, WithEncryptionKey("secret"))
+	if errors.Is(err, ErrEncryptionUnsupported) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CreateUser(edb, generateUser(1)); err != nil {
+		t.Fatal(err)
+	}
+	edb.Close()
+
+	edb, err = OpenDB(path, WithEncryptionKey("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	if err := edb.Get(&n, `SELECT count(*) FROM sqlite_master`); err != nil || n == 0 {
+		t.Errorf("sqlite_master with key: %d tables, err: %v", n, err)
+	}
+	if usr, err := GetUserById(edb, 1); err != nil || usr == nil {
+		t.Errorf("GetUserById with key = %v, err: %v", usr, err)
+	}
+	edb.Close()
+
+	// 没有密钥时文件内容无法解析
+	plain, err := sqlx.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	if err := plain.Get(&n, `SELECT count(*) FROM sqlite_master`); err == nil {
+		t.Error("sqlite_master is readable without key")
+	}
+	// 密钥错误时打开失败
+	if wrong, err := OpenDB(path, WithEncryptionKey("wrong")); err == nil {
+		wrong.Close()
+		t.Error("opened encrypted database with a wrong key")
+	}
+}
+
+func TestCountUserEntitiesPerUser(t *testing.T) {
+	f := seedDB(t)
+	uid := f.users[0].Id
+	for _, name := range []string{"second", "third"} {
+		if err := CreateUserEntity(db, &UserEntity{Uid: uid, Name: name, ParentDir: filepath.Join(f.root, name)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		threshold int
+		want      map[uint64]int
+	}{
+		{0, map[uint64]int{uid: 3, f.users[1].Id: 1}},
+		{1, map[uint64]int{uid: 3}},
+		{3, map[uint64]int{}},
+	}
+	for _, test := range tests {
+		counts, err := CountUserEntitiesPerUser(db, test.threshold)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(counts, test.want) {
+			t.Errorf("CountUserEntitiesPerUser(%d) = %v want %v", test.threshold, counts, test.want)
+		}
+	}
+}
+
+func TestMoveUserLink(t *testing.T) {
+	f := seedDB(t)
+	link := f.links[0]
+	target := &LstEntity{LstId: int64(f.lst.Id), Name: "target", ParentDir: filepath.Join(f.root, "target")}
+	if err := CreateLstEntity(db, target); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := MoveUserLink(db, link.Uid, link.ParentLstEntityId, target.Id.Int32, "moved"); err != nil {
+		t.Fatal(err)
+	}
+	if old, err := GetUserLink(db, link.Uid, link.ParentLstEntityId); err != nil || old != nil {
+		t.Errorf("link under source = %v, %v want nil", old, err)
+	}
+	moved, err := GetUserLink(db, link.Uid, target.Id.Int32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved == nil || moved.Name != "moved" {
+		t.Errorf("link under target = %v want named moved", moved)
+	}
+
+	// 目标下已有链接时整个移动回滚，原链接保留
+	other := f.links[1]
+	if err := CreateUserLink(db, &UserLink{Uid: other.Uid, Name: other.Name, ParentLstEntityId: target.Id.Int32}); err != nil {
+		t.Fatal(err)
+	}
+	if err := MoveUserLink(db, other.Uid, other.ParentLstEntityId, target.Id.Int32, other.Name); !errors.Is(err, ErrDuplicateLink) {
+		t.Errorf("MoveUserLink() onto existing link: %v want ErrDuplicateLink", err)
+	}
+	if yes, err := hasSameUserLinkRecord(other); err != nil || !yes {
+		t.Errorf("source link changed after failed move, err: %v", err)
+	}
+
+	if err := MoveUserLink(db, other.Uid, other.ParentLstEntityId, 12345, other.Name); !errors.Is(err, ErrNotFound) {
+		t.Errorf("MoveUserLink() to missing lst entity: %v want ErrNotFound", err)
+	}
+	if err := MoveUserLink(db, link.Uid, link.ParentLstEntityId, target.Id.Int32, "again"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("MoveUserLink() of missing link: %v want ErrNotFound", err)
+	}
+}
+
+func TestIterUserEntities(t *testing.T) {
+	f := seedDB(t)
+
+	visited := []*UserEntity{}
+	err := IterUserEntities(db, func(entity *UserEntity) error {
+		visited = append(visited, entity)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(visited) != len(f.userEntities) {
+		t.Fatalf("visited %d entities want %d", len(visited), len(f.userEntities))
+	}
+	for i, entity := range f.userEntities {
+		if withoutTimestamps(visited[i]) != withoutTimestamps(entity) {
+			t.Errorf("visited[%d] = %v want %v", i, visited[i], entity)
+		}
+	}
+
+	// 回调返回错误时立即停止
+	stop := errors.New("stop")
+	n := 0
+	err = IterUserEntities(db, func(*UserEntity) error {
+		n++
+		return stop
+	})
+	if !errors.Is(err, stop) || n != 1 {
+		t.Errorf("IterUserEntities() = %v after %d calls want stop after 1", err, n)
+	}
+
+	// 遍历结束后连接已释放
+	if _, err := CountUsers(db); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestListUsersWithoutLinks(t *testing.T) {
+	f := seedDB(t)
+	linked := map[uint64]bool{}
+	for _, link := range f.links {
+		linked[link.Uid] = true
+	}
+	want := []uint64{}
+	for _, usr := range f.users {
+		if !linked[usr.Id] {
+			want = append(want, usr.Id)
+		}
+	}
+
+	users, err := ListUsersWithoutLinks(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []uint64{}
+	for _, usr := range users {
+		got = append(got, usr.Id)
+	}
+	if len(want) == 0 || !reflect.DeepEqual(got, want) {
+		t.Errorf("ListUsersWithoutLinks() = %v want %v", got, want)
+	}
+}
+
+func TestUserEntityPaused(t *testing.T) {
+	f := seedDB(t)
+
+	paused := f.userEntities[0]
+	eid := int(paused.Id.Int32)
+	if err := SetUserEntityPaused(db, eid, true); err != nil {
+		t.Fatal(err)
+	}
+
+	active, err := ListActiveUserEntities(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(active) != len(f.userEntities)-1 {
+		t.Fatalf("len(active) = %d, want %d", len(active), len(f.userEntities)-1)
+	}
+	for _, e := range active {
+		if e.Id == paused.Id {
+			t.Error("paused entity was listed as active")
+		}
+	}
+
+	// 暂停的实体仍出现在查询和统计中
+	got, err := GetUserEntity(db, eid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got == nil || !got.Paused {
+		t.Errorf("GetUserEntity: %v, want paused entity", got)
+	}
+	all, err := ListAllUserEntities(db, "id", false, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != len(f.userEntities) {
+		t.Errorf("len(all) = %d, want %d", len(all), len(f.userEntities))
+	}
+	res, err := QueryUserEntities(db, EntityQuery{Paused: sql.NullBool{Bool: true, Valid: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 1 || res[0].Id != paused.Id {
+		t.Errorf("QueryUserEntities(paused) = %v", res)
+	}
+
+	if err := SetUserEntityPaused(db, eid, false); err != nil {
+		t.Fatal(err)
+	}
+	active, err = ListActiveUserEntities(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(active) != len(f.userEntities) {
+		t.Errorf("after resume len(active) = %d, want %d", len(active), len(f.userEntities))
+	}
+
+	if err := SetUserEntityPaused(db, 9999, true); !errors.Is(err, ErrNotFound) {
+		t.Errorf("SetUserEntityPaused(missing) = %v, want ErrNotFound", err)
+	}
+}
+
+func TestGetUserLinksForEntities(t *testing.T) {
+	f := seedDB(t)
+
+	other := &LstEntity{LstId: f.lstEntity.LstId, Name: "other", ParentDir: f.root}
+	if err := CreateLstEntity(db, other); err != nil {
+		t.Fatal(err)
+	}
+	link := &UserLink{Uid: f.users[2].Id, Name: "link", ParentLstEntityId: other.Id.Int32}
+	if err := CreateUserLink(db, link); err != nil {
+		t.Fatal(err)
+	}
+
+	// 超过单条语句的参数数量，需要分批查询
+	ids := []int32{}
+	for i := 0; i < 3*maxInParams; i++ {
+		ids = append(ids, int32(1000+i))
+	}
+	ids = append(ids, other.Id.Int32, f.lstEntity.Id.Int32)
+
+	links, err := GetUserLinksForEntities(db, ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(links) != 2 {
+		t.Fatalf("GetUserLinksForEntities() returned %d groups want 2", len(links))
+	}
+	if got := links[f.lstEntity.Id.Int32]; len(got) != len(f.links) {
+		t.Errorf("links[%d] has %d links want %d", f.lstEntity.Id.Int32, len(got), len(f.links))
+	}
+	if got := links[other.Id.Int32]; len(got) != 1 || got[0].Uid != link.Uid {
+		t.Errorf("links[%d] = %v want [%v]", other.Id.Int32, got, link)
+	}
+
+	links, err = GetUserLinksForEntities(db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(links) != 0 {
+		t.Errorf("GetUserLinksForEntities(nil) = %v want empty", links)
+	}
+}
+
+func TestUserEntityContentHash(t *testing.T) {
+	f := seedDB(t)
+
+	unchanged, changed := f.userEntities[0], f.userEntities[1]
+	for _, e := range []*UserEntity{unchanged, changed} {
+		if err := UpdateUserEntityContentHash(db, int(e.Id.Int32), "old"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	third := &UserEntity{Uid: f.users[2].Id, Name: "third", ParentDir: f.root}
+	if err := CreateUserEntity(db, third); err != nil {
+		t.Fatal(err)
+	}
+
+	hashes := map[int]string{
+		int(unchanged.Id.Int32): "old",
+		int(changed.Id.Int32):   "new",
+		int(third.Id.Int32):     "new", // 尚未保存校验值
+		9999:                    "new",
+	}
+	res, err := GetUserEntitiesWithChangedContent(db, hashes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 2 || res[0].Id != changed.Id || res[1].Id != third.Id {
+		t.Errorf("GetUserEntitiesWithChangedContent() = %v want [%d %d]", res, changed.Id.Int32, third.Id.Int32)
+	}
+
+	if err := UpdateUserEntityContentHash(db, int(changed.Id.Int32), "new"); err != nil {
+		t.Fatal(err)
+	}
+	got, err := GetUserEntity(db, int(changed.Id.Int32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ContentHash.String != "new" {
+		t.Errorf("ContentHash = %v want new", got.ContentHash)
+	}
+
+	if err := UpdateUserEntityContentHash(db, 9999, "new"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("UpdateUserEntityContentHash(missing) = %v, want ErrNotFound", err)
+	}
+}
+
+func TestLocateLstEntityMoved(t *testing.T) {
+	db = opentmpdb()
+	defer db.Close()
+
+	root := t.TempDir()
+	dirA, dirB, dirC := filepath.Join(root, "a"), filepath.Join(root, "b"), filepath.Join(root, "c")
+	e1 := generateLstEntity(1, dirA)
+	e2 := generateLstEntity(2, dirB)
+	for _, e := range []*LstEntity{e1, e2} {
+		if err := CreateLstEntity(db, e); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.MkdirAll(e.Path(), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// dirB 存在且属于另一个列表，不能把列表 1 的实体迁移过去
+	got, err := LocateLstEntity(db, e1.LstId, dirB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != nil {
+		t.Errorf("LocateLstEntity(1, dirB) = %v want nil", got)
+	}
+	if yes, err := hasSameLstEntityRecord(e1); err != nil || !yes {
+		t.Errorf("lst entity 1 was changed, err: %v", err)
+	}
+
+	// 原目录仍存在时，新位置下的同名目录不足以认定为同一实体
+	if err := os.MkdirAll(filepath.Join(dirC, e1.Name), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := LocateLstEntity(db, e1.LstId, dirC); err != nil || got != nil {
+		t.Errorf("LocateLstEntity(1, dirC) = %v, %v want nil", got, err)
+	}
+
+	// .lst 文件记录的是其他列表
+	if err := WriteLstFile(filepath.Join(dirC, e1.Name), e2.LstId); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := LocateLstEntity(db, e1.LstId, dirC); err != nil || got != nil {
+		t.Errorf("LocateLstEntity(1, dirC) with foreign .lst = %v, %v want nil", got, err)
+	}
+
+	// .lst 文件记录了该列表
+	if err := WriteLstFile(filepath.Join(dirC, e1.Name), e1.LstId); err != nil {
+		t.Fatal(err)
+	}
+	got, err = LocateLstEntity(db, e1.LstId, dirC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got == nil || got.Id != e1.Id || got.ParentDir != dirC {
+		t.Fatalf("LocateLstEntity(1, dirC) = %v want entity %d at %s", got, e1.Id.Int32, dirC)
+	}
+
+	// 没有 .lst 文件的目录在原目录消失后视为被移动
+	dirD := filepath.Join(root, "d")
+	if err := os.MkdirAll(filepath.Join(dirD, e2.Name), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(e2.Path()); err != nil {
+		t.Fatal(err)
+	}
+	got, err = LocateLstEntity(db, e2.LstId, dirD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got == nil || got.Id != e2.Id || got.ParentDir != dirD {
+		t.Errorf("LocateLstEntity(2, dirD) = %v want entity %d at %s", got, e2.Id.Int32, dirD)
+	}
+}
+
+func TestGetLstEntityByPath(t *testing.T) {
+	f := seedDB(t)
+
+	got, err := GetLstEntityByPath(db, f.lstEntity.ParentDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got == nil || withoutTimestamps(got) != withoutTimestamps(f.lstEntity) {
+		t.Errorf("GetLstEntityByPath() = %v want %v", got, f.lstEntity)
+	}
+
+	// 未清理的路径同样能匹配
+	got, err = GetLstEntityByPath(db, f.lstEntity.ParentDir+string(filepath.Separator)+".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got == nil || got.Id != f.lstEntity.Id {
+		t.Errorf("GetLstEntityByPath(unclean) = %v want %v", got, f.lstEntity)
+	}
+
+	got, err = GetLstEntityByPath(db, filepath.Join(f.root, "missing"))
+	if err != nil || got != nil {
+		t.Errorf("GetLstEntityByPath(missing) = %v, %v want nil, nil", got, err)
+	}
+
+	lst := &Lst{Id: 2, Name: "lst2", OwnerId: f.users[0].Id}
+	if err := CreateLst(db, lst); err != nil {
+		t.Fatal(err)
+	}
+	other := &LstEntity{LstId: int64(lst.Id), Name: "lst2", ParentDir: f.lstEntity.ParentDir}
+	if err := CreateLstEntity(db, other); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GetLstEntityByPath(db, f.lstEntity.ParentDir); err == nil {
+		t.Error("GetLstEntityByPath() with two lists under the same dir returned no error")
+	}
+}
+
+func TestGetUserEntityWatermark(t *testing.T) {
+	f := seedDB(t)
+	eid := int(f.userEntities[0].Id.Int32)
+
+	if _, ok, err := GetUserEntityWatermark(db, eid); err != nil || ok {
+		t.Errorf("GetUserEntityWatermark() of unsynced entity: ok = %v, err = %v want false, nil", ok, err)
+	}
+
+	want := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	if _, err := UpdateUserEntityTweetStat(db, eid, want, 1); err != nil {
+		t.Fatal(err)
+	}
+	got, ok, err := GetUserEntityWatermark(db, eid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || !got.Equal(want) {
+		t.Errorf("GetUserEntityWatermark() = %v, %v want %v, true", got, ok, want)
+	}
+
+	if _, ok, err := GetUserEntityWatermark(db, 9999); err != nil || ok {
+		t.Errorf("GetUserEntityWatermark(missing) ok = %v, err = %v want false, nil", ok, err)
+	}
+}
+
+func TestUserEntityCursor(t *testing.T) {
+	f := seedDB(t)
+	eid := int(f.userEntities[0].Id.Int32)
+
+	if cursor, err := GetUserEntityCursor(db, eid); err != nil || cursor != "" {
+		t.Errorf("GetUserEntityCursor() = %q, %v want empty", cursor, err)
+	}
+	if err := SetUserEntityCursor(db, eid, "DAABCgABF"); err != nil {
+		t.Fatal(err)
+	}
+	if cursor, err := GetUserEntityCursor(db, eid); err != nil || cursor != "DAABCgABF" {
+		t.Errorf("GetUserEntityCursor() = %q, %v want DAABCgABF", cursor, err)
+	}
+
+	// 重置进度时游标随之清除
+	if err := ResetUserEntityProgress(db, eid); err != nil {
+		t.Fatal(err)
+	}
+	if cursor, err := GetUserEntityCursor(db, eid); err != nil || cursor != "" {
+		t.Errorf("GetUserEntityCursor() after reset = %q, %v want empty", cursor, err)
+	}
+
+	if err := SetUserEntityCursor(db, eid, "next"); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetUserEntityCursor(db, eid, ""); err != nil {
+		t.Fatal(err)
+	}
+	got, err := GetUserEntity(db, eid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.LastCursor.Valid {
+		t.Errorf("LastCursor = %v want NULL after clearing", got.LastCursor)
+	}
+
+	if err := SetUserEntityCursor(db, 9999, "next"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("SetUserEntityCursor(missing) = %v want ErrNotFound", err)
+	}
+}
+
+func TestNormalizeStoredPaths(t *testing.T) {
+	f := seedDB(t)
+	uid := f.users[2].Id
+	dir := filepath.Join(f.root, "norm")
+
+	// 用未规范化的路径直接写入，模拟旧版本或手动编辑留下的记录
+	insert := `INSERT INTO user_entities(user_id, name, parent_dir) VALUES(?, ?, ?)`
+	res, err := db.Exec(insert, uid, "rel", "relative")
+	if err != nil {
+		t.Fatal(err)
+	}
+	relId, _ := res.LastInsertId()
+	res, err = db.Exec(insert, uid, "unclean", dir+string(filepath.Separator)+".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	uncleanId, _ := res.LastInsertId()
+	// 与 f.userEntities[0] 规范化后是同一目录
+	res, err = db.Exec(insert, f.userEntities[0].Uid, "dup", f.userEntities[0].ParentDir+string(filepath.Separator))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dupId, _ := res.LastInsertId()
+	_, err = db.Exec(`UPDATE lst_entities SET parent_dir=? WHERE id=?`, f.lstEntity.ParentDir+string(filepath.Separator)+".", f.lstEntity.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := NormalizeStoredPaths(db)
+	if !errors.Is(err, ErrDuplicatePath) {
+		t.Errorf("NormalizeStoredPaths() err = %v want ErrDuplicatePath", err)
+	}
+	if n != 3 {
+		t.Errorf("NormalizeStoredPaths() = %d want 3", n)
+	}
+
+	wantRel, _ := filepath.Abs("relative")
+	for id, want := range map[int64]string{
+		relId:     wantRel,
+		uncleanId: dir,
+		dupId:     f.userEntities[0].ParentDir + string(filepath.Separator),
+	} {
+		entity, err := GetUserEntity(db, int(id))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entity.ParentDir != want {
+			t.Errorf("entity %d parent_dir = %s want %s", id, entity.ParentDir, want)
+		}
+	}
+	if yes, err := hasSameLstEntityRecord(f.lstEntity); err != nil || !yes {
+		t.Errorf("lst entity parent_dir was not normalized, err: %v", err)
+	}
+
+	// 再次运行只报告仍然存在的冲突
+	n, err = NormalizeStoredPaths(db)
+	if n != 0 || !errors.Is(err, ErrDuplicatePath) {
+		t.Errorf("second NormalizeStoredPaths() = %d, %v want 0, ErrDuplicatePath", n, err)
+	}
+}
+
+func TestLibraryRootRebaseAndSearch(t *testing.T) {
+	tmp := t.TempDir()
+	root := filepath.Join(tmp, "library")
+	var err error
+	db, err = OpenDB(filepath.Join(tmp, "lib.db"), WithLibraryRoot(root))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	usr := generateUser(1)
+	if err := CreateUser(db, usr); err != nil {
+		t.Fatal(err)
+	}
+	entity := &UserEntity{Uid: usr.Id, Name: "entity", ParentDir: filepath.Join(root, "users")}
+	if err := CreateUserEntity(db, entity); err != nil {
+		t.Fatal(err)
+	}
+
+	// 存储的是相对路径，仍应按绝对路径匹配到
+	found, err := SearchEntitiesByPath(db, filepath.Base(root))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 1 || found[0].Id != entity.Id {
+		t.Errorf("SearchEntitiesByPath() = %v want entity %d", found, entity.Id.Int32)
+	}
+	matches, err := SearchAllEntitiesByPath(db, filepath.Base(root))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 1 || matches[0].ParentDir != entity.ParentDir {
+		t.Errorf("SearchAllEntitiesByPath() = %v want entity %d", matches, entity.Id.Int32)
+	}
+
+	// 跨越根目录与相对部分的子串，以及根目录外不匹配的实体
+	other := &UserEntity{Uid: usr.Id, Name: "other", ParentDir: filepath.Join(tmp, "outside")}
+	if err := CreateUserEntity(db, other); err != nil {
+		t.Fatal(err)
+	}
+	for _, substring := range []string{"library" + string(filepath.Separator) + "us", "RARY" + string(filepath.Separator), "users"} {
+		found, err := SearchEntitiesByPath(db, substring)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(found) != 1 || found[0].Id != entity.Id {
+			t.Errorf("SearchEntitiesByPath(%q) = %v want entity %d", substring, found, entity.Id.Int32)
+		}
+	}
+	found, err = SearchEntitiesByPath(db, "out%")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 0 {
+		t.Errorf("SearchEntitiesByPath(%q) = %v want none", "out%", found)
+	}
+
+	n, err := RebaseEntityPaths(db, filepath.Join(root, "users"), filepath.Join(root, "archive"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("RebaseEntityPaths() = %d want 1", n)
+	}
+	got, err := GetUserEntity(db, int(entity.Id.Int32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(root, "archive"); got.ParentDir != want {
+		t.Errorf("ParentDir after rebase = %s want %s", got.ParentDir, want)
+	}
+	var stored string
+	if err := db.Get(&stored, `SELECT parent_dir FROM user_entities WHERE id=?`, entity.Id); err != nil {
+		t.Fatal(err)
+	}
+	if stored != "archive" {
+		t.Errorf("stored parent_dir after rebase = %q want %q", stored, "archive")
+	}
 }
@@ -0,0 +1,29 @@
+package database
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// 记录实体下载 url 失败的原因，downloadErr 不能为 nil
+func RecordDownloadError(db *sqlx.DB, entityId int, tweetId uint64, url string, downloadErr error) error {
+	if downloadErr == nil {
+		return fmt.Errorf("no error to record for %s", url)
+	}
+	stmt := `INSERT INTO download_errors(entity_id, tweet_id, url, error, record_date) VALUES(?, ?, ?, ?, ?)`
+	_, err := execWithRetry(db, stmt, entityId, tweetId, url, downloadErr.Error(), time.Now())
+	return err
+}
+
+// 返回实体最近的下载错误，新的在前；limit <= 0 时不限制数量
+func GetRecentDownloadErrors(db *sqlx.DB, entityId int, limit int) ([]*DownloadError, error) {
+	if limit <= 0 {
+		limit = -1
+	}
+	stmt := `SELECT * FROM download_errors WHERE entity_id=? ORDER BY julianday(record_date) DESC, id DESC LIMIT ?`
+	res := []*DownloadError{}
+	err := db.Select(&res, stmt, entityId, limit)
+	return res, err
+}
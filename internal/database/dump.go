@@ -0,0 +1,172 @@
+package database
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type schemaObject struct {
+	Name string `db:"name"`
+	Sql  string `db:"sql"`
+}
+
+// DumpSQL 将表结构和所有数据导出为纯文本 SQL，可通过 `sqlite3 < dump.sql` 还原
+// 表按外键依赖顺序输出，被引用的表总在引用它的表之前
+// 同时导出 PRAGMA user_version，还原后的数据库不会被 Migrate 重复迁移
+func DumpSQL(db *sqlx.DB, w io.Writer) error {
+	return DumpSQLContext(context.Background(), db, w)
+}
+
+// 同 DumpSQL，ctx 的期限代替 WithTimeout 的默认期限
+func DumpSQLContext(ctx context.Context, db *sqlx.DB, w io.Writer) error {
+	tables, err := tablesInDependencyOrder(ctx, db)
+	if err != nil {
+		return err
+	}
+	var version int
+	if err := db.GetContext(ctx, &version, `PRAGMA user_version`); err != nil {
+		return err
+	}
+
+	others := []*schemaObject{}
+	stmt := `SELECT name, sql FROM sqlite_master WHERE type IN ('index', 'trigger') AND sql IS NOT NULL ORDER BY type, name`
+	if err := db.SelectContext(ctx, &others, stmt); err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "PRAGMA foreign_keys=OFF;")
+	fmt.Fprintln(bw, "BEGIN TRANSACTION;")
+	for _, table := range tables {
+		fmt.Fprintf(bw, "%s;\n", table.Sql)
+	}
+	for _, table := range tables {
+		if err := dumpTableRows(ctx, db, bw, table.Name); err != nil {
+			return err
+		}
+	}
+	for _, obj := range others {
+		fmt.Fprintf(bw, "%s;\n", obj.Sql)
+	}
+	fmt.Fprintf(bw, "PRAGMA user_version=%d;\n", version)
+	fmt.Fprintln(bw, "COMMIT;")
+	return bw.Flush()
+}
+
+func tablesInDependencyOrder(ctx context.Context, db *sqlx.DB) ([]*schemaObject, error) {
+	tables := []*schemaObject{}
+	stmt := `SELECT name, sql FROM sqlite_master WHERE type='table' AND name NOT LIKE 'sqlite_%' ORDER BY rowid`
+	if err := db.SelectContext(ctx, &tables, stmt); err != nil {
+		return nil, err
+	}
+
+	deps := make(map[string][]string)
+	for _, table := range tables {
+		refs := []string{}
+		if err := db.SelectContext(ctx, &refs, `SELECT DISTINCT "table" FROM pragma_foreign_key_list(?)`, table.Name); err != nil {
+			return nil, err
+		}
+		deps[table.Name] = refs
+	}
+
+	// 拓扑排序，忽略自引用和指向不存在的表的外键
+	byName := make(map[string]*schemaObject)
+	for _, table := range tables {
+		byName[table.Name] = table
+	}
+	visited := make(map[string]bool)
+	ordered := make([]*schemaObject, 0, len(tables))
+	var visit func(name string)
+	visit = func(name string) {
+		if visited[name] {
+			return
+		}
+		visited[name] = true
+		for _, ref := range deps[name] {
+			if _, ok := byName[ref]; ok && ref != name {
+				visit(ref)
+			}
+		}
+		ordered = append(ordered, byName[name])
+	}
+	for _, table := range tables {
+		visit(table.Name)
+	}
+	return ordered, nil
+}
+
+func dumpTableRows(ctx context.Context, db *sqlx.DB, w io.Writer, table string) error {
+	cols := []string{}
+	if err := db.SelectContext(ctx, &cols, `SELECT name FROM pragma_table_info(?) ORDER BY cid`, table); err != nil {
+		return err
+	}
+	quotedCols := make([]string, len(cols))
+	exprs := make([]string, len(cols))
+	for i, col := range cols {
+		quotedCols[i] = quoteIdent(col)
+		// 驱动按声明的类型把 DATE/DATETIME 列转换为 time.Time，再输出时格式会改变（如 DATE 多出时间部分）
+		// 一元 + 不改变值，但结果没有声明的类型，读出的是存储的原始值
+		exprs[i] = "+" + quotedCols[i]
+	}
+	rows, err := db.QueryxContext(ctx, fmt.Sprintf("SELECT %s FROM %s", strings.Join(exprs, ","), quoteIdent(table)))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	prefix := fmt.Sprintf("INSERT INTO %s(%s) VALUES(", quoteIdent(table), strings.Join(quotedCols, ","))
+
+	values := make([]any, len(cols))
+	ptrs := make([]any, len(cols))
+	for i := range values {
+		ptrs[i] = &values[i]
+	}
+	literals := make([]string, len(cols))
+	for rows.Next() {
+		if err := rows.Scan(ptrs...); err != nil {
+			return err
+		}
+		for i, v := range values {
+			literals[i], err = sqlLiteral(v)
+			if err != nil {
+				return fmt.Errorf("%s.%s: %v", table, cols[i], err)
+			}
+		}
+		if _, err := fmt.Fprintf(w, "%s%s);\n", prefix, strings.Join(literals, ",")); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func quoteIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+func quoteString(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+func sqlLiteral(v any) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "NULL", nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64), nil
+	case string:
+		return quoteString(v), nil
+	case []byte:
+		return "X'" + hex.EncodeToString(v) + "'", nil
+	default:
+		return "", fmt.Errorf("unsupported value type %T", v)
+	}
+}
@@ -0,0 +1,58 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/mattn/go-sqlite3"
+)
+
+var (
+	// Get* 函数仅在使用 WithNotFoundError 打开数据库时返回此错误，修改操作找不到记录时总是返回
+	ErrNotFound            = errors.New("record not found")
+	ErrDuplicateScreenName = errors.New("screen name already exists")
+	ErrDuplicatePath       = errors.New("entity already exists at this path")
+	ErrDuplicateLink       = errors.New("user is already linked under this lst entity")
+	ErrConstraint          = errors.New("constraint violation")
+	// 通过 OpenDBReadOnly 打开的连接执行写语句
+	ErrReadOnly = errors.New("database is opened read-only")
+	// 设置了 WithEncryptionKey，但链接的 SQLite 不是 SQLCipher，无法加密
+	ErrEncryptionUnsupported = errors.New("sqlite driver does not support encryption, build with SQLCipher")
+)
+
+// 将驱动返回的约束错误和只读错误包装为对应的哨兵错误，原始错误仍可通过 errors.As 获取
+func wrapErr(err error) error {
+	var sqliteErr sqlite3.Error
+	if !errors.As(err, &sqliteErr) {
+		return err
+	}
+	if sqliteErr.Code == sqlite3.ErrReadonly {
+		return fmt.Errorf("%w: %w", ErrReadOnly, err)
+	}
+	if sqliteErr.Code != sqlite3.ErrConstraint {
+		return err
+	}
+
+	// 错误信息形如 "UNIQUE constraint failed: users.screen_name"
+	msg := sqliteErr.Error()
+	switch {
+	case sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique && strings.Contains(msg, "users.screen_name"):
+		return fmt.Errorf("%w: %w", ErrDuplicateScreenName, err)
+	case sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique && strings.Contains(msg, ".parent_dir"):
+		return fmt.Errorf("%w: %w", ErrDuplicatePath, err)
+	case sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique && strings.Contains(msg, "user_links.parent_lst_entity_id"):
+		return fmt.Errorf("%w: %w", ErrDuplicateLink, err)
+	default:
+		return fmt.Errorf("%w: %w", ErrConstraint, err)
+	}
+}
+
+// 记录不存在时 Get* 函数应返回的错误，默认为 nil
+func notFoundErr(db *sqlx.DB) error {
+	if optionsOf(db).notFoundErr {
+		return ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,505 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// 将占位用户的实体、链接、曾用名、关注数历史等记录转移到真实用户并删除占位用户
+// 若真实用户在同一目录已有实体（或在同一列表实体下已有链接），保留真实用户的记录
+// 真实用户不存在时返回 ErrNotFound
+func MergePlaceholderIntoUser(db *sqlx.DB, placeholderId, realId uint64) error {
+	if placeholderId == realId {
+		return fmt.Errorf("cannot merge user %d into itself", realId)
+	}
+
+	return withRetry(optionsOf(db), func() error {
+		return WithTx(db, func(tx *Tx) error {
+			var exists bool
+			if err := tx.Get(&exists, `SELECT EXISTS(SELECT 1 FROM users WHERE id=?)`, realId); err != nil {
+				return err
+			}
+			if !exists {
+				return fmt.Errorf("%w: user %d", ErrNotFound, realId)
+			}
+
+			stmts := []string{
+				`UPDATE OR IGNORE user_entities SET user_id=:real, updated_at=CURRENT_TIMESTAMP WHERE user_id=:placeholder`,
+				`DELETE FROM user_entities WHERE user_id=:placeholder`,
+				`UPDATE OR IGNORE user_links SET user_id=:real WHERE user_id=:placeholder`,
+				`DELETE FROM user_links WHERE user_id=:placeholder`,
+				`UPDATE user_previous_names SET uid=:real WHERE uid=:placeholder`,
+				`UPDATE OR IGNORE user_friends_history SET uid=:real WHERE uid=:placeholder`,
+				`DELETE FROM user_friends_history WHERE uid=:placeholder`,
+				`UPDATE watchlist SET resolved_uid=:real WHERE resolved_uid=:placeholder`,
+				`UPDATE OR IGNORE user_tags SET uid=:real WHERE uid=:placeholder`,
+				`DELETE FROM user_tags WHERE uid=:placeholder`,
+				`DELETE FROM users WHERE id=:placeholder`,
+			}
+			args := map[string]any{"real": realId, "placeholder": placeholderId}
+			for _, stmt := range stmts {
+				if _, err := tx.NamedExec(stmt, args); err != nil {
+					return wrapErr(err)
+				}
+			}
+			return nil
+		})
+	})
+}
+
+// 查找同一用户的多个用户实体，按 user_id 分组
+func FindDuplicateUserEntities(db *sqlx.DB) (map[uint64][]*UserEntity, error) {
+	stmt := `SELECT * FROM user_entities WHERE user_id IN (
+		SELECT user_id FROM user_entities GROUP BY user_id HAVING COUNT(*) > 1)
+		ORDER BY user_id, id`
+	entities := []*UserEntity{}
+	if err := db.Select(&entities, stmt); err != nil {
+		return nil, err
+	}
+
+	resolveUserEntities(optionsOf(db), entities...)
+	res := make(map[uint64][]*UserEntity)
+	for _, entity := range entities {
+		res[entity.Uid] = append(res[entity.Uid], entity)
+	}
+	return res, nil
+}
+
+// 将用户实体和列表实体中未规范化的 parent_dir（相对路径或未清理的路径）改写为规范化后的值，返回改写的实体数
+// 规范化后与同一用户或列表的其他实体冲突的行保持不变，所有冲突以包装了 ErrDuplicatePath 的错误一并返回，
+// 此时其余行的改写仍会提交；相对路径按当前工作目录解析，设置了库根目录时按库根目录解析
+func NormalizeStoredPaths(db *sqlx.DB) (int, error) {
+	o := optionsOf(db)
+	n := 0
+	var conflicts []error
+	err := withRetry(o, func() error {
+		n, conflicts = 0, nil
+		return WithTx(db, func(tx *Tx) error {
+			for _, table := range []string{"user_entities", "lst_entities"} {
+				rows := []struct {
+					Id        int    `db:"id"`
+					ParentDir string `db:"parent_dir"`
+				}{}
+				if err := tx.Select(&rows, `SELECT id, parent_dir FROM `+table+` ORDER BY id`); err != nil {
+					return err
+				}
+				for _, row := range rows {
+					_, stored, err := storedPath(o, resolvePath(o, row.ParentDir))
+					if err != nil {
+						return err
+					}
+					if stored == row.ParentDir {
+						continue
+					}
+					// 约束失败只回滚这一条语句，事务中的其他改写不受影响
+					stmt := `UPDATE ` + table + ` SET parent_dir=?, updated_at=CURRENT_TIMESTAMP WHERE id=?`
+					if _, err := tx.Exec(stmt, stored, row.Id); err != nil {
+						err = wrapErr(err)
+						if !errors.Is(err, ErrDuplicatePath) {
+							return err
+						}
+						conflicts = append(conflicts, fmt.Errorf("%s %d: %q -> %q: %w", table, row.Id, row.ParentDir, stored, err))
+						continue
+					}
+					n++
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, errors.Join(conflicts...)
+}
+
+// 删除同一用户指向同一目录的重复实体，返回删除的实体数
+// parent_dir 规范化后相同（与 parent_dir 一致，不区分 ASCII 大小写）即视为同一目录，
+// 每组保留 media_count 最大的实体，相同时保留 latest_release_time 最晚的，再相同时保留 id 最小的；
+// 保留的实体的 parent_dir 改写为规范化后的值。被删除实体的下载失败记录随之删除
+func DeduplicateUserEntities(db *sqlx.DB) (int, error) {
+	o := optionsOf(db)
+	n := 0
+	err := withRetry(o, func() error {
+		n = 0
+		return WithTx(db, func(tx *Tx) error {
+			entities := []*UserEntity{}
+			if err := tx.Select(&entities, `SELECT * FROM user_entities ORDER BY id`); err != nil {
+				return err
+			}
+
+			type key struct {
+				uid uint64
+				dir string
+			}
+			groups := make(map[key][]*UserEntity)
+			keys := []key{}
+			stored := make(map[*UserEntity]string)
+			for _, entity := range entities {
+				_, dir, err := storedPath(o, resolvePath(o, entity.ParentDir))
+				if err != nil {
+					return err
+				}
+				stored[entity] = dir
+				k := key{entity.Uid, asciiLower(dir)}
+				if _, ok := groups[k]; !ok {
+					keys = append(keys, k)
+				}
+				groups[k] = append(groups[k], entity)
+			}
+
+			for _, k := range keys {
+				group := groups[k]
+				keep := group[0]
+				for _, entity := range group[1:] {
+					if richerEntity(entity, keep) {
+						keep = entity
+					}
+				}
+				for _, entity := range group {
+					if entity == keep {
+						continue
+					}
+					if _, err := tx.Exec(`DELETE FROM user_entities WHERE id=?`, entity.Id); err != nil {
+						return err
+					}
+					n++
+				}
+				if keep.ParentDir != stored[keep] {
+					stmt := `UPDATE user_entities SET parent_dir=?, updated_at=CURRENT_TIMESTAMP WHERE id=?`
+					if _, err := tx.Exec(stmt, stored[keep], keep.Id); err != nil {
+						return wrapErr(err)
+					}
+				}
+			}
+			return nil
+		})
+	})
+	return n, err
+}
+
+// a 的下载记录是否比 b 更完整，两者相同时保留先创建的 b
+func richerEntity(a, b *UserEntity) bool {
+	if a.MediaCount != b.MediaCount {
+		return a.MediaCount > b.MediaCount
+	}
+	if a.LatestReleaseTime.Valid != b.LatestReleaseTime.Valid {
+		return a.LatestReleaseTime.Valid
+	}
+	return a.LatestReleaseTime.Time.After(b.LatestReleaseTime.Time)
+}
+
+// 与 SQLite 的 NOCASE 一致，只转换 ASCII 字母
+func asciiLower(s string) string {
+	return strings.Map(func(r rune) rune {
+		if 'A' <= r && r <= 'Z' {
+			return r + 'a' - 'A'
+		}
+		return r
+	}, s)
+}
+
+// 将 mergeIds 指定的实体合并到 keepId：media_count 取最大值（各类型数量随之取自同一实体），latest_release_time 取最晚值，
+// total_bytes 累加，下载失败记录转移到 keepId，随后删除被合并的实体
+// 所有实体必须属于同一用户
+func MergeUserEntities(db *sqlx.DB, keepId int, mergeIds []int) error {
+	return withRetry(optionsOf(db), func() error {
+		return WithTx(db, func(tx *Tx) error {
+			keep, err := getUserEntityForMerge(tx, keepId)
+			if err != nil {
+				return err
+			}
+
+			for _, id := range mergeIds {
+				if id == keepId {
+					continue
+				}
+				merged, err := getUserEntityForMerge(tx, id)
+				if err != nil {
+					return err
+				}
+				if merged.Uid != keep.Uid {
+					return fmt.Errorf("user entity %d belongs to user %d, not %d", id, merged.Uid, keep.Uid)
+				}
+
+				if merged.MediaCount > keep.MediaCount {
+					keep.MediaCount = merged.MediaCount
+					keep.PhotoCount, keep.VideoCount, keep.GifCount = merged.PhotoCount, merged.VideoCount, merged.GifCount
+				}
+				if merged.LatestReleaseTime.Valid && (!keep.LatestReleaseTime.Valid || merged.LatestReleaseTime.Time.After(keep.LatestReleaseTime.Time)) {
+					keep.LatestReleaseTime = merged.LatestReleaseTime
+				}
+				keep.TotalBytes += merged.TotalBytes
+				// 删除实体会级联删除其下载失败记录
+				if _, err := tx.Exec(`UPDATE download_errors SET entity_id=? WHERE entity_id=?`, keepId, id); err != nil {
+					return wrapErr(err)
+				}
+				if _, err := tx.Exec(`DELETE FROM user_entities WHERE id=?`, id); err != nil {
+					return wrapErr(err)
+				}
+			}
+
+			stmt := `UPDATE user_entities SET latest_release_time=?, media_count=?, photo_count=?, video_count=?, gif_count=?, total_bytes=?, updated_at=CURRENT_TIMESTAMP WHERE id=?`
+			if _, err := tx.Exec(stmt, keep.LatestReleaseTime, keep.MediaCount, keep.PhotoCount, keep.VideoCount, keep.GifCount, keep.TotalBytes, keepId); err != nil {
+				return wrapErr(err)
+			}
+			return nil
+		})
+	})
+}
+
+func getUserEntityForMerge(tx *Tx, id int) (*UserEntity, error) {
+	entity := &UserEntity{}
+	err := tx.Get(entity, `SELECT * FROM user_entities WHERE id=?`, id)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: user entity %d", ErrNotFound, id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user entity %d: %w", id, err)
+	}
+	return entity, nil
+}
+
+// 返回 parent_dir 在磁盘上已不存在的用户实体，只读，不做任何迁移
+func ListMissingUserEntities(db *sqlx.DB) ([]*UserEntity, error) {
+	entities := []*UserEntity{}
+	if err := db.Select(&entities, `SELECT * FROM user_entities ORDER BY id`); err != nil {
+		return nil, err
+	}
+
+	resolveUserEntities(optionsOf(db), entities...)
+	res := []*UserEntity{}
+	for _, entity := range entities {
+		if _, err := os.Stat(entity.ParentDir); err != nil {
+			res = append(res, entity)
+		}
+	}
+	return res, nil
+}
+
+// 检查每个用户实体的目录（parent_dir/name）中是否有记录了其 user_id 的 .user 文件，返回所有不符合的实体，只读
+// 路径迁移依赖 .user 文件判断目录属于哪个用户，有问题的实体可能被错误地迁移或无法被找回
+func VerifyUserFiles(db *sqlx.DB) ([]UserFileIssue, error) {
+	res := []UserFileIssue{}
+	err := IterUserEntities(db, func(entity *UserEntity) error {
+		uid, err := ReadUserFile(filepath.Join(entity.ParentDir, entity.Name))
+		switch {
+		case os.IsNotExist(err):
+			res = append(res, UserFileIssue{Entity: entity, Problem: UserFileMissing})
+		case err != nil:
+			res = append(res, UserFileIssue{Entity: entity, Problem: UserFileUnreadable, Err: err})
+		case uid != entity.Uid:
+			res = append(res, UserFileIssue{Entity: entity, Problem: UserFileWrongUid, RecordedUid: uid})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// 将 oldRoot 下所有用户实体和列表实体的 parent_dir 前缀替换为 newRoot，返回更新的行数
+// 路径按 parent_dir 的 NOCASE 规则（不区分 ASCII 大小写）匹配，只处理等于 oldRoot 或位于其子目录中的记录
+// 设置了库根目录时按解析后的绝对路径匹配，改写后的路径仍按库根目录存储
+func RebaseEntityPaths(db *sqlx.DB, oldRoot, newRoot string) (int, error) {
+	oldRoot, err := normalizePath(oldRoot)
+	if err != nil {
+		return 0, err
+	}
+	newRoot, err = normalizePath(newRoot)
+	if err != nil {
+		return 0, err
+	}
+
+	sep := string(filepath.Separator)
+	oldPrefix := strings.TrimSuffix(oldRoot, sep) + sep
+	newPrefix := strings.TrimSuffix(newRoot, sep) + sep
+	lowerRoot, lowerPrefix := asciiLower(oldRoot), asciiLower(oldPrefix)
+
+	o := optionsOf(db)
+	n := 0
+	err = withRetry(o, func() error {
+		n = 0
+		return WithTx(db, func(tx *Tx) error {
+			for _, table := range []string{"user_entities", "lst_entities"} {
+				rows := []struct {
+					Id        int    `db:"id"`
+					ParentDir string `db:"parent_dir"`
+				}{}
+				if err := tx.Select(&rows, `SELECT id, parent_dir FROM `+table+` ORDER BY id`); err != nil {
+					return err
+				}
+				for _, row := range rows {
+					// asciiLower 不改变字节长度，可以直接按 oldPrefix 的长度截取
+					abs := resolvePath(o, row.ParentDir)
+					var rebased string
+					switch lower := asciiLower(abs); {
+					case lower == lowerRoot:
+						rebased = newRoot
+					case strings.HasPrefix(lower, lowerPrefix):
+						rebased = newPrefix + abs[len(oldPrefix):]
+					default:
+						continue
+					}
+					_, stored, err := storedPath(o, rebased)
+					if err != nil {
+						return err
+					}
+					stmt := `UPDATE ` + table + ` SET parent_dir=?, updated_at=CURRENT_TIMESTAMP WHERE id=?`
+					if _, err := tx.Exec(stmt, stored, row.Id); err != nil {
+						return wrapErr(err)
+					}
+					n++
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// 每个用户只保留 record_date 最晚的 keepPerUser 条曾用名记录，返回删除的记录数
+func PrunePreviousNames(db *sqlx.DB, keepPerUser int) (int, error) {
+	if keepPerUser < 0 {
+		return 0, fmt.Errorf("keepPerUser must not be negative: %d", keepPerUser)
+	}
+
+	stmt := `DELETE FROM user_previous_names WHERE id IN (
+		SELECT id FROM (
+			SELECT id, ROW_NUMBER() OVER (PARTITION BY uid ORDER BY julianday(record_date) DESC, id DESC) AS rn
+			FROM user_previous_names)
+		WHERE rn > ?)`
+	n := 0
+	err := withRetry(optionsOf(db), func() error {
+		return WithTx(db, func(tx *Tx) error {
+			res, err := tx.Exec(stmt, keepPerUser)
+			if err != nil {
+				return err
+			}
+			affected, err := res.RowsAffected()
+			n = int(affected)
+			return err
+		})
+	})
+	return n, err
+}
+
+// 用户实体和列表实体使用的所有 parent_dir，按 NOCASE 去重
+func DistinctParentDirs(db *sqlx.DB) ([]string, error) {
+	stmt := `SELECT parent_dir FROM user_entities UNION SELECT parent_dir FROM lst_entities ORDER BY 1`
+	res := []string{}
+	if err := db.Select(&res, stmt); err != nil {
+		return nil, err
+	}
+	o := optionsOf(db)
+	for i, dir := range res {
+		res[i] = resolvePath(o, dir)
+	}
+	return res, nil
+}
+
+// 按根目录对 DistinctParentDirs 分组：不位于其他 parent_dir 之下的目录为根，
+// 值为该根目录及其下的所有 parent_dir。与 parent_dir 一致，比较时不区分 ASCII 大小写
+func GroupParentDirsByRoot(db *sqlx.DB) (map[string][]string, error) {
+	dirs, err := DistinctParentDirs(db)
+	if err != nil {
+		return nil, err
+	}
+
+	// 排序后父目录总在其子目录之前
+	sort.Slice(dirs, func(i, j int) bool {
+		return asciiLower(dirs[i]) < asciiLower(dirs[j])
+	})
+
+	sep := string(filepath.Separator)
+	res := make(map[string][]string)
+	roots := []string{}
+	for _, dir := range dirs {
+		root := dir
+		for _, r := range roots {
+			if strings.HasPrefix(asciiLower(dir), asciiLower(strings.TrimSuffix(r, sep)+sep)) {
+				root = r
+				break
+			}
+		}
+		if root == dir {
+			roots = append(roots, dir)
+		}
+		res[root] = append(res[root], dir)
+	}
+	return res, nil
+}
+
+type foreignKeyViolation struct {
+	Table  string        `db:"table"`
+	RowId  sql.NullInt64 `db:"rowid"`
+	Parent string        `db:"parent"`
+	FkId   int           `db:"fkid"`
+}
+
+// 运行 integrity_check 和 foreign_key_check，数据库有问题时返回列出所有问题的错误
+func CheckIntegrity(db *sqlx.DB) error {
+	return CheckIntegrityContext(context.Background(), db)
+}
+
+// 同 CheckIntegrity，ctx 的期限代替 WithTimeout 的默认期限
+func CheckIntegrityContext(ctx context.Context, db *sqlx.DB) error {
+	results := []string{}
+	if err := db.SelectContext(ctx, &results, `PRAGMA integrity_check`); err != nil {
+		return err
+	}
+	problems := []string{}
+	for _, result := range results {
+		if result != "ok" {
+			problems = append(problems, result)
+		}
+	}
+
+	violations := []*foreignKeyViolation{}
+	if err := db.SelectContext(ctx, &violations, `PRAGMA foreign_key_check`); err != nil {
+		return err
+	}
+	for _, v := range violations {
+		problems = append(problems, fmt.Sprintf("row %d in %s references a missing row in %s", v.RowId.Int64, v.Table, v.Parent))
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	return fmt.Errorf("database integrity check failed with %d problem(s):\n%s", len(problems), strings.Join(problems, "\n"))
+}
+
+// 回收已删除记录占用的空间并更新查询优化器的统计信息
+// VACUUM 不能在事务中执行，且需要独占数据库：调用前应确保没有其他协程正在读写，
+// 否则会因数据库被锁定而失败。两条语句在同一连接上依次执行，不会同时占用其他连接
+func Vacuum(db *sqlx.DB) error {
+	return VacuumContext(context.Background(), db)
+}
+
+// 同 Vacuum，但在 ctx 结束时中断；不受 WithTimeout 的默认期限限制
+func VacuumContext(ctx context.Context, db *sqlx.DB) error {
+	ctx = WithoutTimeout(ctx)
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, `VACUUM`); err != nil {
+		return err
+	}
+	_, err = conn.ExecContext(ctx, `ANALYZE`)
+	return err
+}
@@ -0,0 +1,204 @@
+package database
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// 对 schema 的增量修改，按顺序追加，不要修改已发布的迁移
+// PRAGMA user_version 记录已应用的迁移数量
+var migrations = []string{
+	// 1: 待追踪用户
+	`CREATE TABLE IF NOT EXISTS watchlist (
+		screen_name VARCHAR NOT NULL COLLATE NOCASE,
+		added_at DATETIME NOT NULL,
+		resolved_uid INTEGER,
+		PRIMARY KEY (screen_name),
+		FOREIGN KEY(resolved_uid) REFERENCES users (id)
+	);`,
+	// 2: 关注数历史
+	`CREATE TABLE IF NOT EXISTS user_friends_history (
+		id INTEGER NOT NULL,
+		uid INTEGER NOT NULL,
+		friends_count INTEGER NOT NULL,
+		record_date DATE NOT NULL,
+		PRIMARY KEY (id),
+		UNIQUE (uid, record_date, friends_count),
+		FOREIGN KEY(uid) REFERENCES users (id)
+	);`,
+	// 3: 按更新时间筛选和按用户查找实体
+	`CREATE INDEX IF NOT EXISTS idx_user_entities_latest_release ON user_entities (latest_release_time);
+	CREATE INDEX IF NOT EXISTS idx_user_entities_user_id ON user_entities (user_id);`,
+	// 4: 下载失败记录，随实体一同删除
+	`CREATE TABLE IF NOT EXISTS download_errors (
+		id INTEGER NOT NULL,
+		entity_id INTEGER NOT NULL,
+		tweet_id INTEGER NOT NULL,
+		url VARCHAR NOT NULL,
+		error VARCHAR NOT NULL,
+		record_date DATETIME NOT NULL,
+		PRIMARY KEY (id),
+		FOREIGN KEY(entity_id) REFERENCES user_entities (id) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS idx_download_errors_entity_id ON download_errors (entity_id);`,
+	// 5: 按媒体类型统计的下载数量，由 UpdateUserEntityMediaBreakdown 写入
+	`ALTER TABLE user_entities ADD COLUMN photo_count INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE user_entities ADD COLUMN video_count INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE user_entities ADD COLUMN gif_count INTEGER NOT NULL DEFAULT 0;`,
+	// 6: 记录创建时间
+	// ALTER TABLE 添加的列不能以 CURRENT_TIMESTAMP 为默认值，改由触发器在插入后填充，迁移前已有的记录保持为空
+	`ALTER TABLE users ADD COLUMN created_at DATETIME;
+	CREATE TRIGGER IF NOT EXISTS users_created_at AFTER INSERT ON users WHEN NEW.created_at IS NULL
+	BEGIN
+		UPDATE users SET created_at = CURRENT_TIMESTAMP WHERE id = NEW.id;
+	END;
+	ALTER TABLE lsts ADD COLUMN created_at DATETIME;
+	CREATE TRIGGER IF NOT EXISTS lsts_created_at AFTER INSERT ON lsts WHEN NEW.created_at IS NULL
+	BEGIN
+		UPDATE lsts SET created_at = CURRENT_TIMESTAMP WHERE id = NEW.id;
+	END;
+	ALTER TABLE lst_entities ADD COLUMN created_at DATETIME;
+	CREATE TRIGGER IF NOT EXISTS lst_entities_created_at AFTER INSERT ON lst_entities WHEN NEW.created_at IS NULL
+	BEGIN
+		UPDATE lst_entities SET created_at = CURRENT_TIMESTAMP WHERE id = NEW.id;
+	END;
+	ALTER TABLE user_entities ADD COLUMN created_at DATETIME;
+	CREATE TRIGGER IF NOT EXISTS user_entities_created_at AFTER INSERT ON user_entities WHEN NEW.created_at IS NULL
+	BEGIN
+		UPDATE user_entities SET created_at = CURRENT_TIMESTAMP WHERE id = NEW.id;
+	END;
+	ALTER TABLE user_links ADD COLUMN created_at DATETIME;
+	CREATE TRIGGER IF NOT EXISTS user_links_created_at AFTER INSERT ON user_links WHEN NEW.created_at IS NULL
+	BEGIN
+		UPDATE user_links SET created_at = CURRENT_TIMESTAMP WHERE id = NEW.id;
+	END;`,
+	// 7: 已下载文件的总字节数
+	`ALTER TABLE user_entities ADD COLUMN total_bytes INTEGER NOT NULL DEFAULT 0;`,
+	// 8: 最后修改时间，由修改实体的语句设置，从未修改过的记录为空
+	`ALTER TABLE user_entities ADD COLUMN updated_at DATETIME;
+	ALTER TABLE lst_entities ADD COLUMN updated_at DATETIME;`,
+	// 9: media_count 改为 NOT NULL DEFAULT 0，已有的 NULL 视为 0
+	// SQLite 不能修改列的约束，只能重建表，列的顺序与重建前一致
+	`CREATE TABLE user_entities_new (
+		id INTEGER NOT NULL,
+		user_id INTEGER NOT NULL,
+		name VARCHAR NOT NULL,
+		latest_release_time DATETIME,
+		parent_dir VARCHAR COLLATE NOCASE NOT NULL,
+		media_count INTEGER NOT NULL DEFAULT 0,
+		photo_count INTEGER NOT NULL DEFAULT 0,
+		video_count INTEGER NOT NULL DEFAULT 0,
+		gif_count INTEGER NOT NULL DEFAULT 0,
+		created_at DATETIME,
+		total_bytes INTEGER NOT NULL DEFAULT 0,
+		updated_at DATETIME,
+		PRIMARY KEY (id),
+		UNIQUE (user_id, parent_dir),
+		FOREIGN KEY(user_id) REFERENCES users (id)
+	);
+	INSERT INTO user_entities_new(id, user_id, name, latest_release_time, parent_dir, media_count,
+		photo_count, video_count, gif_count, created_at, total_bytes, updated_at)
+	SELECT id, user_id, name, latest_release_time, parent_dir, COALESCE(media_count, 0),
+		photo_count, video_count, gif_count, created_at, total_bytes, updated_at FROM user_entities;
+	DROP TABLE user_entities;
+	ALTER TABLE user_entities_new RENAME TO user_entities;
+	CREATE INDEX IF NOT EXISTS idx_user_entities_latest_release ON user_entities (latest_release_time);
+	CREATE INDEX IF NOT EXISTS idx_user_entities_user_id ON user_entities (user_id);
+	CREATE TRIGGER IF NOT EXISTS user_entities_created_at AFTER INSERT ON user_entities WHEN NEW.created_at IS NULL
+	BEGIN
+		UPDATE user_entities SET created_at = CURRENT_TIMESTAMP WHERE id = NEW.id;
+	END;`,
+	// 10: 用户标签，与 Twitter 列表无关的分组方式；标签或用户被删除时关联随之删除
+	`CREATE TABLE IF NOT EXISTS tags (
+		id INTEGER NOT NULL,
+		name VARCHAR NOT NULL COLLATE NOCASE,
+		PRIMARY KEY (id),
+		UNIQUE (name)
+	);
+	CREATE TABLE IF NOT EXISTS user_tags (
+		uid INTEGER NOT NULL,
+		tag_id INTEGER NOT NULL,
+		PRIMARY KEY (uid, tag_id),
+		FOREIGN KEY(uid) REFERENCES users (id) ON DELETE CASCADE,
+		FOREIGN KEY(tag_id) REFERENCES tags (id) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS idx_user_tags_tag_id ON user_tags (tag_id);`,
+	// 11: 按修改时间增量查询实体
+	`CREATE INDEX IF NOT EXISTS idx_user_entities_updated_at ON user_entities (updated_at);`,
+	// 12: 暂停下载的实体，保留其下载进度
+	`ALTER TABLE user_entities ADD COLUMN paused BOOLEAN NOT NULL DEFAULT 0;`,
+	// 13: 实体已下载文件集合的校验值，由调用方计算
+	`ALTER TABLE user_entities ADD COLUMN content_hash VARCHAR;`,
+	// 14: 上次同步停止时的分页游标，中断后从此处继续
+	`ALTER TABLE user_entities ADD COLUMN last_cursor VARCHAR;`,
+	// 15: 创建实体也算作修改，插入时由触发器填充 updated_at；已有的从未修改过的实体取其创建时间
+	`CREATE TRIGGER IF NOT EXISTS user_entities_updated_at AFTER INSERT ON user_entities WHEN NEW.updated_at IS NULL
+	BEGIN
+		UPDATE user_entities SET updated_at = CURRENT_TIMESTAMP WHERE id = NEW.id;
+	END;
+	CREATE TRIGGER IF NOT EXISTS lst_entities_updated_at AFTER INSERT ON lst_entities WHEN NEW.updated_at IS NULL
+	BEGIN
+		UPDATE lst_entities SET updated_at = CURRENT_TIMESTAMP WHERE id = NEW.id;
+	END;
+	UPDATE user_entities SET updated_at = created_at WHERE updated_at IS NULL;
+	UPDATE lst_entities SET updated_at = created_at WHERE updated_at IS NULL;`,
+}
+
+func Migrate(db *sqlx.DB) error {
+	if _, err := db.Exec(schema); err != nil {
+		return err
+	}
+
+	var version int
+	if err := db.Get(&version, `PRAGMA user_version`); err != nil {
+		return err
+	}
+	if version >= len(migrations) {
+		return nil
+	}
+
+	// 重建表时必须关闭外键约束，否则 DROP TABLE 会级联删除 download_errors 等引用它的记录
+	// PRAGMA foreign_keys 在事务中不起作用，因此在同一连接上于事务外关闭，迁移结束后恢复
+	// 迁移可能耗时较长，不受 WithTimeout 的默认期限限制
+	ctx := WithoutTimeout(context.Background())
+	conn, err := db.Connx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	var foreignKeys bool
+	if err := conn.GetContext(ctx, &foreignKeys, `PRAGMA foreign_keys`); err != nil {
+		return err
+	}
+	if foreignKeys {
+		if _, err := conn.ExecContext(ctx, `PRAGMA foreign_keys=OFF`); err != nil {
+			return err
+		}
+		defer conn.ExecContext(ctx, `PRAGMA foreign_keys=ON`)
+	}
+
+	for ; version < len(migrations); version++ {
+		if err := applyMigration(ctx, conn, version); err != nil {
+			return fmt.Errorf("failed to apply migration %d: %v", version+1, err)
+		}
+	}
+	return nil
+}
+
+func applyMigration(ctx context.Context, conn *sqlx.Conn, index int) error {
+	tx, err := conn.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, migrations[index]); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf(`PRAGMA user_version = %d`, index+1)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -4,25 +4,82 @@ import (
 	"database/sql"
 	"fmt"
 	"path/filepath"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 )
 
 type User struct {
-	Id           uint64 `db:"id"`
-	ScreenName   string `db:"screen_name"`
-	Name         string `db:"name"`
-	IsProtected  bool   `db:"protected"`
-	FriendsCount int    `db:"friends_count"`
+	Id           uint64       `db:"id"`
+	ScreenName   string       `db:"screen_name"`
+	Name         string       `db:"name"`
+	IsProtected  bool         `db:"protected"`
+	FriendsCount int          `db:"friends_count"`
+	CreatedAt    sql.NullTime `db:"created_at"`
 }
 
 type UserEntity struct {
-	Id                sql.NullInt32 `db:"id"`
-	Uid               uint64        `db:"user_id"`
-	Name              string        `db:"name"`
-	LatestReleaseTime sql.NullTime  `db:"latest_release_time"`
-	ParentDir         string        `db:"parent_dir"`
-	MediaCount        sql.NullInt32 `db:"media_count"`
+	Id                sql.NullInt32  `db:"id"`
+	Uid               uint64         `db:"user_id"`
+	Name              string         `db:"name"`
+	LatestReleaseTime sql.NullTime   `db:"latest_release_time"`
+	ParentDir         string         `db:"parent_dir"`
+	MediaCount        int            `db:"media_count"`
+	PhotoCount        int            `db:"photo_count"`
+	VideoCount        int            `db:"video_count"`
+	GifCount          int            `db:"gif_count"`
+	CreatedAt         sql.NullTime   `db:"created_at"`
+	TotalBytes        int64          `db:"total_bytes"`
+	UpdatedAt         sql.NullTime   `db:"updated_at"`
+	Paused            bool           `db:"paused"`
+	ContentHash       sql.NullString `db:"content_hash"`
+	LastCursor        sql.NullString `db:"last_cursor"`
+}
+
+// 用户实体及其所属用户的名称，用户记录缺失时 ScreenName 和 UserName 为空
+type UserEntityWithUser struct {
+	UserEntity
+	ScreenName string `db:"screen_name"`
+	UserName   string `db:"user_name"`
+}
+
+// QueryUserEntities 的过滤条件，未设置（Valid 为 false）的条件不参与过滤
+type EntityQuery struct {
+	Protected     sql.NullBool // 所属用户是否受保护
+	StaleBefore   sql.NullTime // latest_release_time 为空或早于此时间
+	MinMediaCount sql.NullInt32
+	MaxMediaCount sql.NullInt32
+	Tag           sql.NullString // 所属用户带有此标签
+	Paused        sql.NullBool
+}
+
+// LocateUserEntity 匹配到实体时使用的规则
+const (
+	MatchedExactPath        = "exact path"           // 路径完全一致，无需移动
+	MatchedUserFileInNewDir = "user file in new dir" // 新路径下存在该用户的 .user 文件
+	MatchedUserFileInOldDir = "user file in old dir" // 实体原路径下存在该用户的 .user 文件
+)
+
+// 实体路径的变更计划
+type Relocation struct {
+	Entity  *UserEntity
+	OldDir  string
+	NewDir  string
+	Matched string
+}
+
+// VerifyUserFiles 发现的问题
+const (
+	UserFileMissing    = "missing"    // 目录或其中的 .user 文件不存在
+	UserFileWrongUid   = "wrong uid"  // .user 文件记录的 uid 与实体的 user_id 不一致
+	UserFileUnreadable = "unreadable" // .user 文件无法读取或内容无效
+)
+
+type UserFileIssue struct {
+	Entity      *UserEntity
+	Problem     string
+	RecordedUid uint64 // Problem 为 UserFileWrongUid 时文件中记录的 uid
+	Err         error  // Problem 为 UserFileUnreadable 时读取文件的错误
 }
 
 type UserLink struct {
@@ -30,12 +87,88 @@ type UserLink struct {
 	Uid               uint64        `db:"user_id"`
 	Name              string        `db:"name"`
 	ParentLstEntityId int32         `db:"parent_lst_entity_id"`
+	CreatedAt         sql.NullTime  `db:"created_at"`
+}
+
+type UserPreviousName struct {
+	Id         int       `db:"id"`
+	Uid        uint64    `db:"uid"`
+	ScreenName string    `db:"screen_name"`
+	Name       string    `db:"name"`
+	RecordDate time.Time `db:"record_date"`
+}
+
+type FriendsCountRecord struct {
+	Id           int       `db:"id"`
+	Uid          uint64    `db:"uid"`
+	FriendsCount int       `db:"friends_count"`
+	RecordDate   time.Time `db:"record_date"`
+}
+
+type DownloadError struct {
+	Id         int       `db:"id"`
+	EntityId   int       `db:"entity_id"`
+	TweetId    uint64    `db:"tweet_id"`
+	Url        string    `db:"url"`
+	Error      string    `db:"error"`
+	RecordDate time.Time `db:"record_date"`
+}
+
+// GetListMemberStats 的结果，成员没有用户实体时 EntityId 和 LatestReleaseTime 无效
+type ListMemberStat struct {
+	Uid               uint64        `db:"uid"`
+	ScreenName        string        `db:"screen_name"`
+	Name              string        `db:"name"`
+	EntityId          sql.NullInt32 `db:"entity_id"`
+	MediaCount        int           `db:"media_count"`
+	LatestReleaseTime sql.NullTime  `db:"latest_release_time"`
+}
+
+// ListsWithMemberCounts 的结果
+type LstWithMemberCount struct {
+	Id          uint64 `db:"id"`
+	Name        string `db:"name"`
+	OwnerId     uint64 `db:"owner_uid"`
+	MemberCount int    `db:"member_count"`
+}
+
+const (
+	EntityKindUser = "user"
+	EntityKindLst  = "lst"
+)
+
+// SearchAllEntitiesByPath 的结果，Kind 为 EntityKindUser 时 OwnerId 是 user_id，否则是 lst_id
+type EntityPathMatch struct {
+	Kind      string `db:"kind"`
+	Id        int32  `db:"id"`
+	OwnerId   int64  `db:"owner_id"`
+	Name      string `db:"name"`
+	ParentDir string `db:"parent_dir"`
+}
+
+// GetDatabaseStats 的结果
+type DBStats struct {
+	Users         int   `db:"users"`
+	Lsts          int   `db:"lsts"`
+	LstEntities   int   `db:"lst_entities"`
+	UserEntities  int   `db:"user_entities"`
+	UserLinks     int   `db:"user_links"`
+	PreviousNames int   `db:"user_previous_names"`
+	MediaCount    int64 `db:"media_count"`
+	TotalBytes    int64 `db:"total_bytes"`
+}
+
+type WatchlistEntry struct {
+	ScreenName  string        `db:"screen_name"`
+	AddedAt     time.Time     `db:"added_at"`
+	ResolvedUid sql.NullInt64 `db:"resolved_uid"`
 }
 
 type Lst struct {
-	Id      uint64 `db:"id"`
-	Name    string `db:"name"`
-	OwnerId uint64 `db:"owner_uid"`
+	Id        uint64       `db:"id"`
+	Name      string       `db:"name"`
+	OwnerId   uint64       `db:"owner_uid"`
+	CreatedAt sql.NullTime `db:"created_at"`
 }
 
 type LstEntity struct {
@@ -43,6 +176,8 @@ type LstEntity struct {
 	LstId     int64         `db:"lst_id"`
 	Name      string        `db:"name"`
 	ParentDir string        `db:"parent_dir"`
+	CreatedAt sql.NullTime  `db:"created_at"`
+	UpdatedAt sql.NullTime  `db:"updated_at"`
 }
 
 func (le *LstEntity) Path() string {
@@ -0,0 +1,294 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/mattn/go-sqlite3"
+)
+
+const (
+	defaultBusyTimeout   = 5 * time.Second
+	defaultMaxRetries    = 5
+	defaultMaxRetryDelay = time.Second
+	// 与 SQLite 的默认值相同：约 2 MiB 页缓存，不使用内存映射
+	defaultCacheSize = -2000
+	defaultMmapSize  = 0
+)
+
+type options struct {
+	busyTimeout   time.Duration
+	maxRetries    int
+	maxRetryDelay time.Duration
+	notFoundErr   bool
+	strictPaths   bool
+	cacheSize     int
+	mmapSize      int64
+	libraryRoot   string
+	timeout       time.Duration
+	encryptionKey string
+}
+
+func defaultOptions() *options {
+	return &options{
+		busyTimeout:   defaultBusyTimeout,
+		maxRetries:    defaultMaxRetries,
+		maxRetryDelay: defaultMaxRetryDelay,
+		cacheSize:     defaultCacheSize,
+		mmapSize:      defaultMmapSize,
+	}
+}
+
+// 检查选项的取值，并将 libraryRoot 规范化为绝对路径
+func (o *options) validate() error {
+	if o.cacheSize == 0 {
+		return fmt.Errorf("cache size must not be 0")
+	}
+	if o.mmapSize < 0 {
+		return fmt.Errorf("mmap size must not be negative: %d", o.mmapSize)
+	}
+	if o.timeout < 0 {
+		return fmt.Errorf("timeout must not be negative: %v", o.timeout)
+	}
+	if o.libraryRoot != "" {
+		root, err := normalizePath(o.libraryRoot)
+		if err != nil {
+			return err
+		}
+		o.libraryRoot = root
+	}
+	return nil
+}
+
+type Option func(*options)
+
+// 数据库被其他连接锁定时，语句最多等待 d 后才返回 SQLITE_BUSY
+func WithBusyTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.busyTimeout = d
+	}
+}
+
+// 写语句遇到 SQLITE_BUSY/SQLITE_LOCKED 时最多重试 maxRetries 次，重试间隔指数增长且不超过 maxDelay
+func WithRetry(maxRetries int, maxDelay time.Duration) Option {
+	return func(o *options) {
+		o.maxRetries = maxRetries
+		o.maxRetryDelay = maxDelay
+	}
+}
+
+// 记录不存在时 GetUserById 等函数返回 ErrNotFound 而不是 nil, nil
+func WithNotFoundError() Option {
+	return func(o *options) {
+		o.notFoundErr = true
+	}
+}
+
+// 查找或创建用户实体时只按路径精确匹配，不根据目录名或 .user 文件自动迁移已有实体的路径
+func WithStrictPaths() Option {
+	return func(o *options) {
+		o.strictPaths = true
+	}
+}
+
+// 每个连接的页缓存大小（PRAGMA cache_size）：正数为页数，负数为 KiB，如 -65536 表示 64 MiB
+func WithCacheSize(n int) Option {
+	return func(o *options) {
+		o.cacheSize = n
+	}
+}
+
+// 每个连接最多以内存映射方式访问数据库文件的前 bytes 字节（PRAGMA mmap_size），0 表示不使用
+// 实际上限受 SQLite 编译参数 SQLITE_MAX_MMAP_SIZE 限制
+func WithMmapSize(bytes int64) Option {
+	return func(o *options) {
+		o.mmapSize = bytes
+	}
+}
+
+// 位于 root 下的 parent_dir 以相对于 root 的路径存储，移动整个下载目录后只需以新的 root 打开数据库
+// 读取的实体中 ParentDir 总是绝对路径；打开时已有的位于 root 下的绝对路径会被转换为相对路径
+// 同一数据库此后必须始终以该选项打开，否则相对路径会被当作相对于工作目录
+func WithLibraryRoot(root string) Option {
+	return func(o *options) {
+		o.libraryRoot = root
+	}
+}
+
+// 调用方的 context 没有期限时，每条语句最多执行 d，超时后语句被中断并返回 context.DeadlineExceeded
+// 查询只计入数据库逐行计算结果的时间，遍历结果时调用方处理每行的时间不计入
+// 单次调用可以通过 IterUserEntitiesContext、CheckIntegrityContext 等 *Context 函数或 sqlx 的 *Context 方法传入自己的期限，
+// 或用 WithoutTimeout 取消默认期限；其余函数总是使用默认期限。0 表示不限制
+func WithTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.timeout = d
+	}
+}
+
+// 以 key 加密数据库文件，要求链接 SQLCipher 构建 go-sqlite3（如 libsqlite3 构建标签配合 SQLCipher 的 libsqlite3）
+// 每个连接建立后最先执行 PRAGMA key，之后的语句与未加密时相同
+// 驱动不支持加密时 OpenDB 返回 ErrEncryptionUnsupported，而不会写入未加密的数据
+func WithEncryptionKey(key string) Option {
+	return func(o *options) {
+		o.encryptionKey = key
+	}
+}
+
+// 打开数据库时的选项保存在连接器的驱动中，随 *sqlx.DB 一同释放；不是由 OpenDB 打开的数据库使用默认选项
+func optionsOf(db *sqlx.DB) *options {
+	if drv, ok := db.Driver().(*optionsDriver); ok {
+		return drv.o
+	}
+	return defaultOptions()
+}
+
+// *Tx 函数的 ext 只能是 *sqlx.DB 或由 WithTx、Begin 开启的 *Tx，其他事务不知道所属数据库的选项
+func optionsOfExt(ext sqlx.Ext) (*options, error) {
+	switch ext := ext.(type) {
+	case *sqlx.DB:
+		return optionsOf(ext), nil
+	case *Tx:
+		return ext.o, nil
+	}
+	return nil, fmt.Errorf("%T does not carry database options, start the transaction with WithTx or Begin", ext)
+}
+
+// 打开数据库，设置连接参数并迁移到最新的 schema
+// path 为 ":memory:" 时打开内存数据库，可用于测试
+func OpenDB(path string, opts ...Option) (*sqlx.DB, error) {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(o)
+	}
+	if err := o.validate(); err != nil {
+		return nil, err
+	}
+
+	memory := path == ":memory:"
+	var dsn string
+	if memory {
+		dsn = fmt.Sprintf("file::memory:?_busy_timeout=%d&_foreign_keys=on", o.busyTimeout.Milliseconds())
+	} else {
+		dsn = fmt.Sprintf("file:%s?_busy_timeout=%d&_foreign_keys=on", path, o.busyTimeout.Milliseconds())
+	}
+
+	// WAL 模式下读写互不阻塞，允许下载协程并发更新的同时查询实体
+	db, err := connect(dsn, o, !memory)
+	if err != nil {
+		return nil, err
+	}
+	if memory {
+		// 每个连接都会打开一个独立的内存数据库，所以只保留一个连接
+		db.SetMaxOpenConns(1)
+	}
+
+	if err := Migrate(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if o.libraryRoot != "" {
+		if err := relativizeParentDirs(db, o); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return db, nil
+}
+
+// 以只读模式打开已存在的数据库，不执行迁移，供报表、导出等不应修改数据库的命令使用
+// 通过该连接执行的写语句总是失败，错误可以用 errors.Is(err, ErrReadOnly) 判断
+func OpenDBReadOnly(path string, opts ...Option) (*sqlx.DB, error) {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(o)
+	}
+	if err := o.validate(); err != nil {
+		return nil, err
+	}
+	if path == ":memory:" {
+		return nil, fmt.Errorf("cannot open an in-memory database read-only")
+	}
+
+	dsn := fmt.Sprintf("file:%s?mode=ro&_busy_timeout=%d&_foreign_keys=on", path, o.busyTimeout.Milliseconds())
+	return connect(dsn, o, false)
+}
+
+// wal 为 true 时每个连接切换到 WAL 模式
+func connect(dsn string, o *options, wal bool) (*sqlx.DB, error) {
+	// 连接池随时可能新建连接，PRAGMA 在每个连接建立时设置，保证任何查询执行前都已生效
+	// DSN 中的参数只能设置不读取数据库文件的 PRAGMA：加密的数据库在执行 PRAGMA key 之前无法读取，
+	// 所以 journal_mode 也在这里设置
+	drv := &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			if o.encryptionKey != "" {
+				if _, err := conn.Exec(o.keyPragma(), nil); err != nil {
+					return err
+				}
+				if err := checkEncryption(conn); err != nil {
+					return err
+				}
+			}
+			pragmas := fmt.Sprintf("PRAGMA cache_size=%d; PRAGMA mmap_size=%d;", o.cacheSize, o.mmapSize)
+			if wal {
+				pragmas += " PRAGMA journal_mode=WAL;"
+			}
+			_, err := conn.Exec(pragmas, nil)
+			return err
+		},
+	}
+	db := sqlx.NewDb(sql.OpenDB(&connector{&optionsDriver{drv, o}, dsn}), "sqlite3")
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// 设置密钥的语句，必须在连接上的其他语句之前执行
+func (o *options) keyPragma() string {
+	return fmt.Sprintf("PRAGMA key = '%s';", strings.ReplaceAll(o.encryptionKey, "'", "''"))
+}
+
+// 未链接 SQLCipher 时 PRAGMA key 被静默忽略，只能通过 cipher_version 是否有结果判断
+func checkEncryption(conn *sqlite3.SQLiteConn) error {
+	rows, err := conn.Query(`PRAGMA cipher_version`, nil)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	if err := rows.Next(make([]driver.Value, len(rows.Columns()))); err == io.EOF {
+		return ErrEncryptionUnsupported
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+// 携带打开数据库时的选项，optionsOf 通过 db.Driver() 取回
+type optionsDriver struct {
+	*sqlite3.SQLiteDriver
+	o *options
+}
+
+type connector struct {
+	drv *optionsDriver
+	dsn string
+}
+
+func (c *connector) Connect(context.Context) (driver.Conn, error) {
+	conn, err := c.drv.Open(c.dsn)
+	if err != nil || c.drv.o.timeout == 0 {
+		return conn, err
+	}
+	return &timeoutConn{conn.(*sqlite3.SQLiteConn), c.drv.o.timeout}, nil
+}
+
+func (c *connector) Driver() driver.Driver {
+	return c.drv
+}
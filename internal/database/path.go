@@ -0,0 +1,103 @@
+package database
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// 所有写入或用于查询 parent_dir 的路径都应经过此函数，保证同一目录只对应一个值：
+// 转为绝对路径并去掉多余的分隔符，Windows 下盘符统一为大写
+func normalizePath(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+
+	vol := filepath.VolumeName(abs)
+	if len(vol) == 2 && vol[1] == ':' {
+		abs = strings.ToUpper(vol) + abs[len(vol):]
+	}
+	return abs, nil
+}
+
+// 返回 path 规范化后的绝对路径和写入 parent_dir 时使用的值
+// 设置了库根目录时，根目录下的路径以 / 分隔的相对路径存储，其他路径与 abs 相同
+func storedPath(o *options, path string) (abs string, stored string, err error) {
+	abs, err = normalizePath(path)
+	if err != nil {
+		return "", "", err
+	}
+	if o.libraryRoot == "" {
+		return abs, abs, nil
+	}
+
+	rel, err := filepath.Rel(o.libraryRoot, abs)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return abs, abs, nil
+	}
+	return abs, filepath.ToSlash(rel), nil
+}
+
+// 将 parent_dir 中存储的值还原为绝对路径
+func resolvePath(o *options, stored string) string {
+	if o.libraryRoot == "" || filepath.IsAbs(stored) {
+		return stored
+	}
+	return filepath.Join(o.libraryRoot, filepath.FromSlash(stored))
+}
+
+// 将直接从数据库读取的 parent_dir 解析为绝对路径，本包返回的实体已经解析过，不需要再调用
+func ResolveParentDir(db *sqlx.DB, parentDir string) string {
+	return resolvePath(optionsOf(db), parentDir)
+}
+
+func resolveUserEntities(o *options, entities ...*UserEntity) {
+	for _, entity := range entities {
+		if entity == nil {
+			continue
+		}
+		entity.ParentDir = resolvePath(o, entity.ParentDir)
+	}
+}
+
+func resolveLstEntities(o *options, entities ...*LstEntity) {
+	for _, entity := range entities {
+		if entity == nil {
+			continue
+		}
+		entity.ParentDir = resolvePath(o, entity.ParentDir)
+	}
+}
+
+// 将库根目录下仍以绝对路径存储的 parent_dir 转换为相对路径
+func relativizeParentDirs(db *sqlx.DB, o *options) error {
+	return WithTx(db, func(tx *Tx) error {
+		for _, table := range []string{"user_entities", "lst_entities"} {
+			rows := []struct {
+				Id        int    `db:"id"`
+				ParentDir string `db:"parent_dir"`
+			}{}
+			if err := tx.Select(&rows, `SELECT id, parent_dir FROM `+table); err != nil {
+				return err
+			}
+			for _, row := range rows {
+				if !filepath.IsAbs(row.ParentDir) {
+					continue
+				}
+				_, stored, err := storedPath(o, row.ParentDir)
+				if err != nil {
+					return err
+				}
+				if stored == row.ParentDir {
+					continue
+				}
+				if _, err := tx.Exec(`UPDATE `+table+` SET parent_dir=? WHERE id=?`, stored, row.Id); err != nil {
+					return wrapErr(err)
+				}
+			}
+		}
+		return nil
+	})
+}
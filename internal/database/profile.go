@@ -0,0 +1,55 @@
+package database
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const profileExt = ".db"
+
+// 打开 dir 下名为 name 的配置的数据库，不存在时创建，每个配置对应一个独立的 sqlite 文件
+// 所有函数都只操作传入的 *sqlx.DB，选项保存在句柄自身中，关闭后随句柄一同释放，
+// 因此可以同时打开多个配置，互不影响
+func OpenProfile(dir, name string, opts ...Option) (*sqlx.DB, error) {
+	if err := checkProfileName(name); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return OpenDB(filepath.Join(dir, name+profileExt), opts...)
+}
+
+// dir 下已有的配置名，按名称排序；dir 不存在时返回空列表
+func ListProfiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	res := []string{}
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != profileExt {
+			continue
+		}
+		res = append(res, strings.TrimSuffix(entry.Name(), profileExt))
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+// 配置名直接用作文件名，不能包含路径分隔符
+func checkProfileName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\:`) {
+		return fmt.Errorf("invalid profile name %q", name)
+	}
+	return nil
+}
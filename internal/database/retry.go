@@ -0,0 +1,54 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/mattn/go-sqlite3"
+)
+
+const retryBaseDelay = 10 * time.Millisecond
+
+func isBusy(err error) bool {
+	var sqliteErr sqlite3.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+	return sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked
+}
+
+// 仅在数据库被锁定时重试，其他错误立即返回
+func withRetry(o *options, fn func() error) error {
+	delay := retryBaseDelay
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || !isBusy(err) || attempt >= o.maxRetries {
+			return err
+		}
+
+		time.Sleep(delay)
+		delay = min(delay*2, o.maxRetryDelay)
+	}
+}
+
+func execWithRetry(db *sqlx.DB, query string, args ...any) (sql.Result, error) {
+	var res sql.Result
+	err := withRetry(optionsOf(db), func() error {
+		var err error
+		res, err = db.Exec(query, args...)
+		return err
+	})
+	return res, wrapErr(err)
+}
+
+func namedExecWithRetry(db *sqlx.DB, query string, arg any) (sql.Result, error) {
+	var res sql.Result
+	err := withRetry(optionsOf(db), func() error {
+		var err error
+		res, err = db.NamedExec(query, arg)
+		return err
+	})
+	return res, wrapErr(err)
+}
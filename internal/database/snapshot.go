@@ -0,0 +1,142 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// 数据库中关于一个用户的全部记录，用于排查问题
+type UserSnapshot struct {
+	User          *User // 用户不存在时为 nil
+	Entities      []*UserEntity
+	PreviousNames []*UserPreviousName
+	Links         []*UserLink
+}
+
+// WriteUserSnapshot 输出的 JSON 文档，可为空的列在为 NULL 时省略
+type snapshotDoc struct {
+	User          *snapshotUser           `json:"user"`
+	Entities      []*snapshotUserEntity   `json:"entities"`
+	PreviousNames []*snapshotPreviousName `json:"previous_names"`
+	Links         []*snapshotUserLink     `json:"links"`
+}
+
+type snapshotUser struct {
+	Id           uint64     `json:"id"`
+	ScreenName   string     `json:"screen_name"`
+	Name         string     `json:"name"`
+	IsProtected  bool       `json:"protected"`
+	FriendsCount int        `json:"friends_count"`
+	CreatedAt    *time.Time `json:"created_at,omitempty"`
+}
+
+type snapshotUserEntity struct {
+	Id                int32      `json:"id"`
+	Uid               uint64     `json:"user_id"`
+	Name              string     `json:"name"`
+	ParentDir         string     `json:"parent_dir"`
+	LatestReleaseTime *time.Time `json:"latest_release_time,omitempty"`
+	MediaCount        int        `json:"media_count"`
+	PhotoCount        int        `json:"photo_count"`
+	VideoCount        int        `json:"video_count"`
+	GifCount          int        `json:"gif_count"`
+	TotalBytes        int64      `json:"total_bytes"`
+	Paused            bool       `json:"paused"`
+	ContentHash       *string    `json:"content_hash,omitempty"`
+	LastCursor        *string    `json:"last_cursor,omitempty"`
+	CreatedAt         *time.Time `json:"created_at,omitempty"`
+	UpdatedAt         *time.Time `json:"updated_at,omitempty"`
+}
+
+type snapshotPreviousName struct {
+	ScreenName string    `json:"screen_name"`
+	Name       string    `json:"name"`
+	RecordDate time.Time `json:"record_date"`
+}
+
+type snapshotUserLink struct {
+	Id                int32      `json:"id"`
+	Name              string     `json:"name"`
+	ParentLstEntityId int32      `json:"parent_lst_entity_id"`
+	CreatedAt         *time.Time `json:"created_at,omitempty"`
+}
+
+func GetUserSnapshot(db *sqlx.DB, uid uint64) (*UserSnapshot, error) {
+	usr, err := GetUserById(db, uid)
+	if err != nil && err != ErrNotFound {
+		return nil, err
+	}
+
+	snapshot := &UserSnapshot{
+		User:          usr,
+		Entities:      []*UserEntity{},
+		PreviousNames: []*UserPreviousName{},
+		Links:         []*UserLink{},
+	}
+	if err := db.Select(&snapshot.Entities, `SELECT * FROM user_entities WHERE user_id=? ORDER BY id`, uid); err != nil {
+		return nil, err
+	}
+	resolveUserEntities(optionsOf(db), snapshot.Entities...)
+	if err := db.Select(&snapshot.PreviousNames, `SELECT * FROM user_previous_names WHERE uid=? ORDER BY id`, uid); err != nil {
+		return nil, err
+	}
+	if err := db.Select(&snapshot.Links, `SELECT * FROM user_links WHERE user_id=? ORDER BY id`, uid); err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+// 将 GetUserSnapshot 的结果以 JSON 写入 w
+func WriteUserSnapshot(db *sqlx.DB, uid uint64, w io.Writer) error {
+	snapshot, err := GetUserSnapshot(db, uid)
+	if err != nil {
+		return err
+	}
+
+	doc := &snapshotDoc{
+		Entities:      make([]*snapshotUserEntity, 0, len(snapshot.Entities)),
+		PreviousNames: make([]*snapshotPreviousName, 0, len(snapshot.PreviousNames)),
+		Links:         make([]*snapshotUserLink, 0, len(snapshot.Links)),
+	}
+	if usr := snapshot.User; usr != nil {
+		doc.User = &snapshotUser{usr.Id, usr.ScreenName, usr.Name, usr.IsProtected, usr.FriendsCount, nullTimePtr(usr.CreatedAt)}
+	}
+	for _, ue := range snapshot.Entities {
+		doc.Entities = append(doc.Entities, &snapshotUserEntity{
+			Id: ue.Id.Int32, Uid: ue.Uid, Name: ue.Name, ParentDir: ue.ParentDir,
+			LatestReleaseTime: nullTimePtr(ue.LatestReleaseTime),
+			MediaCount:        ue.MediaCount, PhotoCount: ue.PhotoCount, VideoCount: ue.VideoCount, GifCount: ue.GifCount,
+			TotalBytes: ue.TotalBytes, Paused: ue.Paused,
+			ContentHash: nullStringPtr(ue.ContentHash), LastCursor: nullStringPtr(ue.LastCursor),
+			CreatedAt: nullTimePtr(ue.CreatedAt), UpdatedAt: nullTimePtr(ue.UpdatedAt),
+		})
+	}
+	for _, name := range snapshot.PreviousNames {
+		doc.PreviousNames = append(doc.PreviousNames, &snapshotPreviousName{name.ScreenName, name.Name, name.RecordDate})
+	}
+	for _, link := range snapshot.Links {
+		doc.Links = append(doc.Links, &snapshotUserLink{link.Id.Int32, link.Name, link.ParentLstEntityId, nullTimePtr(link.CreatedAt)})
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(doc)
+}
+
+func nullTimePtr(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+func nullStringPtr(s sql.NullString) *string {
+	if !s.Valid {
+		return nil
+	}
+	return &s.String
+}
@@ -0,0 +1,130 @@
+package database
+
+import (
+	"github.com/jmoiron/sqlx"
+)
+
+func CountUsers(db *sqlx.DB) (int, error) {
+	var n int
+	err := db.Get(&n, `SELECT COUNT(*) FROM users`)
+	return n, err
+}
+
+func CountUserEntities(db *sqlx.DB) (int, error) {
+	var n int
+	err := db.Get(&n, `SELECT COUNT(*) FROM user_entities`)
+	return n, err
+}
+
+func CountLstEntities(db *sqlx.DB) (int, error) {
+	var n int
+	err := db.Get(&n, `SELECT COUNT(*) FROM lst_entities`)
+	return n, err
+}
+
+func SumMediaCount(db *sqlx.DB) (int64, error) {
+	var n int64
+	err := db.Get(&n, `SELECT COALESCE(SUM(media_count), 0) FROM user_entities`)
+	return n, err
+}
+
+// 所有用户实体已下载文件的总字节数
+func SumTotalBytes(db *sqlx.DB) (int64, error) {
+	var n int64
+	err := db.Get(&n, `SELECT COALESCE(SUM(total_bytes), 0) FROM user_entities`)
+	return n, err
+}
+
+// 统计列表成员的媒体总数，同一用户通过多个列表实体链接时只计算一次
+func SumMediaCountByLst(db *sqlx.DB, lid uint64) (int64, error) {
+	stmt := `SELECT COALESCE(SUM(media_count), 0) FROM user_entities WHERE user_id IN (
+		SELECT user_links.user_id FROM user_links
+		JOIN lst_entities ON user_links.parent_lst_entity_id = lst_entities.id
+		WHERE lst_entities.lst_id = ?)`
+	var n int64
+	err := db.Get(&n, stmt, lid)
+	return n, err
+}
+
+func CountUserLinksByLstEntity(db *sqlx.DB, parentLstEntityId int32) (int, error) {
+	var n int
+	err := db.Get(&n, `SELECT COUNT(*) FROM user_links WHERE parent_lst_entity_id = ?`, parentLstEntityId)
+	return n, err
+}
+
+// 一次查询统计列表所有实体下的用户链接数量，键为列表实体 id，没有链接的实体计为 0
+func CountUserLinksByLst(db *sqlx.DB, lid uint64) (map[int32]int, error) {
+	stmt := `SELECT lst_entities.id, COUNT(user_links.id) FROM lst_entities
+		LEFT JOIN user_links ON user_links.parent_lst_entity_id = lst_entities.id
+		WHERE lst_entities.lst_id = ?
+		GROUP BY lst_entities.id`
+	rows, err := db.Query(stmt, lid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := make(map[int32]int)
+	for rows.Next() {
+		var id int32
+		var n int
+		if err := rows.Scan(&id, &n); err != nil {
+			return nil, err
+		}
+		res[id] = n
+	}
+	return res, rows.Err()
+}
+
+// 统计每个用户的实体数量，只返回数量大于 threshold 的用户，键为 uid
+// threshold 为 1 时即在多个目录中被追踪、可能重复下载的用户
+func CountUserEntitiesPerUser(db *sqlx.DB, threshold int) (map[uint64]int, error) {
+	stmt := `SELECT user_id, COUNT(*) FROM user_entities GROUP BY user_id HAVING COUNT(*) > ?`
+	rows, err := db.Query(stmt, threshold)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := make(map[uint64]int)
+	for rows.Next() {
+		var uid uint64
+		var n int
+		if err := rows.Scan(&uid, &n); err != nil {
+			return nil, err
+		}
+		res[uid] = n
+	}
+	return res, rows.Err()
+}
+
+// 所有列表及其成员数，同一用户通过多个列表实体链接时只计算一次，没有成员的列表计为 0
+func ListsWithMemberCounts(db *sqlx.DB) ([]*LstWithMemberCount, error) {
+	stmt := `SELECT lsts.id, lsts.name, lsts.owner_uid, COUNT(DISTINCT user_links.user_id) AS member_count
+		FROM lsts
+		LEFT JOIN lst_entities ON lst_entities.lst_id = lsts.id
+		LEFT JOIN user_links ON user_links.parent_lst_entity_id = lst_entities.id
+		GROUP BY lsts.id
+		ORDER BY lsts.id`
+	res := []*LstWithMemberCount{}
+	err := db.Select(&res, stmt)
+	return res, err
+}
+
+// 在一次查询中统计各表的行数以及媒体总数和总字节数
+func GetDatabaseStats(db *sqlx.DB) (*DBStats, error) {
+	stmt := `SELECT
+		(SELECT COUNT(*) FROM users) AS users,
+		(SELECT COUNT(*) FROM lsts) AS lsts,
+		(SELECT COUNT(*) FROM lst_entities) AS lst_entities,
+		(SELECT COUNT(*) FROM user_entities) AS user_entities,
+		(SELECT COUNT(*) FROM user_links) AS user_links,
+		(SELECT COUNT(*) FROM user_previous_names) AS user_previous_names,
+		(SELECT COALESCE(SUM(media_count), 0) FROM user_entities) AS media_count,
+		(SELECT COALESCE(SUM(total_bytes), 0) FROM user_entities) AS total_bytes`
+	res := &DBStats{}
+	if err := db.Get(res, stmt); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
@@ -0,0 +1,83 @@
+package database
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// 标签名去掉首尾空白，不区分 ASCII 大小写
+func normalizeTag(tag string) (string, error) {
+	tag = strings.TrimSpace(tag)
+	if tag == "" {
+		return "", fmt.Errorf("tag is empty")
+	}
+	return tag, nil
+}
+
+// 为用户添加标签，标签不存在时创建；用户已有该标签时什么也不做
+// 用户不存在时返回 ErrNotFound
+func AddUserTag(db *sqlx.DB, uid uint64, tag string) error {
+	tag, err := normalizeTag(tag)
+	if err != nil {
+		return err
+	}
+
+	return withRetry(optionsOf(db), func() error {
+		return WithTx(db, func(tx *Tx) error {
+			var exists bool
+			if err := tx.Get(&exists, `SELECT EXISTS(SELECT 1 FROM users WHERE id=?)`, uid); err != nil {
+				return err
+			}
+			if !exists {
+				return fmt.Errorf("%w: user %d", ErrNotFound, uid)
+			}
+
+			if _, err := tx.Exec(`INSERT OR IGNORE INTO tags(name) VALUES(?)`, tag); err != nil {
+				return wrapErr(err)
+			}
+			stmt := `INSERT OR IGNORE INTO user_tags(uid, tag_id) SELECT ?, id FROM tags WHERE name=?`
+			_, err := tx.Exec(stmt, uid, tag)
+			return wrapErr(err)
+		})
+	})
+}
+
+// 移除用户的标签，用户没有该标签时什么也不做；标签本身保留
+func RemoveUserTag(db *sqlx.DB, uid uint64, tag string) error {
+	tag, err := normalizeTag(tag)
+	if err != nil {
+		return err
+	}
+	stmt := `DELETE FROM user_tags WHERE uid=? AND tag_id IN (SELECT id FROM tags WHERE name=?)`
+	_, err = execWithRetry(db, stmt, uid, tag)
+	return err
+}
+
+// 带有该标签的所有用户，按 screen_name 排序
+func GetUsersByTag(db *sqlx.DB, tag string) ([]*User, error) {
+	tag, err := normalizeTag(tag)
+	if err != nil {
+		return nil, err
+	}
+	stmt := `SELECT users.* FROM users
+		JOIN user_tags ON user_tags.uid = users.id
+		JOIN tags ON tags.id = user_tags.tag_id
+		WHERE tags.name=?
+		ORDER BY users.screen_name COLLATE NOCASE`
+	res := []*User{}
+	err = db.Select(&res, stmt, tag)
+	return res, err
+}
+
+// 用户的所有标签，按名称排序
+func GetUserTags(db *sqlx.DB, uid uint64) ([]string, error) {
+	stmt := `SELECT tags.name FROM tags
+		JOIN user_tags ON user_tags.tag_id = tags.id
+		WHERE user_tags.uid=?
+		ORDER BY tags.name`
+	res := []string{}
+	err := db.Select(&res, stmt, uid)
+	return res, err
+}
@@ -0,0 +1,126 @@
+package database
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+type noTimeoutKey struct{}
+
+// 返回不受 WithTimeout 默认期限限制的 ctx，用于 VACUUM 等预期耗时很长的语句
+// 调用方为 ctx 设置的期限仍然有效
+func WithoutTimeout(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noTimeoutKey{}, true)
+}
+
+// 调用方未设置期限，也没有用 WithoutTimeout 取消默认期限
+func useDefaultTimeout(ctx context.Context, timeout time.Duration) bool {
+	if timeout <= 0 || ctx.Value(noTimeoutKey{}) != nil {
+		return false
+	}
+	_, ok := ctx.Deadline()
+	return !ok
+}
+
+// 调用方未设置期限时为语句加上默认期限
+// go-sqlite3 在 ctx 结束时调用 sqlite3_interrupt 中断正在执行的语句，而不只是提前返回
+func statementContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if !useDefaultTimeout(ctx, timeout) {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// 查询的结果在 Next 中逐行计算，期限只计入 Next 的执行时间，调用方处理每行所花的时间不计入
+// 否则逐行回调的流式接口会在遍历到一半时超时
+func queryRows(ctx context.Context, timeout time.Duration, query func(context.Context) (driver.Rows, error)) (driver.Rows, error) {
+	if !useDefaultTimeout(ctx, timeout) {
+		return query(ctx)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	rows, err := query(ctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &timeoutRows{Rows: rows, cancel: cancel, remaining: timeout}, nil
+}
+
+// 以 WithTimeout 打开的数据库所使用的连接，其余方法由 *sqlite3.SQLiteConn 实现
+type timeoutConn struct {
+	*sqlite3.SQLiteConn
+	timeout time.Duration
+}
+
+func (c *timeoutConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	ctx, cancel := statementContext(ctx, c.timeout)
+	defer cancel()
+	return c.SQLiteConn.ExecContext(ctx, query, args)
+}
+
+func (c *timeoutConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	return queryRows(ctx, c.timeout, func(ctx context.Context) (driver.Rows, error) {
+		return c.SQLiteConn.QueryContext(ctx, query, args)
+	})
+}
+
+func (c *timeoutConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	stmt, err := c.SQLiteConn.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return &timeoutStmt{stmt.(*sqlite3.SQLiteStmt), c.timeout}, nil
+}
+
+type timeoutStmt struct {
+	*sqlite3.SQLiteStmt
+	timeout time.Duration
+}
+
+func (s *timeoutStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	ctx, cancel := statementContext(ctx, s.timeout)
+	defer cancel()
+	return s.SQLiteStmt.ExecContext(ctx, args)
+}
+
+func (s *timeoutStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	return queryRows(ctx, s.timeout, func(ctx context.Context) (driver.Rows, error) {
+		return s.SQLiteStmt.QueryContext(ctx, args)
+	})
+}
+
+// 所有 Next 调用共用 remaining 的执行时间，用完时取消 ctx 以中断正在执行的 Next
+type timeoutRows struct {
+	driver.Rows
+	cancel    context.CancelFunc
+	remaining time.Duration
+	expired   atomic.Bool
+}
+
+func (r *timeoutRows) Next(dest []driver.Value) error {
+	if r.expired.Load() || r.remaining <= 0 {
+		return context.DeadlineExceeded
+	}
+	start := time.Now()
+	timer := time.AfterFunc(r.remaining, func() {
+		r.expired.Store(true)
+		r.cancel()
+	})
+	err := r.Rows.Next(dest)
+	timer.Stop()
+	r.remaining -= time.Since(start)
+	if errors.Is(err, context.Canceled) && r.expired.Load() {
+		return context.DeadlineExceeded
+	}
+	return err
+}
+
+func (r *timeoutRows) Close() error {
+	defer r.cancel()
+	return r.Rows.Close()
+}
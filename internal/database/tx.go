@@ -0,0 +1,36 @@
+package database
+
+import (
+	"github.com/jmoiron/sqlx"
+)
+
+// 由 WithTx 或 Begin 开启的事务，携带所属数据库的选项，供事务中调用的 *Tx 函数使用
+// 直接由 db.Beginx 开启的 *sqlx.Tx 不知道数据库的选项，传给 *Tx 函数会返回错误
+type Tx struct {
+	*sqlx.Tx
+	o *options
+}
+
+// 开启事务，调用方负责 Commit 或 Rollback
+func Begin(db *sqlx.DB) (*Tx, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	return &Tx{tx, optionsOf(db)}, nil
+}
+
+// 在事务中执行 fn，fn 返回错误或 panic 时回滚，否则提交
+// fn 中只能通过 tx 访问数据库：内存数据库只有一个连接，使用 db 会导致死锁
+func WithTx(db *sqlx.DB, fn func(tx *Tx) error) error {
+	tx, err := Begin(db)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
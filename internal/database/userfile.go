@@ -0,0 +1,67 @@
+package database
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const userFileName = ".user"
+
+// 用户实体目录（parent_dir/name）下的 .user 文件，内容为十进制 uid，以换行结尾
+func WriteUserFile(dir string, uid uint64) error {
+	path := filepath.Join(dir, userFileName)
+	return os.WriteFile(path, []byte(strconv.FormatUint(uid, 10)+"\n"), 0644)
+}
+
+func ReadUserFile(dir string) (uint64, error) {
+	path := filepath.Join(dir, userFileName)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	content := strings.TrimSpace(string(data))
+	if content == "" {
+		return 0, fmt.Errorf("user file %s is empty", path)
+	}
+	uid, err := strconv.ParseUint(content, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("user file %s is malformed: %v", path, err)
+	}
+	return uid, nil
+}
+
+// 仅当 dir 下的 .user 文件可读且记录的 uid 与给定 uid 一致时才认为是同一用户
+func isUserFileOf(dir string, uid uint64) bool {
+	recorded, err := ReadUserFile(dir)
+	return err == nil && recorded == uid
+}
+
+const lstFileName = ".lst"
+
+// 列表实体目录下的 .lst 文件，内容为十进制 lst_id，以换行结尾
+func WriteLstFile(dir string, lid int64) error {
+	path := filepath.Join(dir, lstFileName)
+	return os.WriteFile(path, []byte(strconv.FormatInt(lid, 10)+"\n"), 0644)
+}
+
+func ReadLstFile(dir string) (int64, error) {
+	path := filepath.Join(dir, lstFileName)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	content := strings.TrimSpace(string(data))
+	if content == "" {
+		return 0, fmt.Errorf("lst file %s is empty", path)
+	}
+	lid, err := strconv.ParseInt(content, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("lst file %s is malformed: %v", path, err)
+	}
+	return lid, nil
+}
@@ -0,0 +1,39 @@
+package database
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// 记录尚未解析出 uid 的待追踪用户，重复添加会被忽略
+func AddToWatchlist(db *sqlx.DB, screenName string) error {
+	stmt := `INSERT INTO watchlist(screen_name, added_at) VALUES(?, ?) ON CONFLICT(screen_name) DO NOTHING`
+	_, err := execWithRetry(db, stmt, screenName, time.Now())
+	return err
+}
+
+func ListWatchlist(db *sqlx.DB) ([]*WatchlistEntry, error) {
+	stmt := `SELECT * FROM watchlist ORDER BY added_at`
+	res := []*WatchlistEntry{}
+	err := db.Select(&res, stmt)
+	return res, err
+}
+
+// 将待追踪用户关联到已存在于 users 表中的用户，screenName 不在关注列表中时返回 ErrNotFound
+func ResolveWatchlistEntry(db *sqlx.DB, screenName string, uid uint64) error {
+	stmt := `UPDATE watchlist SET resolved_uid=? WHERE screen_name=?`
+	res, err := execWithRetry(db, stmt, uid, screenName)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("%w: %s is not in watchlist", ErrNotFound, screenName)
+	}
+	return nil
+}
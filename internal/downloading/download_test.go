@@ -47,11 +47,13 @@ func TestUserEntity(t *testing.T) {
 
 	os.RemoveAll(filepath.Join(tempdir, name))
 	testSyncUser(t, name, uid, tempdir, false)
+	verifyUserFile(t, filepath.Join(tempdir, name), uint64(uid))
 
 	// 改名
 	name = name + "renamed"
 	os.RemoveAll(filepath.Join(tempdir, name))
 	testSyncUser(t, name, uid, tempdir, true)
+	verifyUserFile(t, filepath.Join(tempdir, name), uint64(uid))
 
 	// 什么都不干
 	os.RemoveAll(filepath.Join(tempdir, name))
@@ -80,6 +82,21 @@ func TestUserEntity(t *testing.T) {
 		t.Errorf("recorded time: %v, want %v", record.LatestReleaseTime.Time, now)
 	}
 
+	// 下载失败记录
+	pt := TweetInEntity{Tweet: &twitter.Tweet{Id: 1}, Entity: ue}
+	if err := pt.recordError("https://example.com/1.jpg", fmt.Errorf("404")); err != nil {
+		t.Error(err)
+		return
+	}
+	errs, err := database.GetRecentDownloadErrors(db, ue.Id(), 0)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(errs) != 1 || errs[0].TweetId != 1 || errs[0].Url != "https://example.com/1.jpg" || errs[0].Error != "404" {
+		t.Errorf("download errors = %v want the recorded failure", errs)
+	}
+
 	// remove
 	eid := ue.Id()
 	if err := ue.Remove(); err != nil {
@@ -122,6 +139,13 @@ func TestListEntity(t *testing.T) {
 	name = name + "renamed"
 	os.RemoveAll(filepath.Join(tempdir, name))
 	testSyncList(t, name, uid, tempdir, true)
+	verifyLstFile(t, filepath.Join(tempdir, name), int64(uid))
+
+	// 原目录不存在时改名会重新创建目录，同样要写入 .lst 文件
+	os.RemoveAll(filepath.Join(tempdir, name))
+	name = name + "again"
+	testSyncList(t, name, uid, tempdir, true)
+	verifyLstFile(t, filepath.Join(tempdir, name), int64(uid))
 
 	os.RemoveAll(filepath.Join(tempdir, name))
 	le := testSyncList(t, name, uid, tempdir, true)
@@ -214,6 +238,22 @@ func verifyLstRecord(t *testing.T, entity SmartPath, lid int64, name string, par
 	}
 }
 
+// 创建或重命名实体目录后，其中的 .user 文件记录了 uid
+func verifyUserFile(t *testing.T, dir string, uid uint64) {
+	recorded, err := database.ReadUserFile(dir)
+	if err != nil || recorded != uid {
+		t.Errorf("user file in %s: %d, %v want %d", dir, recorded, err, uid)
+	}
+}
+
+// 创建或重命名列表实体目录后，其中的 .lst 文件记录了列表 id
+func verifyLstFile(t *testing.T, dir string, lid int64) {
+	recorded, err := database.ReadLstFile(dir)
+	if err != nil || recorded != lid {
+		t.Errorf("lst file in %s: %d, %v want %d", dir, recorded, err, lid)
+	}
+}
+
 func testSyncUser(t *testing.T, name string, uid int, parentdir string, exist bool) *UserEntity {
 	ue, err := NewUserEntity(db, uint64(uid), parentdir)
 	if err != nil {
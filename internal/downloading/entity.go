@@ -65,6 +65,10 @@ func (ue *UserEntity) Create(name string) error {
 	if err := os.MkdirAll(path, 0755); err != nil {
 		return err
 	}
+	// 目录被移动后据此找回用户实体
+	if err := database.WriteUserFile(path, ue.record.Uid); err != nil {
+		return err
+	}
 
 	// 使用新的路径变更处理函数，支持路径变更时的记录关联
 	updatedRecord, err := database.CreateOrUpdateUserEntityWithPathChange(ue.db, ue.record, filepath.Dir(path))
@@ -105,6 +109,9 @@ func (ue *UserEntity) Rename(title string) error {
 	if err != nil && !os.IsExist(err) {
 		return err
 	}
+	if err := database.WriteUserFile(newPath, ue.record.Uid); err != nil {
+		return err
+	}
 
 	ue.record.Name = title
 	return database.UpdateUserEntity(ue.db, ue.record)
@@ -146,6 +153,26 @@ func (ue *UserEntity) SetLatestReleaseTime(t time.Time) error {
 	return err
 }
 
+func (ue *UserEntity) AddBytes(n int64) error {
+	if !ue.created {
+		return fmt.Errorf("user entity [%s:%d] was not created", ue.record.ParentDir, ue.record.Uid)
+	}
+	// 多个下载协程会同时调用，只更新数据库而不修改 record
+	return database.AddUserEntityBytes(ue.db, int(ue.record.Id.Int32), n)
+}
+
+func (ue *UserEntity) RecordDownloadError(tweetId uint64, url string, downloadErr error) error {
+	if !ue.created {
+		return fmt.Errorf("user entity [%s:%d] was not created", ue.record.ParentDir, ue.record.Uid)
+	}
+	return database.RecordDownloadError(ue.db, int(ue.record.Id.Int32), tweetId, url, downloadErr)
+}
+
+// 暂停的实体仍会同步名称和路径，但不下载推文
+func (ue *UserEntity) Paused() bool {
+	return ue.record.Paused
+}
+
 func (ue *UserEntity) Uid() uint64 {
 	return ue.record.Uid
 }
@@ -181,6 +208,10 @@ func (le *ListEntity) Create(name string) error {
 	if err := os.MkdirAll(path, 0755); err != nil {
 		return err
 	}
+	// 目录被移动后据此找回列表实体
+	if err := database.WriteLstFile(path, le.record.LstId); err != nil {
+		return err
+	}
 
 	// 使用新的路径变更处理函数，支持路径变更时的记录关联
 	updatedRecord, err := database.CreateOrUpdateLstEntityWithPathChange(le.db, le.record)
@@ -223,6 +254,9 @@ func (le *ListEntity) Rename(title string) error {
 	if err != nil && !os.IsExist(err) {
 		return err
 	}
+	if err := database.WriteLstFile(newPath, le.record.LstId); err != nil {
+		return err
+	}
 
 	le.record.Name = title
 	return database.UpdateLstEntity(le.db, le.record)
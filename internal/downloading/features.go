@@ -41,22 +41,23 @@ func (pt TweetInDir) GetPath() string {
 
 var mutex sync.Mutex
 
-// 任何一个 url 下载失败直接返回
+// 任何一个 url 下载失败直接返回，返回值为已写入文件的字节数和下载失败的 url
 // TODO: 要么全做，要么不做
-func downloadTweetMedia(ctx context.Context, client *resty.Client, dir string, tweet *twitter.Tweet) error {
+func downloadTweetMedia(ctx context.Context, client *resty.Client, dir string, tweet *twitter.Tweet) (int64, string, error) {
 	text := utils.WinFileName(tweet.Text)
+	var written int64
 
 	for _, u := range tweet.Urls {
 		ext, err := utils.GetExtFromUrl(u)
 		if err != nil {
-			return err
+			return written, u, err
 		}
 
 		mutex.Lock()
 		path, err := utils.UniquePath(filepath.Join(dir, text+ext))
 		mutex.Unlock()
 		if err != nil {
-			return err
+			return written, u, err
 		}
 
 		// 检查文件是否已存在
@@ -68,28 +69,29 @@ func downloadTweetMedia(ctx context.Context, client *resty.Client, dir string, t
 		// 请求
 		resp, err := client.R().SetContext(ctx).SetQueryParam("name", "4096x4096").Get(u)
 		if err != nil {
-			return err
+			return written, u, err
 		}
 
 		file, err := os.Create(path)
 		if err != nil {
-			return err
+			return written, u, err
 		}
 		if err != nil {
-			return err
+			return written, u, err
 		}
 
 		defer os.Chtimes(path, time.Time{}, tweet.CreatedAt)
 		defer file.Close()
 
-		_, err = file.Write(resp.Body())
+		n, err := file.Write(resp.Body())
+		written += int64(n)
 		if err != nil {
-			return err
+			return written, u, err
 		}
 	}
 
 	fmt.Printf("%s %s\n", color.FgLightMagenta.Render("["+tweet.Creator.Title()+"]"), text)
-	return nil
+	return written, "", nil
 }
 
 var MaxDownloadRoutine int
@@ -146,7 +148,18 @@ func tweetDownloader(client *resty.Client, config *workerConfig, errch chan<- Pa
 			errch <- pt
 			continue
 		}
-		err := downloadTweetMedia(config.ctx, client, path, pt.GetTweet())
+		written, failedUrl, err := downloadTweetMedia(config.ctx, client, path, pt.GetTweet())
+		if recorder, ok := pt.(bytesRecorder); ok && written > 0 {
+			if err := recorder.recordBytes(written); err != nil {
+				log.WithField("worker", "downloading").Warnln("failed to record downloaded bytes:", err)
+			}
+		}
+		// 因取消而中断的下载不是下载失败
+		if recorder, ok := pt.(errorRecorder); ok && err != nil && config.ctx.Err() == nil {
+			if err := recorder.recordError(failedUrl, err); err != nil {
+				log.WithField("worker", "downloading").Warnln("failed to record download error:", err)
+			}
+		}
 		// 403: Dmcaed
 		if err != nil && !utils.IsStatusCode(err, 404) && !utils.IsStatusCode(err, 403) {
 			errch <- pt
@@ -262,6 +275,10 @@ func DownloadUser(ctx context.Context, db *sqlx.DB, client *resty.Client, user *
 	}
 
 	syncedUsers.Store(user.Id, entity)
+	if entity.Paused() {
+		log.WithField("user", user.Title()).Debugln("skipped paused user")
+		return nil, nil
+	}
 	tweets, err := getTweetAndUpdateLatestReleaseTime(ctx, client, user, entity)
 	if err != nil || len(tweets) == 0 {
 		return nil, err
@@ -280,7 +297,7 @@ func syncUserAndEntity(db *sqlx.DB, user *twitter.User, dir string) (*UserEntity
 	if err := syncUser(db, user); err != nil {
 		return nil, err
 	}
-	expectedTitle := utils.WinFileName(user.Title())
+	expectedTitle := database.UserEntityTitle(user.ScreenName, user.Name)
 
 	entity, err := NewUserEntity(db, user.Id, dir)
 	if err != nil {
@@ -297,6 +314,24 @@ type TweetInEntity struct {
 	Entity *UserEntity
 }
 
+// 下载推文后记录写入磁盘的字节数
+type bytesRecorder interface {
+	recordBytes(n int64) error
+}
+
+func (pt TweetInEntity) recordBytes(n int64) error {
+	return pt.Entity.AddBytes(n)
+}
+
+// 下载失败后记录失败的 url 和原因
+type errorRecorder interface {
+	recordError(url string, err error) error
+}
+
+func (pt TweetInEntity) recordError(url string, err error) error {
+	return pt.Entity.RecordDownloadError(pt.Tweet.Id, url, err)
+}
+
 func (pt TweetInEntity) GetTweet() *twitter.Tweet {
 	return pt.Tweet
 }
@@ -430,9 +465,9 @@ func BatchUserDownload(ctx context.Context, client *resty.Client, db *sqlx.DB, u
 				}
 
 				// 计算深度
-				if user.MediaCount != 0 && user.IsVisiable() {
-					missingTweets += max(0, user.MediaCount-int(pathEntity.record.MediaCount.Int32))
-					depthByEntity[pathEntity] = calcUserDepth(int(pathEntity.record.MediaCount.Int32), user.MediaCount)
+				if user.MediaCount != 0 && user.IsVisiable() && !pathEntity.Paused() {
+					missingTweets += max(0, user.MediaCount-pathEntity.record.MediaCount)
+					depthByEntity[pathEntity] = calcUserDepth(pathEntity.record.MediaCount, user.MediaCount)
 					userEntityHeap.Push(pathEntity)
 					deepest = max(deepest, depthByEntity[pathEntity])
 				}
@@ -474,7 +509,7 @@ func BatchUserDownload(ctx context.Context, client *resty.Client, db *sqlx.DB, u
 			linkpath, err := curlink.Path(db)
 			if err == nil {
 				if err = os.Symlink(upath, linkpath); err == nil || os.IsExist(err) {
-					err = database.CreateUserLink(db, curlink)
+					_, err = database.CreateUserLinkIfNotExists(db, curlink)
 				}
 			}
 			if err != nil {
@@ -554,10 +589,14 @@ func BatchUserDownload(ctx context.Context, client *resty.Client, db *sqlx.DB, u
 			}
 		}
 
-		if err := database.UpdateUserEntityTweetStat(db, entity.Id(), tweets[0].CreatedAt, user.MediaCount); err != nil {
+		advanced, err := database.UpdateUserEntityTweetStat(db, entity.Id(), tweets[0].CreatedAt, user.MediaCount)
+		if err != nil {
 			// 影响程序的正确性，必须 Panic
 			getterLogger.WithField("user", entity.Name()).Panicln("failed to update user tweets stat:", err)
 		}
+		if !advanced {
+			getterLogger.WithField("user", entity.Name()).Debugln("latest release time was not advanced")
+		}
 	}
 
 	// launch worker
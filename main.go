@@ -230,6 +230,8 @@ func main() {
 	var dbg bool
 	var autoFollow bool
 	var noRetry bool
+	var strictPaths bool
+	var relativePaths bool
 
 	flag.BoolVar(&confArg, "conf", false, "reconfigure")
 	flag.Var(&usrArgs, "user", "download tweets from the user specified by user_id/screen_name since the last download")
@@ -238,6 +240,8 @@ func main() {
 	flag.BoolVar(&dbg, "dbg", false, "display debug message")
 	flag.BoolVar(&autoFollow, "auto-follow", false, "send follow request automatically to protected users")
 	flag.BoolVar(&noRetry, "no-retry", false, "quickly exit without retrying failed tweets")
+	flag.BoolVar(&strictPaths, "strict-paths", false, "match download records by exact path only, never relocate them based on .user files or folder names")
+	flag.BoolVar(&relativePaths, "relative-paths", false, "store download paths relative to the storage root so the whole library can be moved; once used, it must always be passed")
 	flag.Parse()
 
 	var err error
@@ -350,7 +354,14 @@ func main() {
 	}
 
 	// connect db
-	db, err := connectDatabase(pathHelper.db)
+	var dbOpts []database.Option
+	if strictPaths {
+		dbOpts = append(dbOpts, database.WithStrictPaths())
+	}
+	if relativePaths {
+		dbOpts = append(dbOpts, database.WithLibraryRoot(pathHelper.root))
+	}
+	db, err := connectDatabase(pathHelper.db, dbOpts...)
 	if err != nil {
 		log.Fatalln("failed to connect to database:", err)
 	}
@@ -412,18 +423,16 @@ func setClientLogger(client *resty.Client, out io.Writer) {
 	client.SetLogger(logger)
 }
 
-func connectDatabase(path string) (*sqlx.DB, error) {
+func connectDatabase(path string, opts ...database.Option) (*sqlx.DB, error) {
 	ex, err := utils.PathExists(path)
 	if err != nil {
 		return nil, err
 	}
 
-	dsn := fmt.Sprintf("file:%s?_journal_mode=WAL&busy_timeout=2147483647", path)
-	db, err := sqlx.Connect("sqlite3", dsn)
+	db, err := database.OpenDB(path, opts...)
 	if err != nil {
 		return nil, err
 	}
-	database.CreateTables(db)
 	//db.SetMaxOpenConns(1)
 	if !ex {
 		log.Debugln("created new db file", path)